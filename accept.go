@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// Revealing the votes doesn't settle the estimate yet, the team might want
+// to discuss and re-vote. Once the moderator accepts the result, it is
+// written back to the tracker of the story. Until the next round starts,
+// votes are rejected, so that a revealed round is never counted twice.
+
+var ErrRoundRevealed = errors.New("the votes have been revealed already, start a new round to vote again")
+
+// revealedRound is the result of the current round after its votes were
+// revealed
+type revealedRound struct {
+	round Round
+	// story is a copy of the story of the round, or nil if there is none
+	story    *Story
+	accepted bool
+}
+
+// acceptHooks are called when the moderator accepts a round. They are
+// registered on startup and run like the round hooks.
+var acceptHooks []RoundHook
+
+func runAcceptHooks(session *Session, story *Story, round Round) {
+	runHooks(acceptHooks, session, story, round)
+}
+
+// isRevealed reports whether the votes of the current round are revealed
+func (s *Session) isRevealed() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.revealed != nil
+}
+
+// handleAccept accepts the revealed round. Only the moderator may accept,
+// and every round is accepted at most once.
+func (s *Session) handleAccept(msg Data) {
+	if !s.isModerator(msg.MyUser) {
+		// logger.Warn("user tried to accept the round without being moderator", "session", s.Id, "user", msg.MyUser.Name)
+		return
+	}
+
+	s.Lock()
+	revealed := s.revealed
+	if revealed == nil || revealed.accepted {
+		s.Unlock()
+		return
+	}
+	revealed.accepted = true
+	s.Unlock()
+
+	// logger.Info("round accepted", "session", s.Id, "recommendation", revealed.round.Recommendation)
+	runAcceptHooks(s, revealed.story, revealed.round)
+
+	d := resultData(revealed.round)
+	d.Accepted = true
+
+	go s.executeAllUsers(msg, func(ctx context.Context, user *User) {
+		data := d
+		data.MyUser = user
+		data.OtherUsers = s.getOtherUsers(user.Id)
+		data.Moderator = s.isModerator(user)
+
+		s.render(ctx, user, "users", data)
+	})
+}
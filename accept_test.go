@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls condition until it holds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// vote casts vote for user like a websocket message
+func vote(t *testing.T, session *Session, user *User, card string) error {
+	t.Helper()
+
+	data, err := session.messageEvent(context.Background(), user, HtmxWsResponse{Vote: card})
+	if err != nil {
+		return err
+	}
+	session.publish(data)
+	return nil
+}
+
+func trigger(session *Session, user *User, trigger string) {
+	data, _ := session.messageEvent(context.Background(), user, HtmxWsResponse{Headers: HtmxWsHeaders{HxTrigger: trigger}})
+	session.publish(data)
+}
+
+func TestAcceptWritesBackOnce(t *testing.T) {
+	server := newFakeJira(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	jira = newJiraClient(JiraConfig{URL: server.URL, Token: "pat", StoryPointsField: "customfield_10016"}, server.Client())
+	acceptHooks = []RoundHook{writeBackJira}
+	t.Cleanup(func() {
+		jira = nil
+		acceptHooks = nil
+	})
+
+	config = loadConfig()
+	session := startTestSession(t, "alice-id")
+	session.addStories([]*Story{{Key: "PROJ-1", Title: "Login", Source: storySourceJira}})
+
+	alice := &User{Id: "alice-id", Name: "Alice", Vote: noVote}
+	bob := &User{Id: "bob-id", Name: "Bob", Vote: noVote}
+	session.addUser(alice)
+	session.addUser(bob)
+
+	vote(t, session, alice, "5")
+	vote(t, session, bob, "8")
+	waitFor(t, "the reveal", session.isRevealed)
+
+	// votes are rejected until a new round starts
+	if err := vote(t, session, bob, "3"); !errors.Is(err, ErrRoundRevealed) {
+		t.Errorf("vote after reveal: err = %v, want %v", err, ErrRoundRevealed)
+	}
+	// only the moderator accepts
+	trigger(session, bob, "accept-round")
+	trigger(session, alice, "countdown-30")
+
+	if requests, _ := server.received(); len(requests) != 0 {
+		t.Fatalf("wrote back %d times before the round was accepted", len(requests))
+	}
+
+	trigger(session, alice, "accept-round")
+	trigger(session, alice, "accept-round")
+	waitFor(t, "the write-back", func() bool {
+		requests, _ := server.received()
+		return len(requests) > 0
+	})
+	// give a second write-back the chance to arrive
+	time.Sleep(50 * time.Millisecond)
+
+	session.RLock()
+	rounds := len(session.rounds)
+	session.RUnlock()
+	if rounds != 1 {
+		t.Errorf("%d rounds recorded, want 1", rounds)
+	}
+
+	requests, bodies := server.received()
+	if len(requests) != 1 || requests[0].URL.Path != "/rest/api/2/issue/PROJ-1" || bodies[0] != `{"fields":{"customfield_10016":8}}` {
+		t.Errorf("write-backs %v: %v", requests, bodies)
+	}
+
+	// a re-vote can be accepted again
+	trigger(session, alice, "revote")
+	waitFor(t, "the next round", func() bool { return !session.isRevealed() })
+	if err := vote(t, session, bob, "5"); err != nil {
+		t.Fatal(err)
+	}
+	vote(t, session, alice, "5")
+	waitFor(t, "the reveal of the re-vote", session.isRevealed)
+	trigger(session, alice, "accept-round")
+	waitFor(t, "the second write-back", func() bool {
+		requests, _ := server.received()
+		return len(requests) == 2
+	})
+	if _, bodies := server.received(); bodies[1] != `{"fields":{"customfield_10016":5}}` {
+		t.Errorf("second write-back %s", bodies[1])
+	}
+}
+
+func TestAsyncAcceptWritesBackOnce(t *testing.T) {
+	server := newFakeJira(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	jira = newJiraClient(JiraConfig{URL: server.URL, Token: "pat", StoryPointsField: "customfield_10016"}, server.Client())
+	acceptHooks = []RoundHook{writeBackJira}
+	t.Cleanup(func() {
+		jira = nil
+		acceptHooks = nil
+	})
+
+	app := newTestServer(t)
+	session := startTestSession(t, "alice-id")
+	session.room = &Room{
+		Slug:     "async",
+		Settings: RoomSettings{Async: &AsyncSettings{Days: 3}},
+		Queue: []*AsyncStory{
+			{
+				Id:     "a",
+				Story:  Story{Key: "PROJ-1", Title: "Login", Source: storySourceJira, Estimate: 8},
+				Votes:  map[string]AsyncVote{"bob-id": {Name: "Bob", Vote: 8}},
+				Result: &Round{Votes: map[string]RoundVote{"bob-id": {Name: "Bob", Vote: 8}}, Recommendation: 8},
+			},
+			{Id: "b", Story: Story{Key: "PROJ-2", Title: "Logout", Source: storySourceJira}},
+		},
+	}
+	accept := func(cookie *http.Cookie, story string) int {
+		return postForm(t, app.URL+"/async/"+session.Id+"/accept", url.Values{"story": {story}}, cookie).StatusCode
+	}
+
+	alice := identityCookie("alice-id", "Alice")
+	if status := accept(identityCookie("bob-id", "Bob"), "a"); status != http.StatusForbidden {
+		t.Errorf("accept of a participant responded with %d, want %d", status, http.StatusForbidden)
+	}
+	if status := accept(alice, "b"); status != http.StatusNotFound {
+		t.Errorf("accept of an open story responded with %d, want %d", status, http.StatusNotFound)
+	}
+	for range 2 {
+		if status := accept(alice, "a"); status != http.StatusOK {
+			t.Errorf("accept responded with %d", status)
+		}
+	}
+	resp := postForm(t, app.URL+"/async/"+session.Id+"/accept", url.Values{"story": {"a"}}, alice)
+	if body, _ := io.ReadAll(resp.Body); !strings.Contains(string(body), "Accepted") {
+		t.Errorf("digest after accept: %s", body)
+	}
+
+	waitFor(t, "the write-back", func() bool {
+		requests, _ := server.received()
+		return len(requests) > 0
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	requests, bodies := server.received()
+	if len(requests) != 1 || requests[0].URL.Path != "/rest/api/2/issue/PROJ-1" || bodies[0] != `{"fields":{"customfield_10016":8}}` {
+		t.Errorf("write-backs %v: %v", requests, bodies)
+	}
+	if view := session.asyncView(&User{Id: "alice-id"}); len(view.Digest) != 1 || !view.Digest[0].Accepted {
+		t.Errorf("digest = %+v", view.Digest)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ready reports whether the server accepts traffic. It is set once the
+// listeners are up and reset when the server is shutting down.
+var ready atomic.Bool
+
+var lockBanner sync.RWMutex
+var banner string
+
+// getBanner returns the maintenance banner that is currently shown in all
+// sessions. An empty string means there is no banner.
+func getBanner() string {
+	lockBanner.RLock()
+	defer lockBanner.RUnlock()
+	return banner
+}
+
+func setBanner(message string) {
+	lockBanner.Lock()
+	banner = message
+	lockBanner.Unlock()
+}
+
+func getHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+func getReadyz(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+type UserState struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	Vote      int    `json:"vote"`
+	Voted     bool   `json:"voted"`
+	Abstained bool   `json:"abstained"`
+}
+
+type SessionSummary struct {
+	Id           string    `json:"id"`
+	Name         string    `json:"name"`
+	Participants int       `json:"participants"`
+	CreatedAt    time.Time `json:"createdAt"`
+	LastActivity time.Time `json:"lastActivity"`
+	IdleSeconds  float64   `json:"idleSeconds"`
+}
+
+type SessionState struct {
+	SessionSummary
+	Scale    Scale       `json:"scale"`
+	AllVoted bool        `json:"allVoted"`
+	Users    []UserState `json:"users"`
+	// Result is the last completed round while its votes are shown
+	Result *Round `json:"result,omitempty"`
+	// History are all completed rounds, including re-votes
+	History []Round `json:"history,omitempty"`
+	// Stories is the story list and Story the index of the current story
+	Stories []Story `json:"stories,omitempty"`
+	Story   int     `json:"story"`
+}
+
+func (s *Session) summary() SessionSummary {
+	s.RLock()
+	defer s.RUnlock()
+
+	return SessionSummary{
+		Id:           s.Id,
+		Name:         s.Name,
+		Participants: len(s.Users),
+		CreatedAt:    s.createdAt,
+		LastActivity: s.lastActivity,
+		IdleSeconds:  time.Since(s.lastActivity).Seconds(),
+	}
+}
+
+func (s *Session) state() SessionState {
+	state := SessionState{
+		SessionSummary: s.summary(),
+		Scale:          s.scale.Cards,
+		AllVoted:       s.allUsersVoted(),
+	}
+
+	s.RLock()
+	if state.AllVoted && len(s.Users) > 0 && len(s.rounds) > 0 {
+		result := s.rounds[len(s.rounds)-1]
+		state.Result = &result
+	}
+	state.History = slices.Clone(s.rounds)
+	for _, story := range s.stories {
+		state.Stories = append(state.Stories, *story)
+	}
+	state.Story = s.story
+	for _, user := range s.Users {
+		state.Users = append(state.Users, UserState{
+			Id:        user.Id,
+			Name:      user.Name,
+			Vote:      user.Vote,
+			Voted:     user.Voted(),
+			Abstained: user.Abstained(),
+		})
+	}
+	s.RUnlock()
+
+	slices.SortFunc(state.Users, func(a, b UserState) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return state
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		// logger.Error("could not encode json", "error", err)
+	}
+}
+
+func adminListSessions(w http.ResponseWriter, r *http.Request) {
+	list := listSessions()
+
+	summaries := make([]SessionSummary, 0, len(list))
+	for _, session := range list {
+		summaries = append(summaries, session.summary())
+	}
+	slices.SortFunc(summaries, func(a, b SessionSummary) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+func adminGetSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSessionById(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, session.state())
+}
+
+func adminCloseSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSessionById(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	if !session.publish(Data{ctx: r.Context(), event: CLOSED}) {
+		http.Error(w, "session already closed", http.StatusGone)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type BannerRequest struct {
+	Message string `json:"message"`
+}
+
+// adminPostBanner shows a maintenance banner in all sessions. Sending an
+// empty message removes the banner.
+func adminPostBanner(w http.ResponseWriter, r *http.Request) {
+	var req BannerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	message := strings.TrimSpace(req.Message)
+	setBanner(message)
+
+	for _, session := range listSessions() {
+		session.publish(Data{ctx: r.Context(), event: BANNER, Banner: message})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireAdminToken only lets requests through that carry the configured
+// token as bearer token.
+func requireAdminToken(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "admin API is disabled, no token configured", http.StatusForbidden)
+			return
+		}
+
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// newAdminMux returns the handler for the admin listener. Metrics are
+// served without authentication, everything else requires the admin token.
+func newAdminMux(cfg AdminConfig, reg *prometheus.Registry) *http.ServeMux {
+	api := http.NewServeMux()
+	api.HandleFunc("GET /admin/sessions", adminListSessions)
+	api.HandleFunc("GET /admin/sessions/{id}", adminGetSession)
+	api.HandleFunc("DELETE /admin/sessions/{id}", adminCloseSession)
+	api.HandleFunc("POST /admin/banner", adminPostBanner)
+	api.HandleFunc("GET /admin/webhooks/deliveries", adminGetWebhookDeliveries)
+	api.HandleFunc("GET /admin/rooms/{slug}/webhooks", adminGetRoomWebhooks)
+	api.HandleFunc("PUT /admin/rooms/{slug}/webhooks", adminPutRoomWebhooks)
+	api.HandleFunc("GET /admin/rooms/{slug}/notifiers", adminGetRoomNotifiers)
+	api.HandleFunc("PUT /admin/rooms/{slug}/notifiers", adminPutRoomNotifiers)
+
+	api.HandleFunc("/debug/pprof/", pprof.Index)
+	api.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	api.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	api.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	api.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", requireAdminToken(cfg.Token, api))
+	mux.Handle("/debug/pprof/", requireAdminToken(cfg.Token, api))
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	mux.HandleFunc("/healthz", getHealthz)
+	mux.HandleFunc("/readyz", getReadyz)
+
+	return mux
+}
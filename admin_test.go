@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newAdminTestServer serves the admin listener with token
+func newAdminTestServer(t *testing.T, token string) *httptest.Server {
+	t.Helper()
+
+	config = loadConfig()
+	server := httptest.NewServer(newAdminMux(AdminConfig{Token: token}, newRegistry()))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// adminRequest sends a request to the admin listener with authorization
+// as Authorization header, if it is not empty
+func adminRequest(t *testing.T, method string, u string, authorization string) *http.Response {
+	t.Helper()
+
+	r, _ := http.NewRequest(method, u, nil)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestAdminToken(t *testing.T) {
+	server := newAdminTestServer(t, "secret")
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		want          int
+	}{
+		{"missing", "/admin/sessions", "", http.StatusUnauthorized},
+		{"wrong", "/admin/sessions", "Bearer wrong", http.StatusUnauthorized},
+		{"prefix of token", "/admin/sessions", "Bearer secre", http.StatusUnauthorized},
+		{"other scheme", "/admin/sessions", "Basic secret", http.StatusUnauthorized},
+		{"valid", "/admin/sessions", "Bearer secret", http.StatusOK},
+		{"pprof without token", "/debug/pprof/", "", http.StatusUnauthorized},
+		{"pprof", "/debug/pprof/", "Bearer secret", http.StatusOK},
+		{"metrics", "/metrics", "", http.StatusOK},
+		{"healthz", "/healthz", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := adminRequest(t, http.MethodGet, server.URL+tt.path, tt.authorization)
+			if resp.StatusCode != tt.want {
+				t.Errorf("%s responded with %d, want %d", tt.path, resp.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Error("WWW-Authenticate is missing")
+			}
+		})
+	}
+}
+
+func TestAdminCloseSessionRequiresToken(t *testing.T) {
+	server := newAdminTestServer(t, "secret")
+	session := startTestSession(t, "alice-id")
+
+	if resp := adminRequest(t, http.MethodDelete, server.URL+"/admin/sessions/"+session.Id, "Bearer wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("close with wrong token responded with %d", resp.StatusCode)
+	}
+	if session.closed() {
+		t.Fatal("session was closed with a wrong token")
+	}
+
+	if resp := adminRequest(t, http.MethodDelete, server.URL+"/admin/sessions/"+session.Id, "Bearer secret"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("close responded with %d", resp.StatusCode)
+	}
+	waitFor(t, "the closed session", session.closed)
+}
+
+func TestAdminDisabledWithoutToken(t *testing.T) {
+	server := newAdminTestServer(t, "")
+
+	for _, authorization := range []string{"", "Bearer ", "Bearer secret"} {
+		if resp := adminRequest(t, http.MethodGet, server.URL+"/admin/sessions", authorization); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("admin API with %q responded with %d", authorization, resp.StatusCode)
+		}
+	}
+	if resp := adminRequest(t, http.MethodGet, server.URL+"/debug/pprof/", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("pprof responded with %d", resp.StatusCode)
+	}
+	if resp := adminRequest(t, http.MethodGet, server.URL+"/metrics", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("metrics responded with %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Teams that span time zones estimate asynchronously. An async room keeps
+// a queue of stories that stay open for votes for a number of days.
+// Participants vote whenever they visit, but the votes are hidden until the
+// deadline of the story passes or a quorum has voted. The moderator sees a
+// digest of the revealed stories that are ready for discussion and accepts
+// their results, which writes them back to the trackers.
+//
+// Queue and votes are persisted with the room, so they survive the session
+// of the room going dormant and restarts of the server.
+
+const (
+	defaultAsyncDays = 3
+	maxAsyncDays     = 14
+	maxAsyncQuorum   = 100
+)
+
+// AsyncSettings turn a room into an async room
+type AsyncSettings struct {
+	// Days is how long a story is open for votes after it was queued
+	Days int `json:"days"`
+	// Quorum reveals a story as soon as this many participants voted. The
+	// deadline is waited for if it is 0.
+	Quorum int `json:"quorum,omitempty"`
+}
+
+// AsyncVote is the hidden vote of a participant
+type AsyncVote struct {
+	Name    string    `json:"name"`
+	Role    string    `json:"role,omitempty"`
+	Vote    int       `json:"vote"`
+	Special string    `json:"special,omitempty"`
+	VotedAt time.Time `json:"votedAt"`
+}
+
+// card is the vote as shown to the participant
+func (v AsyncVote) card() string {
+	if v.Vote == abstained {
+		return v.Special
+	}
+	return strconv.Itoa(v.Vote)
+}
+
+// AsyncStory is a story in the queue of an async room
+type AsyncStory struct {
+	Id string `json:"id"`
+	Story
+	QueuedAt time.Time `json:"queuedAt"`
+	Deadline time.Time `json:"deadline"`
+	// Votes maps participant ids to votes
+	Votes map[string]AsyncVote `json:"votes"`
+	// Result is set when the votes are revealed
+	Result *Round `json:"result,omitempty"`
+	// Discussed is set by the moderator and removes the story from the
+	// digest
+	Discussed bool `json:"discussed,omitempty"`
+	// Accepted is set when the moderator accepted the result, which wrote
+	// it back to the tracker of the story
+	Accepted bool `json:"accepted,omitempty"`
+}
+
+// due reports whether the votes of story have to be revealed
+func (story *AsyncStory) due(settings AsyncSettings, now time.Time) bool {
+	if settings.Quorum > 0 && len(story.Votes) >= settings.Quorum {
+		return true
+	}
+	return !now.Before(story.Deadline)
+}
+
+// AsyncStoryView is a story as shown to one participant
+type AsyncStoryView struct {
+	Id       string
+	Story    Story
+	Deadline time.Time
+	// Votes is the number of participants that voted
+	Votes int
+	// MyVote is the card the participant voted, if any
+	MyVote    string
+	Result    *Round
+	Discussed bool
+	Accepted  bool
+}
+
+// AsyncView is the queue of an async room as shown to one participant
+type AsyncView struct {
+	Settings AsyncSettings
+	Scale    ScaleDefinition
+	// Open are the stories that can be voted on, the earliest deadline
+	// first
+	Open []AsyncStoryView
+	// Revealed are the stories with results, the latest first
+	Revealed []AsyncStoryView
+	// Digest are the revealed stories the moderator hasn't discussed yet,
+	// the ones without consensus first. It is only set for the moderator.
+	Digest []AsyncStoryView
+}
+
+var ErrStoryNotFound = errors.New("story not found")
+var ErrStoryRevealed = errors.New("the votes of the story have been revealed already")
+
+// asyncSettings returns the settings of the room of s if it is an async
+// room, or nil otherwise
+func (s *Session) asyncSettings() *AsyncSettings {
+	if s.room == nil {
+		return nil
+	}
+
+	s.room.Lock()
+	defer s.room.Unlock()
+
+	if s.room.Settings.Async == nil {
+		return nil
+	}
+	settings := *s.room.Settings.Async
+	return &settings
+}
+
+// asyncView returns the queue of s as shown to user, or nil if s is not
+// an async session
+func (s *Session) asyncView(user *User) *AsyncView {
+	settings := s.asyncSettings()
+	if settings == nil {
+		return nil
+	}
+
+	view := &AsyncView{Settings: *settings, Scale: s.scale}
+
+	s.room.Lock()
+	for _, story := range s.room.Queue {
+		v := AsyncStoryView{
+			Id:        story.Id,
+			Story:     story.Story,
+			Deadline:  story.Deadline,
+			Votes:     len(story.Votes),
+			Result:    story.Result,
+			Discussed: story.Discussed,
+			Accepted:  story.Accepted,
+		}
+		v.Story.Rounds = nil
+		if vote, ok := story.Votes[user.Id]; ok {
+			v.MyVote = vote.card()
+		}
+
+		if story.Result == nil {
+			view.Open = append(view.Open, v)
+			continue
+		}
+		view.Revealed = append(view.Revealed, v)
+	}
+	s.room.Unlock()
+
+	slices.SortStableFunc(view.Open, func(a, b AsyncStoryView) int {
+		return a.Deadline.Compare(b.Deadline)
+	})
+	slices.SortStableFunc(view.Revealed, func(a, b AsyncStoryView) int {
+		return b.Result.CompletedAt.Compare(a.Result.CompletedAt)
+	})
+
+	if s.isModerator(user) {
+		for _, consensus := range []bool{false, true} {
+			for _, v := range view.Revealed {
+				if !v.Discussed && (v.Result.Consensus != consensusNone) == consensus {
+					view.Digest = append(view.Digest, v)
+				}
+			}
+		}
+	}
+	return view
+}
+
+// queueStories adds stories to the queue of an async room and returns how
+// many were added. Stories that are already queued are skipped.
+func (s *Session) queueStories(settings AsyncSettings, stories []*Story) int {
+	now := time.Now()
+
+	s.room.Lock()
+	added := 0
+	for _, story := range stories {
+		if len(s.room.Queue) >= maxStories {
+			break
+		}
+		queued := slices.ContainsFunc(s.room.Queue, func(existing *AsyncStory) bool {
+			return sameStory(&existing.Story, story)
+		})
+		if queued {
+			continue
+		}
+
+		story.Description = truncate(story.Description, maxDescriptionLength)
+		s.room.Queue = append(s.room.Queue, &AsyncStory{
+			Id:       randSeq(12, letters),
+			Story:    *story,
+			QueuedAt: now,
+			Deadline: now.Add(time.Duration(settings.Days) * 24 * time.Hour),
+			Votes:    make(map[string]AsyncVote),
+		})
+		added++
+	}
+	s.room.Unlock()
+
+	s.saveRoom()
+	return added
+}
+
+// castAsyncVote records the hidden vote of user for the story with the
+// given id and reveals the story if the quorum is reached
+func (s *Session) castAsyncVote(user *User, id string, vote int, special string) error {
+	s.room.Lock()
+	i := slices.IndexFunc(s.room.Queue, func(story *AsyncStory) bool { return story.Id == id })
+	if i < 0 {
+		s.room.Unlock()
+		return ErrStoryNotFound
+	}
+	story := s.room.Queue[i]
+	if story.Result != nil {
+		s.room.Unlock()
+		return ErrStoryRevealed
+	}
+
+	story.Votes[user.Id] = AsyncVote{
+		Name:    user.Name,
+		Role:    user.Role,
+		Vote:    vote,
+		Special: special,
+		VotedAt: time.Now(),
+	}
+	s.room.LastUsed = time.Now()
+	s.room.Unlock()
+
+	if !s.revealDueStories() {
+		s.saveRoom()
+	}
+	return nil
+}
+
+// revealDueStories reveals the votes of all stories whose deadline passed
+// or that reached the quorum. Like live rounds, their results become the
+// estimates of the stories, are recorded in the history and are handed to
+// the round hooks. It reports whether any story was revealed.
+func (s *Session) revealDueStories() bool {
+	settings := s.asyncSettings()
+	if settings == nil {
+		return false
+	}
+
+	now := time.Now()
+	var stories []Story
+	var rounds []Round
+
+	s.room.Lock()
+	for _, story := range s.room.Queue {
+		if story.Result != nil || !story.due(*settings, now) {
+			continue
+		}
+
+		ballots := make([]Ballot, 0, len(story.Votes))
+		for id, vote := range story.Votes {
+			ballots = append(ballots, Ballot{Id: id, Name: vote.Name, Role: vote.Role, Vote: vote.Vote})
+		}
+		round := s.tally(ballots)
+		round.Story = story.Key
+		story.Result = &round
+		if len(round.Votes) > 0 {
+			story.Estimate = round.Recommendation
+		}
+
+		stories = append(stories, story.Story)
+		rounds = append(rounds, round)
+	}
+	s.room.Unlock()
+
+	if len(rounds) == 0 {
+		return false
+	}
+
+	s.Lock()
+	s.rounds = append(s.rounds, rounds...)
+	s.Unlock()
+
+	for i, round := range rounds {
+		// logger.Info("revealing async story", "session", s.Id, "story", stories[i].Key, "votes", len(round.Votes))
+		totalEstimations.Inc()
+		s.room.addRound(round)
+		runRoundHooks(s, &stories[i], round)
+	}
+	s.saveRoom()
+	return true
+}
+
+// markDiscussed removes the story with the given id from the digest
+func (s *Session) markDiscussed(id string) error {
+	s.room.Lock()
+	i := slices.IndexFunc(s.room.Queue, func(story *AsyncStory) bool { return story.Id == id })
+	if i < 0 || s.room.Queue[i].Result == nil {
+		s.room.Unlock()
+		return ErrStoryNotFound
+	}
+	s.room.Queue[i].Discussed = true
+	s.room.Unlock()
+
+	s.saveRoom()
+	return nil
+}
+
+// acceptAsyncStory runs the accept hooks with the result of the story with
+// the given id. Like rounds of live sessions, every story is accepted at
+// most once.
+func (s *Session) acceptAsyncStory(id string) error {
+	s.room.Lock()
+	i := slices.IndexFunc(s.room.Queue, func(story *AsyncStory) bool { return story.Id == id })
+	if i < 0 || s.room.Queue[i].Result == nil {
+		s.room.Unlock()
+		return ErrStoryNotFound
+	}
+	story := s.room.Queue[i]
+	if story.Accepted {
+		s.room.Unlock()
+		return nil
+	}
+	story.Accepted = true
+	estimated := story.Story
+	estimated.Rounds = slices.Clone(story.Rounds)
+	round := *story.Result
+	s.room.Unlock()
+
+	s.saveRoom()
+
+	// logger.Info("async story accepted", "session", s.Id, "story", estimated.Key, "recommendation", round.Recommendation)
+	runAcceptHooks(s, &estimated, round)
+	return nil
+}
+
+// handleAsyncChanged shows the queue to all users after votes were cast,
+// stories were queued or revealed
+func (s *Session) handleAsyncChanged(msg Data) {
+	go s.executeAllUsers(msg, func(ctx context.Context, user *User) {
+		s.render(ctx, user, "async", s.asyncData(user))
+	})
+}
+
+func (s *Session) asyncData(user *User) Data {
+	return Data{
+		SessionId: s.Id,
+		MyUser:    user,
+		Moderator: s.isModerator(user),
+		Async:     s.asyncView(user),
+	}
+}
+
+// asyncSession returns the async session of the request and its user.
+// Otherwise an error is written and ok is false.
+func asyncSession(w http.ResponseWriter, r *http.Request) (session *Session, user *User, ok bool) {
+	session, ok = getSessionById(r.PathValue("id"))
+	if !ok || session.asyncSettings() == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	user = identify(w, r)
+	if user.Id == "" || !session.admits(user) || !session.hasAccess(r) {
+		http.Error(w, "you are not allowed to vote in this session", http.StatusForbidden)
+		return nil, nil, false
+	}
+	return session, user, true
+}
+
+// writeAsync answers requests of the async page with the queue, or with
+// the error if there is one
+func writeAsync(w http.ResponseWriter, session *Session, user *User, err error) {
+	switch {
+	case errors.Is(err, ErrStoryNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrStoryRevealed):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "async", session.asyncData(user)); err != nil {
+		// logger.Error("could not execute template", "template", "async", "session", session.Id, "error", err)
+	}
+}
+
+func postAsyncVote(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("POST /async/{sessionId}/vote").Inc()
+
+	session, user, ok := asyncSession(w, r)
+	if !ok {
+		return
+	}
+
+	vote, special, err := parseVote(session.scale, r.PostFormValue("vote"))
+	if err == nil {
+		err = session.castAsyncVote(user, r.PostFormValue("story"), vote, special)
+	}
+	if err == nil {
+		session.publish(Data{ctx: r.Context(), event: ASYNC_CHANGED, MyUser: user})
+	}
+	writeAsync(w, session, user, err)
+}
+
+// postAsyncDiscussed is used by the moderator to clear the digest
+func postAsyncDiscussed(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("POST /async/{sessionId}/discussed").Inc()
+
+	session, user, ok := asyncSession(w, r)
+	if !ok {
+		return
+	}
+	if !session.isModerator(user) {
+		http.Error(w, "only the moderator can mark stories as discussed", http.StatusForbidden)
+		return
+	}
+
+	err := session.markDiscussed(r.PostFormValue("story"))
+	if err == nil {
+		session.publish(Data{ctx: r.Context(), event: ASYNC_CHANGED, MyUser: user})
+	}
+	writeAsync(w, session, user, err)
+}
+
+// postAsyncAccept is used by the moderator to accept the result of a story
+// in the digest
+func postAsyncAccept(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("POST /async/{sessionId}/accept").Inc()
+
+	session, user, ok := asyncSession(w, r)
+	if !ok {
+		return
+	}
+	if !session.isModerator(user) {
+		http.Error(w, "only the moderator can accept stories", http.StatusForbidden)
+		return
+	}
+
+	err := session.acceptAsyncStory(r.PostFormValue("story"))
+	if err == nil {
+		session.publish(Data{ctx: r.Context(), event: ASYNC_CHANGED, MyUser: user})
+	}
+	writeAsync(w, session, user, err)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Users can optionally log in with OpenID Connect. Their display name then
+// comes from the ID token instead of the username form, and sessions can be
+// restricted to authenticated users or members of specific groups.
+
+const oidcFlowCookieName = "oidc-flow"
+
+// oidcFlowTTL is how long a user has to complete the login at the provider
+const oidcFlowTTL = 10 * time.Minute
+
+type oidcClient struct {
+	oauth2      oauth2.Config
+	verifier    *oidc.IDTokenVerifier
+	issuer      string
+	groupsClaim string
+}
+
+// oidcLogin is nil if OIDC is not configured
+var oidcLogin *oidcClient
+
+func newOIDCClient(ctx context.Context, cfg OIDCConfig) (*oidcClient, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oidcClient{
+		oauth2: oauth2.Config{
+			ClientID:     cfg.ClientId,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, cfg.Scopes...),
+		},
+		verifier:    provider.Verifier(&oidc.Config{ClientID: cfg.ClientId}),
+		issuer:      cfg.Issuer,
+		groupsClaim: cfg.GroupsClaim,
+	}, nil
+}
+
+// oidcFlow is kept in a signed cookie between the redirect to the provider
+// and the callback.
+type oidcFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Next     string `json:"next"`
+	Expiry   int64  `json:"exp"`
+}
+
+// safeRedirect only allows local paths as redirect target after login
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func loginURL(next string) string {
+	return "/auth/login?next=" + url.QueryEscape(next)
+}
+
+func getLogin(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("GET /auth/login").Inc()
+
+	if oidcLogin == nil {
+		http.Error(w, "login is not configured", http.StatusNotFound)
+		return
+	}
+
+	flow := oidcFlow{
+		State:    randSeq(32, letters),
+		Nonce:    randSeq(32, letters),
+		Verifier: oauth2.GenerateVerifier(),
+		Next:     safeRedirect(r.URL.Query().Get("next")),
+		Expiry:   time.Now().Add(oidcFlowTTL).Unix(),
+	}
+
+	payload, err := json.Marshal(flow)
+	if err != nil {
+		http.Error(w, "could not start login", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcFlowCookieName,
+		Value:    sign(string(payload)),
+		Path:     "/auth/",
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		// The callback is a cross-site navigation from the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	authURL := oidcLogin.oauth2.AuthCodeURL(flow.State,
+		oidc.Nonce(flow.Nonce),
+		oauth2.S256ChallengeOption(flow.Verifier),
+	)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+type idTokenClaims struct {
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	Email             string `json:"email"`
+}
+
+func getCallback(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("GET /auth/callback").Inc()
+
+	if oidcLogin == nil {
+		http.Error(w, "login is not configured", http.StatusNotFound)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcFlowCookieName)
+	if err != nil {
+		http.Error(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	clearCookieAt(w, oidcFlowCookieName, "/auth/")
+
+	var flow oidcFlow
+	payload, _, ok := verify(cookie.Value)
+	if !ok || json.Unmarshal([]byte(payload), &flow) != nil || time.Now().After(time.Unix(flow.Expiry, 0)) {
+		http.Error(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("state") != flow.State {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+	if e := query.Get("error"); e != "" {
+		// logger.Warn("login failed at provider", "error", e, "description", query.Get("error_description"))
+		http.Error(w, "login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	token, err := oidcLogin.oauth2.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(flow.Verifier))
+	if err != nil {
+		// logger.Error("could not exchange code", "error", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "login failed: no id token", http.StatusUnauthorized)
+		return
+	}
+
+	idToken, err := oidcLogin.verifier.Verify(r.Context(), rawIdToken)
+	if err != nil || idToken.Nonce != flow.Nonce {
+		// logger.Error("could not verify id token", "error", err)
+		http.Error(w, "login failed: invalid id token", http.StatusUnauthorized)
+		return
+	}
+
+	var claims idTokenClaims
+	var allClaims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, "login failed: invalid claims", http.StatusUnauthorized)
+		return
+	}
+	if err := idToken.Claims(&allClaims); err != nil {
+		http.Error(w, "login failed: invalid claims", http.StatusUnauthorized)
+		return
+	}
+
+	// use the first claim that is a valid name
+	name := ""
+	for _, candidate := range []string{claims.Name, claims.PreferredUsername, claims.Email, idToken.Subject} {
+		if valid, err := validateUserName(candidate); err == nil {
+			name = valid
+			break
+		}
+	}
+	if name == "" {
+		http.Error(w, "login failed: no valid name in id token", http.StatusUnauthorized)
+		return
+	}
+
+	setIdentityCookie(w, Identity{
+		Id:       oidcLogin.participantId(idToken.Subject),
+		Name:     name,
+		Subject:  idToken.Subject,
+		Groups:   stringsClaim(allClaims[oidcLogin.groupsClaim]),
+		IssuedAt: time.Now().Unix(),
+	})
+
+	// logger.Info("user logged in", "subject", idToken.Subject)
+	http.Redirect(w, r, flow.Next, http.StatusFound)
+}
+
+// participantId derives a stable participant id from the subject, so that
+// users keep e.g. moderator rights when they log in again.
+func (c *oidcClient) participantId(subject string) string {
+	sum := sha256.Sum256([]byte(c.issuer + "|" + subject))
+	return "oidc-" + base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// stringsClaim converts a claim that is either a list or a single string
+func stringsClaim(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		list := make([]string, 0, len(v))
+		for _, entry := range v {
+			if s, ok := entry.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	default:
+		return nil
+	}
+}
+
+func getLogout(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("GET /auth/logout").Inc()
+
+	clearCookie(w, identityCookieName)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// admits reports whether user may take part in the session. Sessions can be
+// restricted to logged in users or members of specific groups.
+func (s *Session) admits(user *User) bool {
+	if !s.requireLogin {
+		return true
+	}
+	if user.Subject == "" {
+		return false
+	}
+	if len(s.allowedGroups) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(user.Groups, func(group string) bool {
+		return slices.Contains(s.allowedGroups, group)
+	})
+}
+
+// rejectUser sends users that are not admitted to the login, or tells them
+// that they lack the required group.
+func rejectUser(w http.ResponseWriter, r *http.Request, session *Session, user *User) {
+	if user.Subject == "" && oidcLogin != nil {
+		next := r.URL.RequestURI()
+		if r.Method != http.MethodGet {
+			next = "/" + session.Id
+		}
+
+		// htmx requests need to be told to redirect the whole page
+		w.Header().Set("HX-Redirect", loginURL(next))
+		http.Redirect(w, r, loginURL(next), http.StatusSeeOther)
+		return
+	}
+
+	http.Error(w, "you are not allowed to join this session", http.StatusForbidden)
+}
+
+// parseGroups splits the comma-separated list of groups from the create form
+func parseGroups(groups string) []string {
+	var list []string
+	for _, group := range strings.Split(groups, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			list = append(list, group)
+		}
+	}
+	return list
+}
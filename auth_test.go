@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockProvider is an OpenID Connect provider that serves discovery, keys
+// and tokens. Users are logged in by approve instead of a login page.
+type mockProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	sync.Mutex
+	// grants maps codes to the authorization requests they were issued for
+	grants map[string]url.Values
+	// claims are added to the ID tokens
+	claims map[string]any
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockProvider{key: key, grants: make(map[string]url.Values), claims: make(map[string]any)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("GET /keys", p.keys)
+	mux.HandleFunc("POST /token", p.token)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *mockProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                p.URL,
+		"authorization_endpoint":                p.URL + "/authorize",
+		"token_endpoint":                        p.URL + "/token",
+		"jwks_uri":                              p.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *mockProvider) keys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+// approve logs the user in at the authorization URL and returns the
+// redirect to the callback
+func (p *mockProvider) approve(t *testing.T, authURL string) *url.URL {
+	t.Helper()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("authorization request without PKCE challenge: %s", authURL)
+	}
+
+	code := randSeq(16, letters)
+	p.Lock()
+	p.grants[code] = query
+	p.Unlock()
+
+	callback, _ := url.Parse(query.Get("redirect_uri"))
+	callback.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	return callback
+}
+
+func (p *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	p.Lock()
+	grant, ok := p.grants[r.Form.Get("code")]
+	delete(p.grants, r.Form.Get("code"))
+	p.Unlock()
+
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.Get("code_challenge") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	claims := map[string]any{
+		"iss":   p.URL,
+		"sub":   "alice",
+		"aud":   grant.Get("client_id"),
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": grant.Get("nonce"),
+		"name":  "Alice",
+	}
+	p.Lock()
+	for key, value := range p.claims {
+		claims[key] = value
+	}
+	p.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": randSeq(16, letters),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     p.sign(claims),
+	})
+}
+
+// sign returns claims as JWT signed with RS256
+func (p *mockProvider) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	sum := sha256.Sum256([]byte(unsigned))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, sum[:])
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// newOIDCTestServer serves the routes with the login via provider
+func newOIDCTestServer(t *testing.T, provider *mockProvider) *httptest.Server {
+	t.Helper()
+
+	server := newTestServer(t)
+	client, err := newOIDCClient(context.Background(), OIDCConfig{
+		Issuer:       provider.URL,
+		ClientId:     "pointing-poker",
+		ClientSecret: "secret",
+		RedirectURL:  server.URL + "/auth/callback",
+		Scopes:       []string{"profile", "groups"},
+		GroupsClaim:  "groups",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oidcLogin = client
+	t.Cleanup(func() { oidcLogin = nil })
+	return server
+}
+
+// noRedirects is a client that returns redirects instead of following them
+var noRedirects = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+func get(t *testing.T, u string, cookies ...*http.Cookie) *http.Response {
+	t.Helper()
+
+	r, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	resp, err := noRedirects.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func responseCookie(resp *http.Response, name string) *http.Cookie {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == name && cookie.Value != "" {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// startLogin starts the login and returns the flow cookie and the
+// authorization URL of the provider
+func startLogin(t *testing.T, server *httptest.Server, next string) (*http.Cookie, string) {
+	t.Helper()
+
+	resp := get(t, server.URL+loginURL(next))
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("login responded with %d", resp.StatusCode)
+	}
+	flow := responseCookie(resp, oidcFlowCookieName)
+	if flow == nil {
+		t.Fatal("login did not set the flow cookie")
+	}
+	return flow, resp.Header.Get("Location")
+}
+
+// logIn completes the login at provider and returns the identity cookie
+func logIn(t *testing.T, server *httptest.Server, provider *mockProvider) *http.Cookie {
+	t.Helper()
+
+	flow, authURL := startLogin(t, server, "/")
+	resp := get(t, provider.approve(t, authURL).String(), flow)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("callback responded with %d", resp.StatusCode)
+	}
+	identity := responseCookie(resp, identityCookieName)
+	if identity == nil {
+		t.Fatal("callback did not set the identity cookie")
+	}
+	return identity
+}
+
+func TestLogin(t *testing.T) {
+	provider := newMockProvider(t)
+	server := newOIDCTestServer(t, provider)
+
+	flow, authURL := startLogin(t, server, "/abc?invite=1")
+	if !strings.HasPrefix(authURL, provider.URL+"/authorize?") {
+		t.Fatalf("login redirects to %s", authURL)
+	}
+
+	resp := get(t, provider.approve(t, authURL).String(), flow)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("callback responded with %d", resp.StatusCode)
+	}
+	if location := resp.Header.Get("Location"); location != "/abc?invite=1" {
+		t.Errorf("callback redirects to %s, want /abc?invite=1", location)
+	}
+
+	cookie := responseCookie(resp, identityCookieName)
+	if cookie == nil {
+		t.Fatal("callback did not set the identity cookie")
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	user := identify(httptest.NewRecorder(), r)
+	if user.Name != "Alice" || user.Subject != "alice" || user.Id != oidcLogin.participantId("alice") {
+		t.Errorf("identity = %+v", user)
+	}
+}
+
+func TestLoginWithWrongVerifier(t *testing.T) {
+	provider := newMockProvider(t)
+	server := newOIDCTestServer(t, provider)
+
+	flow, authURL := startLogin(t, server, "/")
+	callback := provider.approve(t, authURL)
+
+	// a flow cookie of another login has a different verifier
+	other, _ := startLogin(t, server, "/")
+	payload, _, _ := verify(other.Value)
+	var otherFlow oidcFlow
+	json.Unmarshal([]byte(payload), &otherFlow)
+
+	payload, _, _ = verify(flow.Value)
+	var tampered oidcFlow
+	json.Unmarshal([]byte(payload), &tampered)
+	tampered.Verifier = otherFlow.Verifier
+	signed, _ := json.Marshal(tampered)
+
+	resp := get(t, callback.String(), &http.Cookie{Name: oidcFlowCookieName, Value: sign(string(signed))})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("callback responded with %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if responseCookie(resp, identityCookieName) != nil {
+		t.Error("callback set the identity cookie")
+	}
+}
+
+func TestLoginStateMismatch(t *testing.T) {
+	provider := newMockProvider(t)
+	server := newOIDCTestServer(t, provider)
+
+	_, authURL := startLogin(t, server, "/")
+	callback := provider.approve(t, authURL)
+
+	// the flow cookie belongs to another login
+	other, _ := startLogin(t, server, "/")
+	resp := get(t, callback.String(), other)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback responded with %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if responseCookie(resp, identityCookieName) != nil {
+		t.Error("callback set the identity cookie")
+	}
+
+	resp = get(t, callback.String())
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback without flow responded with %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestAllowedGroups(t *testing.T) {
+	provider := newMockProvider(t)
+	server := newOIDCTestServer(t, provider)
+
+	session := startTestSession(t, "moderator-id")
+	session.requireLogin = true
+	session.allowedGroups = []string{"team-a"}
+
+	// anonymous users are sent to the login
+	resp := get(t, server.URL+"/"+session.Id, identityCookie("bob-id", "Bob"))
+	if resp.StatusCode != http.StatusSeeOther || !strings.HasPrefix(resp.Header.Get("Location"), "/auth/login?") {
+		t.Errorf("anonymous user got %d to %s, want the login", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	tests := []struct {
+		name   string
+		groups any
+		want   int
+	}{
+		{"member", []string{"team-b", "team-a"}, http.StatusOK},
+		{"single group claim", "team-a", http.StatusOK},
+		{"other group", []string{"team-b"}, http.StatusForbidden},
+		{"no groups", nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider.Lock()
+			provider.claims["groups"] = tt.groups
+			provider.Unlock()
+
+			resp := get(t, server.URL+"/"+session.Id, logIn(t, server, provider))
+			if resp.StatusCode != tt.want {
+				t.Errorf("session page responded with %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// renderResult renders the users template with the round of ballots as
+// seen by the moderator or another user
+func renderResult(t *testing.T, session *Session, moderator bool, ballots ...Ballot) string {
+	t.Helper()
+
+	d := resultData(session.tally(ballots))
+	d.MyUser = &User{Id: ballots[0].Id, Name: ballots[0].Name, Vote: ballots[0].Vote}
+	d.Moderator = moderator
+
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, "users", d); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestAcceptWithoutRecommendation(t *testing.T) {
+	ballots := []Ballot{
+		{Id: "moderator-id", Name: "Mo", Vote: abstained},
+		{Id: "b", Name: "Bob", Vote: abstained},
+	}
+
+	if html := renderResult(t, testSession(), true, ballots...); !strings.Contains(html, `id="accept-round"`) {
+		t.Errorf("the moderator can't accept a round without recommendation:\n%s", html)
+	}
+	if html := renderResult(t, testSession(), false, ballots...); strings.Contains(html, `id="accept-round"`) {
+		t.Errorf("users that aren't moderator can accept:\n%s", html)
+	}
+}
+
+func TestRevoteWithoutVotes(t *testing.T) {
+	tests := []struct {
+		name    string
+		ballots []Ballot
+	}{
+		{"everyone abstained", []Ballot{{Id: "a", Name: "Alex", Vote: abstained}, {Id: "b", Name: "Bob", Vote: abstained}}},
+		{"nobody voted", []Ballot{{Id: "a", Name: "Alex", Vote: noVote}, {Id: "b", Name: "Bob", Vote: noVote}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if html := renderResult(t, testSession(), false, tt.ballots...); !strings.Contains(html, `id="revote"`) {
+				t.Errorf("no re-vote button:\n%s", html)
+			}
+		})
+	}
+}
+
+func TestResultOfZeroCard(t *testing.T) {
+	scale := ScaleDefinition{Name: "zero", Title: "Zero", Cards: Scale{0, 1, 2, 3}, Special: []string{"?"}}
+	if err := scale.validate(); err != nil {
+		t.Fatal(err)
+	}
+	session := newSessionState("Test", "moderator-id", scale, ExpiryPolicy{})
+
+	html := renderResult(t, session, true,
+		Ballot{Id: "moderator-id", Name: "Mo", Vote: 0},
+		Ballot{Id: "b", Name: "Bob", Vote: 0},
+		Ballot{Id: "c", Name: "Cy", Vote: abstained},
+	)
+	for _, want := range []string{"Recommendation", "Consensus! Everybody voted 0.", `id="accept-round"`} {
+		if !strings.Contains(html, want) {
+			t.Errorf("result of a 0 consensus lacks %q:\n%s", want, html)
+		}
+	}
+	if strings.Contains(html, "Nobody voted") {
+		t.Errorf("votes for 0 are shown as nobody voted:\n%s", html)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds all settings that can be changed by the operator. Every
+// setting is read from an environment variable prefixed with POKER_.
+type Config struct {
+	Tracing TracingConfig
+	Admin   AdminConfig
+	Expiry  ExpiryPolicy
+	// AsyncExpiry applies to the sessions of async rooms, which are used
+	// over days
+	AsyncExpiry ExpiryPolicy
+	// SessionIds configures how session ids are generated
+	SessionIds SessionIdConfig
+	Protection ProtectionConfig
+	OIDC       OIDCConfig
+	Security   SecurityConfig
+	Limits     LimitsConfig
+	Jira       JiraConfig
+	Issues     IssuesConfig
+	Slack      SlackConfig
+	Webhooks   WebhooksConfig
+	Notify     NotifyConfig
+	// Secrets are the keys cookies and tokens are signed with. The first one
+	// signs, all of them are accepted. A random key is used if it is empty.
+	Secrets []string
+	// RoleWeights are entries of the form role=weight. They map the roles
+	// users can choose to the weight of their votes in the weighted
+	// recommendation strategy.
+	RoleWeights []string
+	// ScalesFile is a JSON file with scales that are offered in addition
+	// to the built-in ones
+	ScalesFile string
+	// DataDir is where persistent rooms are stored. Rooms are only kept
+	// in memory if it is empty.
+	DataDir string
+}
+
+// config is loaded once on startup
+var config Config
+
+type SessionIdConfig struct {
+	Length   int
+	Alphabet string
+	// JoinCodes enables short, readable codes like ABC-123 for every session
+	JoinCodes bool
+}
+
+// minIdEntropy is the minimum number of random bits in a session id
+const minIdEntropy = 64
+
+func (c SessionIdConfig) validate() error {
+	alphabet := []rune(c.Alphabet)
+	if len(alphabet) < 2 {
+		return errors.New("session id alphabet needs at least two characters")
+	}
+	if float64(c.Length)*math.Log2(float64(len(alphabet))) < minIdEntropy {
+		return fmt.Errorf("session ids need at least %d bits of entropy, increase length or alphabet", minIdEntropy)
+	}
+	return nil
+}
+
+type ProtectionConfig struct {
+	// AccessTTL is how long access to a protected session is remembered
+	AccessTTL time.Duration
+	// InviteTTL is how long invite links are valid
+	InviteTTL time.Duration
+	// MaxFailedAttempts is how many wrong passphrases a client may enter
+	// per session within FailedAttemptsWindow
+	MaxFailedAttempts    int
+	FailedAttemptsWindow time.Duration
+}
+
+// LimitsConfig protects the server against clients that create sessions or
+// send messages in a loop. Rates and maximums of zero disable the limit.
+type LimitsConfig struct {
+	// CreateRate is how many sessions a client may create per minute
+	CreateRate  float64
+	CreateBurst int
+	// JoinRate is how many times a client may submit the join form per
+	// minute
+	JoinRate  float64
+	JoinBurst int
+	// ConnectRate is how many websocket connections and event streams a
+	// client may open per minute. Reconnects count separately from joins,
+	// so that they can't lock a client out of the join form.
+	ConnectRate  float64
+	ConnectBurst int
+	// MessageRate is how many messages a websocket connection may send per
+	// second. Messages above the rate are dropped.
+	MessageRate  float64
+	MessageBurst int
+	MaxSessions  int
+	// MaxParticipants is the maximum number of users per session
+	MaxParticipants int
+	// MaxMessageSize is the maximum size of a websocket message in bytes.
+	// Connections that send larger messages are closed.
+	MaxMessageSize int
+}
+
+type SecurityConfig struct {
+	// AllowedOrigins are host patterns of other origins that may open
+	// websocket connections. The own host is always allowed.
+	AllowedOrigins []string
+	// HSTSMaxAge is sent in the Strict-Transport-Security header on TLS
+	// connections. HSTS is disabled if it is zero.
+	HSTSMaxAge time.Duration
+	// PublicURL is the URL of the app links are built from, e.g. behind a
+	// proxy. They are built from the request if it is empty.
+	PublicURL string
+}
+
+// validate checks that all origin patterns can be matched and that the
+// public URL is absolute
+func (c SecurityConfig) validate() error {
+	for _, pattern := range c.AllowedOrigins {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid origin pattern %q: %w", pattern, err)
+		}
+	}
+	if c.PublicURL != "" {
+		u, err := url.Parse(c.PublicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("invalid public URL %q", c.PublicURL)
+		}
+	}
+	return nil
+}
+
+// OIDCConfig configures the optional login via OpenID Connect. Login is
+// disabled if Issuer is empty.
+type OIDCConfig struct {
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	// RedirectURL has to point to /auth/callback of this server
+	RedirectURL string
+	// Scopes are requested in addition to openid
+	Scopes []string
+	// GroupsClaim is the claim of the ID token that holds the groups
+	GroupsClaim string
+}
+
+// JiraConfig configures the import of Jira issues. It is disabled if URL
+// is empty.
+type JiraConfig struct {
+	URL string
+	// User is the email of the account the token belongs to. Leave it empty
+	// to send the token as bearer token, e.g. a personal access token of
+	// Jira Data Center.
+	User  string
+	Token string
+	// StoryPointsField is the id of the field estimates are written to
+	StoryPointsField string
+	// Groups restricts the import to moderators that logged in via OIDC
+	// and are member of one of them
+	Groups []string
+	// Projects limits imported issues to these project keys, Boards limits
+	// sprint imports to these board ids. Without Groups, JQL queries are
+	// only allowed if Projects is set.
+	Projects []string
+	Boards   []string
+}
+
+// IssuesConfig configures the import of GitHub and GitLab issues. A
+// provider is disabled if its URL is empty.
+type IssuesConfig struct {
+	GitHubURL string
+	// GitLabURL is the URL of the GitLab instance, not of its API
+	GitLabURL string
+}
+
+// SlackConfig configures the /poker slash command. It is disabled if
+// SigningSecret is empty.
+type SlackConfig struct {
+	SigningSecret string
+	// ResponseURLPrefix is what response URLs of Slack have to start with
+	ResponseURLPrefix string
+	// Scale is the scale of sessions started with the slash command
+	Scale string
+}
+
+// WebhooksConfig configures outbound webhooks. Events are sent to URLs
+// in addition to the webhooks of rooms.
+type WebhooksConfig struct {
+	URLs []string
+	// Secret signs the payloads sent to URLs
+	Secret string
+	// Workers is the number of deliveries that are sent at once
+	Workers   int
+	QueueSize int
+	// MaxAttempts is how often a delivery is tried before it is given up
+	MaxAttempts int
+	// Timeout limits a single attempt
+	Timeout time.Duration
+}
+
+// NotifyConfig configures where results are posted to
+type NotifyConfig struct {
+	// Notifiers are entries of the form format=url
+	Notifiers []string
+	// TemplateFile replaces the default message template if it is set
+	TemplateFile string
+}
+
+type AdminConfig struct {
+	// Addr is the listen address of the admin API, metrics and pprof. It
+	// should not be reachable from the internet.
+	Addr string
+	// Token has to be sent as bearer token to use the admin API and pprof.
+	// The admin API is disabled if it is empty.
+	Token string
+}
+
+type TracingConfig struct {
+	// Enabled turns on exporting of spans via OTLP/HTTP
+	Enabled bool
+	// Endpoint is the host:port of the OTLP/HTTP collector
+	Endpoint string
+	// Insecure disables TLS for the connection to the collector
+	Insecure    bool
+	ServiceName string
+	// SampleRatio is the fraction of traces that are sampled, between 0 and 1
+	SampleRatio float64
+}
+
+func loadConfig() Config {
+	return Config{
+		Tracing: TracingConfig{
+			Enabled:     getenvBool("POKER_TRACING_ENABLED", false),
+			Endpoint:    getenv("POKER_OTLP_ENDPOINT", "localhost:4318"),
+			Insecure:    getenvBool("POKER_OTLP_INSECURE", true),
+			ServiceName: getenv("POKER_SERVICE_NAME", "pointing-poker"),
+			SampleRatio: getenvFloat("POKER_TRACING_SAMPLE_RATIO", 1),
+		},
+		Admin: AdminConfig{
+			Addr:  getenv("POKER_ADMIN_ADDR", "127.0.0.1:9090"),
+			Token: getenv("POKER_ADMIN_TOKEN", ""),
+		},
+		Expiry: ExpiryPolicy{
+			EmptyTTL:           getenvDuration("POKER_SESSION_EMPTY_TTL", 10*time.Minute),
+			InactivityTTL:      getenvDuration("POKER_SESSION_INACTIVITY_TTL", time.Hour),
+			PresenceIsActivity: getenvBool("POKER_SESSION_PRESENCE_IS_ACTIVITY", true),
+			MaxLifetime:        getenvDuration("POKER_SESSION_MAX_LIFETIME", 12*time.Hour),
+			WarnBefore:         getenvDuration("POKER_SESSION_WARN_BEFORE", 5*time.Minute),
+			Extension:          getenvDuration("POKER_SESSION_EXTENSION", time.Hour),
+		},
+		AsyncExpiry: ExpiryPolicy{
+			EmptyTTL:           getenvDuration("POKER_ASYNC_EMPTY_TTL", 24*time.Hour),
+			InactivityTTL:      getenvDuration("POKER_ASYNC_INACTIVITY_TTL", 3*24*time.Hour),
+			PresenceIsActivity: true,
+			MaxLifetime:        getenvDuration("POKER_ASYNC_MAX_LIFETIME", 14*24*time.Hour),
+			WarnBefore:         getenvDuration("POKER_SESSION_WARN_BEFORE", 5*time.Minute),
+			Extension:          getenvDuration("POKER_ASYNC_EXTENSION", 24*time.Hour),
+		},
+		SessionIds: SessionIdConfig{
+			Length:    getenvInt("POKER_SESSION_ID_LENGTH", 16),
+			Alphabet:  getenv("POKER_SESSION_ID_ALPHABET", letters),
+			JoinCodes: getenvBool("POKER_JOIN_CODES", true),
+		},
+		Protection: ProtectionConfig{
+			AccessTTL:            getenvDuration("POKER_ACCESS_TTL", 30*24*time.Hour),
+			InviteTTL:            getenvDuration("POKER_INVITE_TTL", 24*time.Hour),
+			MaxFailedAttempts:    getenvInt("POKER_MAX_FAILED_ATTEMPTS", 5),
+			FailedAttemptsWindow: getenvDuration("POKER_FAILED_ATTEMPTS_WINDOW", 15*time.Minute),
+		},
+		OIDC: OIDCConfig{
+			Issuer:       getenv("POKER_OIDC_ISSUER", ""),
+			ClientId:     getenv("POKER_OIDC_CLIENT_ID", ""),
+			ClientSecret: getenv("POKER_OIDC_CLIENT_SECRET", ""),
+			RedirectURL:  getenv("POKER_OIDC_REDIRECT_URL", ""),
+			Scopes:       getenvList("POKER_OIDC_SCOPES", "profile,email,groups"),
+			GroupsClaim:  getenv("POKER_OIDC_GROUPS_CLAIM", "groups"),
+		},
+		Security: SecurityConfig{
+			AllowedOrigins: getenvList("POKER_ALLOWED_ORIGINS", ""),
+			HSTSMaxAge:     getenvDuration("POKER_HSTS_MAX_AGE", 365*24*time.Hour),
+			PublicURL:      getenv("POKER_PUBLIC_URL", ""),
+		},
+		Limits: LimitsConfig{
+			CreateRate:      getenvFloat("POKER_CREATE_RATE", 10),
+			CreateBurst:     getenvInt("POKER_CREATE_BURST", 5),
+			JoinRate:        getenvFloat("POKER_JOIN_RATE", 30),
+			JoinBurst:       getenvInt("POKER_JOIN_BURST", 10),
+			ConnectRate:     getenvFloat("POKER_CONNECT_RATE", 60),
+			ConnectBurst:    getenvInt("POKER_CONNECT_BURST", 20),
+			MessageRate:     getenvFloat("POKER_WS_MESSAGE_RATE", 5),
+			MessageBurst:    getenvInt("POKER_WS_MESSAGE_BURST", 20),
+			MaxSessions:     getenvInt("POKER_MAX_SESSIONS", 1000),
+			MaxParticipants: getenvInt("POKER_MAX_PARTICIPANTS", 100),
+			MaxMessageSize:  getenvInt("POKER_WS_MAX_MESSAGE_SIZE", 4096),
+		},
+		Jira: JiraConfig{
+			URL:              getenv("POKER_JIRA_URL", ""),
+			User:             getenv("POKER_JIRA_USER", ""),
+			Token:            getenv("POKER_JIRA_TOKEN", ""),
+			StoryPointsField: getenv("POKER_JIRA_STORY_POINTS_FIELD", "customfield_10016"),
+			Groups:           getenvList("POKER_JIRA_GROUPS", ""),
+			Projects:         getenvList("POKER_JIRA_PROJECTS", ""),
+			Boards:           getenvList("POKER_JIRA_BOARDS", ""),
+		},
+		Issues: IssuesConfig{
+			GitHubURL: getenv("POKER_GITHUB_API_URL", "https://api.github.com"),
+			GitLabURL: getenv("POKER_GITLAB_URL", "https://gitlab.com"),
+		},
+		Slack: SlackConfig{
+			SigningSecret:     getenv("POKER_SLACK_SIGNING_SECRET", ""),
+			ResponseURLPrefix: getenv("POKER_SLACK_RESPONSE_URL_PREFIX", "https://hooks.slack.com/"),
+			Scale:             getenv("POKER_SLACK_SCALE", defaultScale),
+		},
+		Webhooks: WebhooksConfig{
+			URLs:        getenvList("POKER_WEBHOOK_URLS", ""),
+			Secret:      getenv("POKER_WEBHOOK_SECRET", ""),
+			Workers:     getenvInt("POKER_WEBHOOK_WORKERS", 4),
+			QueueSize:   getenvInt("POKER_WEBHOOK_QUEUE_SIZE", 1000),
+			MaxAttempts: getenvInt("POKER_WEBHOOK_MAX_ATTEMPTS", 5),
+			Timeout:     getenvDuration("POKER_WEBHOOK_TIMEOUT", 10*time.Second),
+		},
+		Notify: NotifyConfig{
+			Notifiers:    getenvList("POKER_NOTIFY_URLS", ""),
+			TemplateFile: getenv("POKER_NOTIFY_TEMPLATE_FILE", ""),
+		},
+		Secrets:     getenvList("POKER_SECRETS", ""),
+		RoleWeights: getenvList("POKER_ROLE_WEIGHTS", "developer=1,tester=1,designer=1,product=0.5"),
+		ScalesFile:  getenv("POKER_SCALES_FILE", ""),
+		DataDir:     getenv("POKER_DATA_DIR", ""),
+	}
+}
+
+func getenv(key string, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
+
+// getenvList splits a comma-separated variable and drops empty entries
+func getenvList(key string, fallback string) []string {
+	var list []string
+	for _, v := range strings.Split(getenv(key, fallback), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func getenvBool(key string, fallback bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func getenvInt(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func getenvFloat(key string, fallback float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"slices"
+)
+
+// When the votes are revealed, the round is checked for consensus. If the
+// team doesn't agree, the users with the highest and the lowest votes are
+// highlighted, so that they can explain their estimate before a re-vote.
+
+type Consensus string
+
+const (
+	// consensusNone means the votes are more than one card apart
+	consensusNone Consensus = ""
+	// consensusUnanimous means everybody voted for the same card
+	consensusUnanimous Consensus = "unanimous"
+	// consensusNear means all votes are on neighbouring cards
+	consensusNear Consensus = "near"
+)
+
+// analyze sets the spread metrics and the consensus of round
+func (round *Round) analyze(scale Scale) {
+	votes := make([]int, 0, len(round.Votes))
+	for _, vote := range round.Votes {
+		votes = append(votes, vote.Vote)
+	}
+	if len(votes) == 0 {
+		return
+	}
+
+	round.Min = slices.Min(votes)
+	round.Max = slices.Max(votes)
+	round.StdDev = stddev(votes)
+
+	lowest := slices.Index(scale, round.Min)
+	highest := slices.Index(scale, round.Max)
+
+	switch {
+	case round.Min == round.Max:
+		round.Consensus = consensusUnanimous
+	case lowest >= 0 && highest >= 0 && highest-lowest <= 1:
+		round.Consensus = consensusNear
+	default:
+		round.Consensus = consensusNone
+	}
+
+	if round.Consensus != consensusNone {
+		return
+	}
+
+	for _, vote := range round.Votes {
+		if vote.Vote == round.Max {
+			round.Highest = append(round.Highest, vote.Name)
+		}
+		if vote.Vote == round.Min {
+			round.Lowest = append(round.Lowest, vote.Name)
+		}
+	}
+	slices.Sort(round.Highest)
+	slices.Sort(round.Lowest)
+}
+
+// resultData returns the data the users template needs to show round
+func resultData(round Round) Data {
+	return Data{
+		AllVoted:       true,
+		Average:        round.Average,
+		Median:         round.Median,
+		Recommendation: round.Recommendation,
+		Result:         &round,
+	}
+}
+
+// Extreme is used by the users template to highlight users with the
+// highest or the lowest vote if there is no consensus
+func (d Data) Extreme(user *User) string {
+	if d.Result == nil || d.Result.Consensus != consensusNone || !user.Voted() || user.Abstained() {
+		return ""
+	}
+
+	switch user.Vote {
+	case d.Result.Max:
+		return "highest"
+	case d.Result.Min:
+		return "lowest"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The moderator can start a countdown for the current round. Every second
+// the remaining time is pushed to all users. When the countdown runs out,
+// users that haven't voted yet abstain and the votes are revealed.
+
+// countdownOptions are the durations the moderator can choose from
+var countdownOptions = []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute}
+
+const countdownInterval = time.Second
+
+type CountdownOption struct {
+	Seconds int
+	Label   string
+}
+
+// CountdownOptions is used by the session template to render the buttons
+// of the moderator
+func (d Data) CountdownOptions() []CountdownOption {
+	options := make([]CountdownOption, 0, len(countdownOptions))
+	for _, option := range countdownOptions {
+		label := fmt.Sprintf("%ds", int(option.Seconds()))
+		if option%time.Minute == 0 {
+			label = fmt.Sprintf("%dmin", int(option.Minutes()))
+		}
+		options = append(options, CountdownOption{Seconds: int(option.Seconds()), Label: label})
+	}
+	return options
+}
+
+// countdownTick returns the channel of the countdown ticker. It is nil if
+// no countdown is running, which disables its case in handleBroadcast.
+func (s *Session) countdownTick() <-chan time.Time {
+	if s.countdown == nil {
+		return nil
+	}
+	return s.countdown.C
+}
+
+// countdownRemaining returns the seconds until the votes are revealed, or
+// zero if no countdown is running
+func (s *Session) countdownRemaining() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.deadline.IsZero() {
+		return 0
+	}
+	return max(int(math.Ceil(time.Until(s.deadline).Seconds())), 0)
+}
+
+// stopCountdown stops the countdown and reports whether one was running
+func (s *Session) stopCountdown() bool {
+	if s.countdown == nil {
+		return false
+	}
+
+	s.countdown.Stop()
+	s.countdown = nil
+
+	s.Lock()
+	s.deadline = time.Time{}
+	s.Unlock()
+
+	return true
+}
+
+// handleCountdown starts a countdown of msg.Countdown seconds. Only the
+// moderator may start a countdown, and only while the round is running.
+func (s *Session) handleCountdown(msg Data) {
+	if !s.isModerator(msg.MyUser) {
+		// logger.Warn("user tried to start countdown without being moderator", "session", s.Id, "user", msg.MyUser.Name)
+		return
+	}
+
+	duration := time.Duration(msg.Countdown) * time.Second
+	if !slices.Contains(countdownOptions, duration) {
+		// logger.Warn("invalid countdown", "session", s.Id, "seconds", msg.Countdown)
+		return
+	}
+
+	if s.isRevealed() {
+		return
+	}
+
+	// logger.Info("countdown started", "session", s.Id, "duration", duration)
+	s.stopCountdown()
+	s.countdown = time.NewTicker(countdownInterval)
+
+	s.Lock()
+	s.deadline = time.Now().Add(duration)
+	s.Unlock()
+
+	s.renderCountdown(msg)
+}
+
+// checkCountdown is called by the broadcast loop every second while a
+// countdown is running
+func (s *Session) checkCountdown() {
+	ctx, span := tracer.Start(context.Background(), "Session.checkCountdown", trace.WithAttributes(sessionAttributes(s)...))
+	defer span.End()
+
+	msg := Data{ctx: ctx, event: COUNTDOWN, publishedAt: time.Now()}
+
+	if s.countdownRemaining() > 0 {
+		s.renderCountdown(msg)
+		return
+	}
+
+	// logger.Info("countdown ran out", "session", s.Id)
+	s.forceReveal(msg)
+}
+
+// forceReveal lets users that haven't voted yet abstain and reveals the
+// votes
+func (s *Session) forceReveal(msg Data) {
+	s.Lock()
+	for _, user := range s.Users {
+		if !user.Voted() {
+			user.Vote = abstained
+		}
+	}
+	s.Unlock()
+
+	s.reveal(msg)
+}
+
+// handleReveal reveals the votes before everyone has voted. Only the
+// moderator may do that.
+func (s *Session) handleReveal(msg Data) {
+	if !s.isModerator(msg.MyUser) {
+		// logger.Warn("user tried to reveal votes without being moderator", "session", s.Id, "user", msg.MyUser.Name)
+		return
+	}
+	if s.isRevealed() {
+		return
+	}
+
+	s.forceReveal(msg)
+}
+
+func (s *Session) renderCountdown(msg Data) {
+	remaining := s.countdownRemaining()
+
+	go s.executeAllUsers(msg, func(ctx context.Context, user *User) {
+		s.render(ctx, user, "countdown", Data{Countdown: remaining})
+	})
+}
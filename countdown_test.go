@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func TestCountdownExpiresWithoutVotes(t *testing.T) {
+	server := newTestServer(t)
+	session := startTestSession(t, "alice-id")
+	session.addUser(&User{Id: "bob-id", Name: "Bob", Vote: noVote})
+
+	ws, messages := dialWebsocket(t, server, session, identityCookie("alice-id", "Alice"))
+	err := ws.Write(context.Background(), websocket.MessageText, []byte(`{"HEADERS":{"HX-Trigger":"countdown-30"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, messages, "countdown")
+
+	// let the countdown run out at the next tick
+	session.Lock()
+	session.deadline = time.Now()
+	session.Unlock()
+
+	receive(t, messages, "Nobody voted, everyone abstained.")
+
+	session.RLock()
+	revealed := session.revealed
+	session.RUnlock()
+	if revealed == nil {
+		t.Fatal("the votes were not revealed")
+	}
+	want := []Voter{{Id: "alice-id", Name: "Alice"}, {Id: "bob-id", Name: "Bob"}}
+	if len(revealed.round.Votes) != 0 || !slices.Equal(revealed.round.Abstained, want) {
+		t.Errorf("round = %+v, want everyone abstained", revealed.round)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Teams without an issue tracker can upload their backlog as CSV file with
+// the columns title, description, link and estimate. The moderator sees a
+// preview with all validation errors first and then imports the stories.
+// The story list of a session can be exported in the same format.
+
+const storySourceCSV = "csv"
+
+// maxCSVSize is the maximum size of an uploaded file in bytes
+const maxCSVSize = 1 << 20
+
+// maxTitleLength is the maximum length of a title in a CSV file
+const maxTitleLength = 200
+
+// maxCSVErrors is the number of validation errors that are shown at most
+const maxCSVErrors = 20
+
+var csvColumns = []string{"title", "description", "link", "estimate"}
+
+// CSVPreview is shown to the moderator before stories are imported
+type CSVPreview struct {
+	Stories []*Story
+	Errors  []string
+	// CSV is the uploaded file, which is sent again to import it
+	CSV string
+}
+
+// parseStoriesCSV reads stories from text. The first row is a header if
+// it starts with "title". Otherwise the columns are expected in the order
+// of csvColumns. Both comma and semicolon, as used by spreadsheets in many
+// locales, are accepted as separator.
+func parseStoriesCSV(text string) ([]*Story, []string) {
+	text = strings.TrimPrefix(text, "\ufeff")
+	if !utf8.ValidString(text) {
+		return nil, []string{"The file has to be encoded in UTF-8"}
+	}
+
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.Comma = csvSeparator(text)
+	reader.FieldsPerRecord = -1
+
+	var stories []*Story
+	var errs []string
+	addError := func(line int, format string, args ...any) {
+		if len(errs) < maxCSVErrors {
+			errs = append(errs, fmt.Sprintf("Line %d: ", line)+fmt.Sprintf(format, args...))
+		}
+	}
+
+	columns := csvColumns
+	first := true
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			errs = append(errs, "Invalid CSV: "+err.Error())
+			break
+		}
+		line, _ := reader.FieldPos(0)
+
+		if first {
+			first = false
+			if header, ok := csvHeader(record); ok {
+				columns = header
+				continue
+			}
+		}
+		if slices.IndexFunc(record, func(cell string) bool { return strings.TrimSpace(cell) != "" }) < 0 {
+			continue
+		}
+
+		if len(record) > len(columns) {
+			addError(line, "expected at most %d columns, found %d", len(columns), len(record))
+			continue
+		}
+		if len(stories) == maxStories {
+			errs = append(errs, fmt.Sprintf("A session can't have more than %d stories", maxStories))
+			break
+		}
+
+		story := &Story{Source: storySourceCSV}
+		for i, cell := range record {
+			cell = strings.TrimSpace(unescapeCSVCell(cell))
+			switch columns[i] {
+			case "title":
+				story.Title = cell
+			case "description":
+				story.Description = cell
+			case "link":
+				story.Link = cell
+			case "estimate":
+				if cell == "" {
+					break
+				}
+				estimate, err := strconv.Atoi(cell)
+				if err != nil || estimate < 0 {
+					addError(line, "estimate %q is not a number", cell)
+					break
+				}
+				story.Estimate = estimate
+			}
+		}
+
+		switch {
+		case story.Title == "":
+			addError(line, "title is missing")
+		case utf8.RuneCountInString(story.Title) > maxTitleLength:
+			addError(line, "title must not be longer than %d characters", maxTitleLength)
+		}
+		if story.Link != "" && !validLink(story.Link) {
+			addError(line, "%q is not a http or https link", story.Link)
+		}
+
+		stories = append(stories, story)
+	}
+
+	if len(stories) == 0 && len(errs) == 0 {
+		errs = append(errs, "The file contains no stories")
+	}
+	return stories, errs
+}
+
+// csvSeparator guesses the separator from the first line of text
+func csvSeparator(text string) rune {
+	line, _, _ := strings.Cut(text, "\n")
+	if strings.Count(line, ";") > strings.Count(line, ",") {
+		return ';'
+	}
+	return ','
+}
+
+// csvHeader returns the columns named in record, if record is a header
+func csvHeader(record []string) ([]string, bool) {
+	columns := make([]string, len(record))
+	for i, cell := range record {
+		columns[i] = strings.ToLower(strings.TrimSpace(cell))
+	}
+	if len(columns) == 0 || columns[0] != "title" {
+		return nil, false
+	}
+	// unknown columns are ignored
+	return columns, true
+}
+
+func validLink(link string) bool {
+	u, err := url.Parse(link)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// formulaPrefixes make spreadsheets interpret a cell as formula. Tab and
+// carriage return are skipped by some of them before the formula.
+const formulaPrefixes = "=+-@\t\r"
+
+// escapeCSVCell keeps spreadsheets from interpreting cells as formulas.
+// unescapeCSVCell reverses it, so that exported files can be imported again.
+func escapeCSVCell(cell string) string {
+	if cell != "" && strings.ContainsRune(formulaPrefixes, rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+func unescapeCSVCell(cell string) string {
+	if len(cell) > 1 && cell[0] == '\'' && strings.ContainsRune(formulaPrefixes, rune(cell[1])) {
+		return cell[1:]
+	}
+	return cell
+}
+
+func writeStoriesCSV(w io.Writer, stories []Story) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvColumns); err != nil {
+		return err
+	}
+	for _, story := range stories {
+		estimate := ""
+		if story.Estimate > 0 {
+			estimate = strconv.Itoa(story.Estimate)
+		}
+		record := []string{
+			escapeCSVCell(story.Title),
+			escapeCSVCell(story.Description),
+			escapeCSVCell(story.Link),
+			estimate,
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// readCSVUpload returns the uploaded file, or the csv field when the
+// previewed file is imported
+func readCSVUpload(w http.ResponseWriter, r *http.Request) (string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxCSVSize)
+	if err := r.ParseMultipartForm(maxCSVSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return "", invalid("file", "The file must not be larger than %d KB", maxCSVSize>>10)
+	}
+
+	file, _, err := r.FormFile("file")
+	if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+		text := r.PostFormValue("csv")
+		if text == "" {
+			return "", invalid("file", "Please choose a CSV file")
+		}
+		return text, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	text, err := io.ReadAll(io.LimitReader(file, maxCSVSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(text) > maxCSVSize {
+		return "", invalid("file", "The file must not be larger than %d KB", maxCSVSize>>10)
+	}
+	return string(text), nil
+}
+
+func postCSVPreview(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("POST /stories/{sessionId}/csv/preview").Inc()
+
+	session, _, ok := moderatorSession(w, r)
+	if !ok {
+		return
+	}
+
+	preview := &CSVPreview{}
+	text, err := readCSVUpload(w, r)
+	if err != nil {
+		preview.Errors = []string{err.Error()}
+	} else {
+		preview.CSV = text
+		preview.Stories, preview.Errors = parseStoriesCSV(text)
+	}
+
+	if err := templates.ExecuteTemplate(w, "csv-preview", Data{SessionId: session.Id, CSVPreview: preview}); err != nil {
+		// logger.Error("could not execute template", "template", "csv-preview", "session", session.Id, "error", err)
+	}
+}
+
+func postCSVImport(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("POST /stories/{sessionId}/csv").Inc()
+
+	session, user, ok := moderatorSession(w, r)
+	if !ok {
+		return
+	}
+
+	text, err := readCSVUpload(w, r)
+	if err != nil {
+		importStories(w, session, user, storySourceCSV, nil, err)
+		return
+	}
+
+	stories, errs := parseStoriesCSV(text)
+	if len(errs) > 0 {
+		importStories(w, session, user, storySourceCSV, nil, errors.New(errs[0]))
+		return
+	}
+	importStories(w, session, user, storySourceCSV, stories, nil)
+}
+
+// getStoriesCSV exports the story list of a session with the estimates
+func getStoriesCSV(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("GET /stories/{sessionId}/csv").Inc()
+
+	session, ok := getSessionById(r.PathValue("id"))
+	if !ok || !session.hasAccess(r) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	user := identify(w, r)
+	if user.Id == "" || !session.admits(user) {
+		http.Error(w, "you are not allowed to export the stories of this session", http.StatusForbidden)
+		return
+	}
+
+	stories := session.exportedStories()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="stories.csv"`)
+	if err := writeStoriesCSV(w, stories); err != nil {
+		// logger.Error("could not write csv", "session", session.Id, "error", err)
+	}
+}
+
+// exportedStories returns copies of the stories of session. These are the
+// queue of async rooms and the story list otherwise.
+func (s *Session) exportedStories() []Story {
+	if s.asyncSettings() != nil {
+		s.room.Lock()
+		defer s.room.Unlock()
+
+		stories := make([]Story, 0, len(s.room.Queue))
+		for _, story := range s.room.Queue {
+			stories = append(stories, story.Story)
+		}
+		return stories
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	stories := make([]Story, 0, len(s.stories))
+	for _, story := range s.stories {
+		stories = append(stories, *story)
+	}
+	return stories
+}
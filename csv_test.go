@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// loginCookie returns a signed identity cookie of a user that logged in
+// via OIDC
+func loginCookie(id string, name string, groups ...string) *http.Cookie {
+	payload, _ := json.Marshal(Identity{Id: id, Name: name, Subject: id, Groups: groups, IssuedAt: time.Now().Unix()})
+	return &http.Cookie{Name: identityCookieName, Value: sign(string(payload))}
+}
+
+// exportCSV returns the status and body of the export of session
+func exportCSV(t *testing.T, url string, session *Session, cookie *http.Cookie) (int, string) {
+	t.Helper()
+
+	r, _ := http.NewRequest(http.MethodGet, url+"/stories/"+session.Id+"/csv", nil)
+	r.AddCookie(cookie)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestExportStoriesCSV(t *testing.T) {
+	server := newTestServer(t)
+	session := startTestSession(t, "alice-id")
+	session.addStories([]*Story{
+		{Key: "1", Title: "Login", Estimate: 5},
+		{Key: "2", Title: "=SUM(A1)", Link: "https://example.com/2"},
+	})
+
+	status, body := exportCSV(t, server.URL, session, identityCookie("bob-id", "Bob"))
+	want := "title,description,link,estimate\nLogin,,,5\n'=SUM(A1),,https://example.com/2,\n"
+	if status != http.StatusOK || body != want {
+		t.Errorf("export = %d %q, want %q", status, body, want)
+	}
+}
+
+func TestExportStoriesCSVRequiresAdmission(t *testing.T) {
+	server := newTestServer(t)
+	session := startTestSession(t, "alice-id")
+	session.addStories([]*Story{{Key: "1", Title: "Login"}})
+	session.requireLogin = true
+	session.allowedGroups = []string{"team-a"}
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		want   int
+	}{
+		{"anonymous", identityCookie("bob-id", "Bob"), http.StatusForbidden},
+		{"other group", loginCookie("bob-id", "Bob", "team-b"), http.StatusForbidden},
+		{"member", loginCookie("bob-id", "Bob", "team-a"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := exportCSV(t, server.URL, session, tt.cookie); status != tt.want {
+				t.Errorf("export responded with %d %q, want %d", status, body, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportAsyncQueueCSV(t *testing.T) {
+	server := newTestServer(t)
+	session := startTestSession(t, "alice-id")
+	session.room = &Room{
+		Slug:     "async",
+		Settings: RoomSettings{Async: &AsyncSettings{Days: 3}},
+		Queue: []*AsyncStory{
+			{Id: "a", Story: Story{Key: "1", Title: "Login", Estimate: 8}, Result: &Round{Recommendation: 8}},
+			{Id: "b", Story: Story{Key: "2", Title: "Logout"}},
+		},
+	}
+
+	status, body := exportCSV(t, server.URL, session, identityCookie("bob-id", "Bob"))
+	want := "title,description,link,estimate\nLogin,,,8\nLogout,,,\n"
+	if status != http.StatusOK || body != want {
+		t.Errorf("export = %d %q, want %q", status, body, want)
+	}
+}
+
+func TestEscapeCSVCell(t *testing.T) {
+	tests := []struct {
+		cell string
+		want string
+	}{
+		{"Login", "Login"},
+		{"", ""},
+		{"=SUM(A1)", "'=SUM(A1)"},
+		{"+1", "'+1"},
+		{"-1", "'-1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=SUM(A1)", "'\t=SUM(A1)"},
+		{"\r=SUM(A1)", "'\r=SUM(A1)"},
+		{"'quoted", "'quoted"},
+	}
+	for _, tt := range tests {
+		if got := escapeCSVCell(tt.cell); got != tt.want {
+			t.Errorf("escapeCSVCell(%q) = %q, want %q", tt.cell, got, tt.want)
+		}
+		if got := unescapeCSVCell(escapeCSVCell(tt.cell)); got != tt.cell {
+			t.Errorf("unescapeCSVCell(%q) = %q, want %q", escapeCSVCell(tt.cell), got, tt.cell)
+		}
+	}
+}
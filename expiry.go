@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ExpiryPolicy decides when a session is closed.
+type ExpiryPolicy struct {
+	// EmptyTTL is how long a session is kept after the last participant left
+	EmptyTTL time.Duration
+	// InactivityTTL is how long a session is kept without any events
+	InactivityTTL time.Duration
+	// PresenceIsActivity makes connected participants count as activity, so
+	// sessions where people are just discussing don't expire
+	PresenceIsActivity bool
+	// MaxLifetime is the hard limit for the age of a session. It can only be
+	// raised by a moderator extending the session.
+	MaxLifetime time.Duration
+	// WarnBefore is how long before expiry the participants are warned
+	WarnBefore time.Duration
+	// Extension is how much time a moderator gains by extending the session
+	Extension time.Duration
+}
+
+// expiryCheckInterval is how often the broadcast loop checks the policy.
+// Tests shorten it.
+var expiryCheckInterval = 10 * time.Second
+
+const (
+	expiryReasonEmpty       = "everyone left"
+	expiryReasonInactivity  = "inactivity"
+	expiryReasonMaxLifetime = "reaching its maximum lifetime"
+)
+
+// expiresAt returns when the session expires according to its policy and
+// the reason for it. s has to be locked by the caller.
+func (s *Session) expiresAt() (time.Time, string) {
+	p := s.expiry
+
+	at := s.createdAt.Add(p.MaxLifetime + s.extension)
+	reason := expiryReasonMaxLifetime
+
+	if len(s.Users) == 0 {
+		if emptyAt := s.emptySince.Add(p.EmptyTTL); emptyAt.Before(at) {
+			at, reason = emptyAt, expiryReasonEmpty
+		}
+	}
+
+	if len(s.Users) == 0 || !p.PresenceIsActivity {
+		if inactiveAt := s.lastActivity.Add(p.InactivityTTL); inactiveAt.Before(at) {
+			at, reason = inactiveAt, expiryReasonInactivity
+		}
+	}
+
+	return at, reason
+}
+
+// checkExpiry is called periodically from the broadcast loop. It warns the
+// participants shortly before the session expires and ends the session once
+// it expired. It returns true if the session has ended.
+func (s *Session) checkExpiry() bool {
+	s.Lock()
+	at, reason := s.expiresAt()
+	soon := time.Until(at) <= s.expiry.WarnBefore
+	// Activity might have pushed the expiry back since the last warning
+	changed := s.warned != soon
+	s.warned = soon
+	s.Unlock()
+
+	if time.Now().After(at) {
+		s.handleTimeout(reason)
+		return true
+	}
+
+	if !changed {
+		return false
+	}
+
+	// logger.Info("expiry of session changed", "session", s.Id, "expiresAt", at, "reason", reason)
+	ctx, span := tracer.Start(context.Background(), "Session.checkExpiry", trace.WithAttributes(sessionAttributes(s)...))
+	defer span.End()
+
+	go s.executeAllUsers(Data{ctx: ctx, event: EXPIRING, publishedAt: time.Now()}, func(ctx context.Context, user *User) {
+		data := Data{}
+		if soon {
+			data.Moderator = s.isModerator(user)
+			data.ExpiresAt = at
+			data.Reason = reason
+		}
+		s.render(ctx, user, "expiry", data)
+	})
+
+	return false
+}
+
+// handleExtend pushes the expiry of the session back. Only the moderator is
+// allowed to do that.
+func (s *Session) handleExtend(msg Data) {
+	if !s.isModerator(msg.MyUser) {
+		// logger.Warn("user tried to extend session without being moderator", "session", s.Id, "user", msg.MyUser.Name)
+		return
+	}
+
+	s.Lock()
+	s.extension += s.expiry.Extension
+	s.lastActivity = time.Now()
+	s.warned = false
+	s.Unlock()
+
+	// logger.Info("session extended", "session", s.Id, "user", msg.MyUser.Name)
+	go s.executeAllUsers(msg, func(ctx context.Context, user *User) {
+		s.render(ctx, user, "expiry", Data{})
+	})
+}
+
+// ExpiresInMinutes is used by the expiry template
+func (d Data) ExpiresInMinutes() int {
+	return int(math.Ceil(time.Until(d.ExpiresAt).Minutes()))
+}
+
+func (s *Session) isModerator(user *User) bool {
+	return user != nil && user.Id != "" && user.Id == s.moderator
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpiresAt(t *testing.T) {
+	policy := ExpiryPolicy{
+		EmptyTTL:           time.Minute,
+		InactivityTTL:      time.Hour,
+		PresenceIsActivity: true,
+		MaxLifetime:        12 * time.Hour,
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		present    bool
+		presence   bool
+		inactive   time.Duration
+		age        time.Duration
+		extension  time.Duration
+		wantAt     time.Time
+		wantReason string
+	}{
+		{"empty", false, true, 0, 0, 0, now.Add(time.Minute), expiryReasonEmpty},
+		{"present", true, true, 0, 0, 0, now.Add(12 * time.Hour), expiryReasonMaxLifetime},
+		{"present and inactive", true, true, 2 * time.Hour, 0, 0, now.Add(12 * time.Hour), expiryReasonMaxLifetime},
+		{"presence is no activity", true, false, 30 * time.Minute, 0, 0, now.Add(30 * time.Minute), expiryReasonInactivity},
+		{"old", true, true, 0, 11 * time.Hour, 0, now.Add(time.Hour), expiryReasonMaxLifetime},
+		{"old and extended", true, true, 0, 11 * time.Hour, 2 * time.Hour, now.Add(3 * time.Hour), expiryReasonMaxLifetime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := policy
+			policy.PresenceIsActivity = tt.presence
+			session := newSessionState("Test", "alice-id", ScaleDefinition{}, policy)
+			session.createdAt = now.Add(-tt.age)
+			session.lastActivity = now.Add(-tt.inactive)
+			session.emptySince = now
+			session.extension = tt.extension
+			if tt.present {
+				session.Users["alice-id"] = &User{Id: "alice-id", Name: "Alice", Vote: noVote}
+			}
+
+			at, reason := session.expiresAt()
+			if !at.Equal(tt.wantAt) || reason != tt.wantReason {
+				t.Errorf("expiresAt() = %v, %s, want %v, %s", at, reason, tt.wantAt, tt.wantReason)
+			}
+		})
+	}
+}
+
+// checkExpiryEvery makes sessions that are started afterwards check their
+// expiry at interval
+func checkExpiryEvery(t *testing.T, interval time.Duration) {
+	previous := expiryCheckInterval
+	expiryCheckInterval = interval
+	t.Cleanup(func() { expiryCheckInterval = previous })
+}
+
+func TestExpiryWarningAndExtension(t *testing.T) {
+	checkExpiryEvery(t, 10*time.Millisecond)
+	server := newTestServer(t, func(c *Config) {
+		c.Expiry = ExpiryPolicy{
+			EmptyTTL:           time.Hour,
+			InactivityTTL:      time.Hour,
+			PresenceIsActivity: true,
+			MaxLifetime:        time.Minute,
+			WarnBefore:         30 * time.Minute,
+			Extension:          time.Hour,
+		}
+	})
+	session := startTestSession(t, "alice-id")
+	alice := &User{Id: "alice-id", Name: "Alice"}
+	bob := &User{Id: "bob-id", Name: "Bob"}
+
+	_, aliceMessages := dialWebsocket(t, server, session, identityCookie(alice.Id, alice.Name))
+	_, bobMessages := dialWebsocket(t, server, session, identityCookie(bob.Id, bob.Name))
+
+	if msg := receive(t, aliceMessages, "This session expires in"); !strings.Contains(msg, "extend-session") {
+		t.Error("the moderator is not offered to extend the session")
+	}
+	if msg := receive(t, bobMessages, "This session expires in"); strings.Contains(msg, "extend-session") {
+		t.Error("a participant is offered to extend the session")
+	}
+
+	// events are handled in order, so the extension of bob was ignored
+	// once the one of alice is applied
+	trigger(session, bob, "extend-session")
+	trigger(session, alice, "extend-session")
+	waitFor(t, "the extension", func() bool {
+		session.RLock()
+		defer session.RUnlock()
+		return session.extension != 0
+	})
+	session.RLock()
+	extension := session.extension
+	session.RUnlock()
+	if extension != time.Hour {
+		t.Errorf("extension = %v, want only the one of the moderator", extension)
+	}
+	if msg := receive(t, bobMessages, `id="expiry"`); strings.Contains(msg, "This session expires in") {
+		t.Error("the warning is still shown after the extension")
+	}
+	if _, ok := getSessionById(session.Id); !ok {
+		t.Error("extended session ended")
+	}
+}
+
+func TestExpiryAfterMaxLifetime(t *testing.T) {
+	checkExpiryEvery(t, 10*time.Millisecond)
+	server := newTestServer(t, func(c *Config) {
+		c.Expiry = ExpiryPolicy{
+			EmptyTTL:           time.Hour,
+			InactivityTTL:      time.Hour,
+			PresenceIsActivity: true,
+			MaxLifetime:        200 * time.Millisecond,
+			Extension:          time.Hour,
+		}
+	})
+	scale, _ := scales.Get(defaultScale)
+	session := newSessionState("Test", "alice-id", scale, config.Expiry)
+	if err := startSession(session); err != nil {
+		t.Fatal(err)
+	}
+	_, messages := dialWebsocket(t, server, session, identityCookie("bob-id", "Bob"))
+
+	waitFor(t, "the expiry", func() bool {
+		_, ok := getSessionById(session.Id)
+		return !ok
+	})
+	receive(t, messages, expiryReasonMaxLifetime)
+}
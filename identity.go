@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const identityCookieName = "identity"
+
+// legacyUserNameCookie held the plain base64 encoded name of the user. It is
+// not trusted anymore and removed whenever it is sent.
+const legacyUserNameCookie = "username"
+
+const identityMaxAge = 3600 * 24 * 365 * 5 // 5 years
+
+// Identity is stored signed in the identity cookie. The participant id
+// identifies a user across sessions, the name is only used for display.
+type Identity struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// Subject and Groups are only set for users that logged in via OIDC
+	Subject string   `json:"sub,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	// Role weighs the votes of the user in the weighted recommendation
+	Role     string `json:"role,omitempty"`
+	IssuedAt int64  `json:"iat"`
+}
+
+func newParticipantId() string {
+	return randSeq(16, letters)
+}
+
+func setIdentityCookie(w http.ResponseWriter, identity Identity) {
+	payload, err := json.Marshal(identity)
+	if err != nil {
+		// logger.Error("could not marshal identity", "error", err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     identityCookieName,
+		Value:    sign(string(payload)),
+		Path:     "/",
+		MaxAge:   identityMaxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearCookie(w http.ResponseWriter, name string) {
+	clearCookieAt(w, name, "/")
+}
+
+func clearCookieAt(w http.ResponseWriter, name string, path string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     path,
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// identify returns the user the request belongs to. Its Id and Name are
+// empty for unknown users. Cookies that can't be verified are removed, so
+// the user has to enter a name again. Cookies signed with a retired key
+// are reissued with the current one.
+func identify(w http.ResponseWriter, r *http.Request) *User {
+	user := &User{
+		Name: "",
+		Vote: noVote,
+	}
+
+	if _, err := r.Cookie(legacyUserNameCookie); err == nil {
+		clearCookie(w, legacyUserNameCookie)
+	}
+
+	cookie, err := r.Cookie(identityCookieName)
+	if err != nil {
+		// logger.Info("new user")
+		return user
+	}
+
+	payload, current, ok := verify(cookie.Value)
+
+	var identity Identity
+	if ok {
+		ok = json.Unmarshal([]byte(payload), &identity) == nil
+	}
+	if !ok || identity.Id == "" || identity.Name == "" || time.Unix(identity.IssuedAt, 0).After(time.Now()) {
+		// logger.Warn("rejecting invalid identity cookie", "ip", clientIP(r))
+		clearCookie(w, identityCookieName)
+		return user
+	}
+
+	if !current {
+		// logger.Info("reissuing identity cookie signed with retired key", "user", identity.Id)
+		setIdentityCookie(w, identity)
+	}
+
+	user.Id = identity.Id
+	user.Name = identity.Name
+	user.Subject = identity.Subject
+	user.Groups = identity.Groups
+	user.Role = identity.Role
+	return user
+}
+
+// login sets the name and the role of user and issues a new identity
+// cookie. Users that are already known keep their participant id. Users
+// that logged in via OIDC keep the name from their ID token.
+func login(w http.ResponseWriter, user *User, name string, role string) {
+	if user.Subject == "" {
+		if user.Id == "" {
+			user.Id = newParticipantId()
+		}
+		user.Name = name
+	}
+	user.Role = role
+
+	setIdentityCookie(w, Identity{
+		Id:       user.Id,
+		Name:     user.Name,
+		Subject:  user.Subject,
+		Groups:   user.Groups,
+		Role:     user.Role,
+		IssuedAt: time.Now().Unix(),
+	})
+}
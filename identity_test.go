@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// identifyWith runs identify on a request with cookies and returns the user
+// and the response the cookies are set on
+func identifyWith(cookies ...*http.Cookie) (*User, *http.Response) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	user := identify(w, r)
+	return user, w.Result()
+}
+
+// clearsCookie reports whether resp removes the cookie name
+func clearsCookie(resp *http.Response, name string) bool {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == name && cookie.MaxAge < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestIdentifyRejectsInvalidCookies(t *testing.T) {
+	payload := func(identity Identity) string {
+		b, _ := json.Marshal(identity)
+		return string(b)
+	}
+	valid := identityCookie("bob-id", "Bob")
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"unsigned", payload(Identity{Id: "bob-id", Name: "Bob", IssuedAt: time.Now().Unix()})},
+		{"tampered", tamper(valid.Value, payload(Identity{Id: "alice-id", Name: "Alice", IssuedAt: time.Now().Unix()}))},
+		{"future", sign(payload(Identity{Id: "bob-id", Name: "Bob", IssuedAt: time.Now().Add(time.Hour).Unix()}))},
+		{"without id", sign(payload(Identity{Name: "Bob", IssuedAt: time.Now().Unix()}))},
+		{"without name", sign(payload(Identity{Id: "bob-id", IssuedAt: time.Now().Unix()}))},
+		{"no json", sign("bob-id")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, resp := identifyWith(&http.Cookie{Name: identityCookieName, Value: tt.value})
+			if user.Id != "" || user.Name != "" {
+				t.Errorf("identified %+v", user)
+			}
+			if !clearsCookie(resp, identityCookieName) {
+				t.Error("the invalid cookie was not removed")
+			}
+		})
+	}
+
+	user, resp := identifyWith(valid)
+	if user.Id != "bob-id" || user.Name != "Bob" || len(resp.Cookies()) != 0 {
+		t.Errorf("valid cookie identified %+v and set %v", user, resp.Cookies())
+	}
+}
+
+func TestIdentifyReissuesRetiredKey(t *testing.T) {
+	retired := identityCookie("bob-id", "Bob")
+
+	keys := signingKeys
+	signingKeys = [][]byte{newRandomKey(), keys[0]}
+	t.Cleanup(func() { signingKeys = keys })
+
+	user, resp := identifyWith(retired)
+	if user.Id != "bob-id" || user.Name != "Bob" {
+		t.Errorf("cookie of retired key identified %+v", user)
+	}
+
+	var reissued *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == identityCookieName {
+			reissued = cookie
+		}
+	}
+	if reissued == nil {
+		t.Fatal("the cookie was not reissued")
+	}
+	if _, current, ok := verify(reissued.Value); !ok || !current {
+		t.Error("the reissued cookie is not signed with the current key")
+	}
+
+	signingKeys = [][]byte{newRandomKey()}
+	if user, _ := identifyWith(retired); user.Id != "" {
+		t.Errorf("cookie of removed key identified %+v", user)
+	}
+}
+
+func TestIdentifyClearsLegacyCookie(t *testing.T) {
+	user, resp := identifyWith(&http.Cookie{Name: legacyUserNameCookie, Value: "Qm9i"})
+	if user.Name != "" {
+		t.Errorf("legacy cookie identified %+v", user)
+	}
+	if !clearsCookie(resp, legacyUserNameCookie) {
+		t.Error("the legacy cookie was not removed")
+	}
+}
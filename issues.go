@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The moderator can import GitHub or GitLab issues by repository and
+// milestone or label. The repository and the token are kept with the
+// session, and with the room if the session belongs to one, so they only
+// have to be entered once. When the moderator accepts a round of an
+// imported issue, the estimate is written back as points/N label or as
+// comment. Later estimates of the issue update the same label or comment.
+
+const (
+	storySourceGitHub = "github"
+	storySourceGitLab = "gitlab"
+)
+
+// WriteBack is how estimates are written back to GitHub and GitLab
+type WriteBack string
+
+const (
+	writeBackNone    WriteBack = "none"
+	writeBackLabel   WriteBack = "label"
+	writeBackComment WriteBack = "comment"
+)
+
+// pointsLabelPrefix is the prefix of the labels estimates are written to
+const pointsLabelPrefix = "points/"
+
+// issuesPageSize is the number of issues and comments requested at once
+const issuesPageSize = 100
+
+// maxCommentPages limits how many pages of comments are searched for the
+// estimate comment
+const maxCommentPages = 10
+
+// estimateCommentMarker is hidden in the Markdown of estimate comments, so
+// that they can be found and updated
+const estimateCommentMarker = "<!-- pointing-poker-estimate -->"
+
+const maxTokenLength = 255
+
+// maxIssueTrackers is the number of repos whose settings are kept. Stories
+// of older repos are no longer written back.
+const maxIssueTrackers = 20
+
+var repoPattern = regexp.MustCompile(`^[\w.-]+(/[\w.-]+)+$`)
+
+// IssueTrackerSettings are the credentials and options of the GitHub or
+// GitLab import of a session
+type IssueTrackerSettings struct {
+	Provider  string    `json:"provider"`
+	Repo      string    `json:"repo"`
+	Token     string    `json:"token,omitempty"`
+	WriteBack WriteBack `json:"writeBack"`
+}
+
+type IssueTracker interface {
+	// Issues returns the open issues of repo. Issues are filtered by
+	// milestone and label if they are not empty.
+	Issues(ctx context.Context, repo string, milestone string, label string) ([]*Story, error)
+	// SetPointsLabel replaces the points/N labels of an issue with the one
+	// for points
+	SetPointsLabel(ctx context.Context, repo string, number int, points int) error
+	// SetEstimateComment adds the estimate comment to an issue, or updates
+	// it if the issue has one already
+	SetEstimateComment(ctx context.Context, repo string, number int, points int) error
+}
+
+// newIssueTracker returns the client for the provider of settings, or nil
+// if the provider is not enabled
+func newIssueTracker(settings IssueTrackerSettings) IssueTracker {
+	client := &http.Client{Timeout: integrationTimeout}
+
+	switch {
+	case settings.Provider == storySourceGitHub && config.Issues.GitHubURL != "":
+		return &githubClient{restClient{
+			baseURL: strings.TrimSuffix(config.Issues.GitHubURL, "/"),
+			http:    client,
+			header: http.Header{
+				"Authorization":        {"Bearer " + settings.Token},
+				"Accept":               {"application/vnd.github+json"},
+				"X-Github-Api-Version": {"2022-11-28"},
+			},
+		}}
+	case settings.Provider == storySourceGitLab && config.Issues.GitLabURL != "":
+		return &gitlabClient{restClient{
+			baseURL: strings.TrimSuffix(config.Issues.GitLabURL, "/") + "/api/v4",
+			http:    client,
+			header:  http.Header{"Private-Token": {settings.Token}},
+		}}
+	default:
+		return nil
+	}
+}
+
+// IssueProviders are the providers the moderator can choose from
+func (d Data) IssueProviders() []string {
+	var providers []string
+	if config.Issues.GitHubURL != "" {
+		providers = append(providers, storySourceGitHub)
+	}
+	if config.Issues.GitLabURL != "" {
+		providers = append(providers, storySourceGitLab)
+	}
+	return providers
+}
+
+// restClient sends JSON requests to the APIs of GitHub and GitLab
+type restClient struct {
+	baseURL string
+	http    httpDoer
+	header  http.Header
+}
+
+// APIError is returned for responses with an error status
+type APIError struct {
+	Status  int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("responded with status %d", e.Status)
+	}
+	return fmt.Sprintf("responded with status %d: %s", e.Status, e.Message)
+}
+
+func (c *restClient) do(ctx context.Context, method string, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	for key, values := range c.header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		apiErr := &APIError{Status: resp.StatusCode}
+		var errBody struct {
+			Message any `json:"message"`
+		}
+		if json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&errBody) == nil && errBody.Message != nil {
+			apiErr.Message = fmt.Sprint(errBody.Message)
+		}
+		return apiErr
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// issueKey is the key of the story of an issue, e.g. owner/repo#12
+func issueKey(repo string, number int) string {
+	return repo + "#" + strconv.Itoa(number)
+}
+
+// parseIssueKey returns repository and number of an issue key
+func parseIssueKey(key string) (repo string, number int, ok bool) {
+	i := strings.LastIndex(key, "#")
+	if i < 0 {
+		return "", 0, false
+	}
+	number, err := strconv.Atoi(key[i+1:])
+	return key[:i], number, err == nil
+}
+
+func pointsLabel(points int) string {
+	return pointsLabelPrefix + strconv.Itoa(points)
+}
+
+func estimateComment(points int) string {
+	return fmt.Sprintf("%s\nEstimated with %d points in Pointing Poker", estimateCommentMarker, points)
+}
+
+// issueComment is a comment of GitHub or a note of GitLab
+type issueComment struct {
+	Id   int    `json:"id"`
+	Body string `json:"body"`
+}
+
+// findEstimateComment returns the id of the estimate comment in the pages
+// of comments at path, or 0 if there is none
+func (c *restClient) findEstimateComment(ctx context.Context, path string) (int, error) {
+	query := url.Values{"per_page": {strconv.Itoa(issuesPageSize)}}
+	for page := 1; page <= maxCommentPages; page++ {
+		query.Set("page", strconv.Itoa(page))
+
+		var comments []issueComment
+		if err := c.do(ctx, http.MethodGet, path+"?"+query.Encode(), nil, &comments); err != nil {
+			return 0, err
+		}
+		for _, comment := range comments {
+			if strings.Contains(comment.Body, estimateCommentMarker) {
+				return comment.Id, nil
+			}
+		}
+		if len(comments) < issuesPageSize {
+			break
+		}
+	}
+	return 0, nil
+}
+
+type githubClient struct {
+	restClient
+}
+
+type githubIssue struct {
+	Number  int    `json:"number"`
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+	HTMLURL string `json:"html_url"`
+	// PullRequest is set for pull requests, which are issues as well
+	PullRequest *struct{} `json:"pull_request"`
+	Labels      []struct {
+		Name string `json:"name"`
+	} `json:"labels"`
+}
+
+var errMilestoneNotFound = errors.New("milestone not found")
+
+// milestone returns the number of the milestone with the given title.
+// GitHub only filters issues by milestone number.
+func (c *githubClient) milestone(ctx context.Context, repo string, title string) (string, error) {
+	if _, err := strconv.Atoi(title); err == nil {
+		return title, nil
+	}
+
+	var milestones []struct {
+		Number int    `json:"number"`
+		Title  string `json:"title"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/repos/"+repo+"/milestones?state=all&per_page=100", nil, &milestones); err != nil {
+		return "", err
+	}
+	for _, milestone := range milestones {
+		if milestone.Title == title {
+			return strconv.Itoa(milestone.Number), nil
+		}
+	}
+	return "", errMilestoneNotFound
+}
+
+func (c *githubClient) Issues(ctx context.Context, repo string, milestone string, label string) ([]*Story, error) {
+	query := url.Values{"state": {"open"}, "per_page": {strconv.Itoa(issuesPageSize)}}
+	if milestone != "" {
+		number, err := c.milestone(ctx, repo, milestone)
+		if err != nil {
+			return nil, err
+		}
+		query.Set("milestone", number)
+	}
+	if label != "" {
+		query.Set("labels", label)
+	}
+
+	var stories []*Story
+	for page := 1; len(stories) < maxStories; page++ {
+		query.Set("page", strconv.Itoa(page))
+
+		var issues []githubIssue
+		if err := c.do(ctx, http.MethodGet, "/repos/"+repo+"/issues?"+query.Encode(), nil, &issues); err != nil {
+			return nil, err
+		}
+		for _, issue := range issues {
+			if issue.PullRequest != nil {
+				continue
+			}
+			stories = append(stories, &Story{
+				Key:         issueKey(repo, issue.Number),
+				Title:       issue.Title,
+				Description: issue.Body,
+				Link:        issue.HTMLURL,
+				Source:      storySourceGitHub,
+			})
+		}
+		if len(issues) < issuesPageSize {
+			break
+		}
+	}
+	return stories, nil
+}
+
+func (c *githubClient) SetPointsLabel(ctx context.Context, repo string, number int, points int) error {
+	path := fmt.Sprintf("/repos/%s/issues/%d", repo, number)
+
+	var issue githubIssue
+	if err := c.do(ctx, http.MethodGet, path, nil, &issue); err != nil {
+		return err
+	}
+
+	label := pointsLabel(points)
+	for _, existing := range issue.Labels {
+		if existing.Name == label || !strings.HasPrefix(existing.Name, pointsLabelPrefix) {
+			continue
+		}
+		if err := c.do(ctx, http.MethodDelete, path+"/labels/"+url.PathEscape(existing.Name), nil, nil); err != nil {
+			return err
+		}
+	}
+
+	return c.do(ctx, http.MethodPost, path+"/labels", map[string][]string{"labels": {label}}, nil)
+}
+
+func (c *githubClient) SetEstimateComment(ctx context.Context, repo string, number int, points int) error {
+	path := fmt.Sprintf("/repos/%s/issues/%d/comments", repo, number)
+	body := map[string]string{"body": estimateComment(points)}
+
+	id, err := c.findEstimateComment(ctx, path)
+	if err != nil {
+		return err
+	}
+	if id != 0 {
+		return c.do(ctx, http.MethodPatch, fmt.Sprintf("/repos/%s/issues/comments/%d", repo, id), body, nil)
+	}
+	return c.do(ctx, http.MethodPost, path, body, nil)
+}
+
+type gitlabClient struct {
+	restClient
+}
+
+type gitlabIssue struct {
+	IID         int      `json:"iid"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	WebURL      string   `json:"web_url"`
+	Labels      []string `json:"labels"`
+}
+
+// project returns the path of the API of the project repo
+func (c *gitlabClient) project(repo string) string {
+	return "/projects/" + url.PathEscape(repo)
+}
+
+func (c *gitlabClient) Issues(ctx context.Context, repo string, milestone string, label string) ([]*Story, error) {
+	query := url.Values{"state": {"opened"}, "per_page": {strconv.Itoa(issuesPageSize)}}
+	if milestone != "" {
+		query.Set("milestone", milestone)
+	}
+	if label != "" {
+		query.Set("labels", label)
+	}
+
+	var stories []*Story
+	for page := 1; len(stories) < maxStories; page++ {
+		query.Set("page", strconv.Itoa(page))
+
+		var issues []gitlabIssue
+		if err := c.do(ctx, http.MethodGet, c.project(repo)+"/issues?"+query.Encode(), nil, &issues); err != nil {
+			return nil, err
+		}
+		for _, issue := range issues {
+			stories = append(stories, &Story{
+				Key:         issueKey(repo, issue.IID),
+				Title:       issue.Title,
+				Description: issue.Description,
+				Link:        issue.WebURL,
+				Source:      storySourceGitLab,
+			})
+		}
+		if len(issues) < issuesPageSize {
+			break
+		}
+	}
+	return stories, nil
+}
+
+func (c *gitlabClient) SetPointsLabel(ctx context.Context, repo string, number int, points int) error {
+	path := fmt.Sprintf("%s/issues/%d", c.project(repo), number)
+
+	var issue gitlabIssue
+	if err := c.do(ctx, http.MethodGet, path, nil, &issue); err != nil {
+		return err
+	}
+
+	label := pointsLabel(points)
+	var remove []string
+	for _, existing := range issue.Labels {
+		if existing != label && strings.HasPrefix(existing, pointsLabelPrefix) {
+			remove = append(remove, existing)
+		}
+	}
+
+	return c.do(ctx, http.MethodPut, path, map[string]string{
+		"add_labels":    label,
+		"remove_labels": strings.Join(remove, ","),
+	}, nil)
+}
+
+func (c *gitlabClient) SetEstimateComment(ctx context.Context, repo string, number int, points int) error {
+	path := fmt.Sprintf("%s/issues/%d/notes", c.project(repo), number)
+	body := map[string]string{"body": estimateComment(points)}
+
+	id, err := c.findEstimateComment(ctx, path)
+	if err != nil {
+		return err
+	}
+	if id != 0 {
+		return c.do(ctx, http.MethodPut, fmt.Sprintf("%s/%d", path, id), body, nil)
+	}
+	return c.do(ctx, http.MethodPost, path, body, nil)
+}
+
+// issueTrackerSettings returns a copy of the settings of repo at provider,
+// or nil if they have not been saved. The most recently saved settings of
+// provider are returned if repo is empty, and of any provider if both are
+// empty.
+func (s *Session) issueTrackerSettings(provider string, repo string) *IssueTrackerSettings {
+	s.RLock()
+	defer s.RUnlock()
+
+	for i := len(s.issueTrackers) - 1; i >= 0; i-- {
+		saved := s.issueTrackers[i]
+		if (provider == "" || saved.Provider == provider) && (repo == "" || saved.Repo == repo) {
+			return &saved
+		}
+	}
+	return nil
+}
+
+// setIssueTrackerSettings stores settings with the session and its room.
+// They replace the settings of the same repo, and the oldest settings are
+// dropped if there are more than maxIssueTrackers.
+func (s *Session) setIssueTrackerSettings(settings IssueTrackerSettings) {
+	s.Lock()
+	s.issueTrackers = slices.DeleteFunc(s.issueTrackers, func(saved IssueTrackerSettings) bool {
+		return saved.Provider == settings.Provider && saved.Repo == settings.Repo
+	})
+	s.issueTrackers = append(s.issueTrackers, settings)
+	if len(s.issueTrackers) > maxIssueTrackers {
+		s.issueTrackers = slices.Delete(s.issueTrackers, 0, len(s.issueTrackers)-maxIssueTrackers)
+	}
+	issueTrackers := slices.Clone(s.issueTrackers)
+	s.Unlock()
+
+	if s.room != nil {
+		s.room.Lock()
+		s.room.Settings.IssueTrackers = issueTrackers
+		s.room.Unlock()
+		s.saveRoom()
+	}
+}
+
+// writeBackIssue is an accept hook that writes the estimate of GitHub and
+// GitLab issues back as label or comment
+func writeBackIssue(ctx context.Context, session *Session, story *Story, round Round) {
+	if story == nil || (story.Source != storySourceGitHub && story.Source != storySourceGitLab) || len(round.Votes) == 0 {
+		return
+	}
+
+	// the story is written back with the settings it was imported with
+	repo, number, ok := parseIssueKey(story.Key)
+	if !ok {
+		return
+	}
+	settings := session.issueTrackerSettings(story.Source, repo)
+	if settings == nil || settings.WriteBack == writeBackNone {
+		return
+	}
+
+	tracker := newIssueTracker(*settings)
+	if tracker == nil {
+		return
+	}
+
+	var err error
+	switch settings.WriteBack {
+	case writeBackLabel:
+		err = tracker.SetPointsLabel(ctx, repo, number, round.Recommendation)
+	case writeBackComment:
+		err = tracker.SetEstimateComment(ctx, repo, number, round.Recommendation)
+	}
+
+	if err != nil {
+		// logger.Error("could not write estimate back", "session", session.Id, "issue", story.Key, "error", err)
+		writeBacks.WithLabelValues(story.Source, "error").Inc()
+		return
+	}
+	// logger.Info("wrote estimate back", "session", session.Id, "issue", story.Key, "points", round.Recommendation)
+	writeBacks.WithLabelValues(story.Source, "ok").Inc()
+}
+
+// validRepo only accepts owner/name on GitHub. GitLab projects can be in
+// nested groups.
+func validRepo(provider string, repo string) bool {
+	if len(repo) > 200 || !repoPattern.MatchString(repo) {
+		return false
+	}
+	segments := strings.Split(repo, "/")
+	if provider == storySourceGitHub && len(segments) != 2 {
+		return false
+	}
+	return !slices.ContainsFunc(segments, func(segment string) bool {
+		return strings.Trim(segment, ".") == ""
+	})
+}
+
+// validateIssueTracker checks the settings entered by the moderator. An
+// empty token keeps the one saved for the provider.
+func validateIssueTracker(settings IssueTrackerSettings, saved *IssueTrackerSettings) (IssueTrackerSettings, error) {
+	if !slices.Contains(Data{}.IssueProviders(), settings.Provider) {
+		return settings, invalid("provider", "Please choose one of the available providers")
+	}
+	if !validRepo(settings.Provider, settings.Repo) {
+		return settings, invalid("repo", "Repository has to look like owner/name")
+	}
+	if !slices.Contains([]WriteBack{writeBackNone, writeBackLabel, writeBackComment}, settings.WriteBack) {
+		return settings, invalid("write-back", "Please choose how estimates are written back")
+	}
+
+	if settings.Token == "" && saved != nil {
+		settings.Token = saved.Token
+	}
+	if settings.Token == "" || len(settings.Token) > maxTokenLength {
+		return settings, invalid("token", "Please enter an access token")
+	}
+	return settings, nil
+}
+
+func postIssueImport(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("POST /stories/{sessionId}/issues").Inc()
+
+	session, user, ok := moderatorSession(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "could not parse form", http.StatusBadRequest)
+		return
+	}
+
+	provider := r.Form.Get("provider")
+	repo := strings.TrimSpace(r.Form.Get("repo"))
+
+	// without a token, the one of the repo is used, or else the one last
+	// used for the provider
+	saved := session.issueTrackerSettings(provider, repo)
+	if saved == nil {
+		saved = session.issueTrackerSettings(provider, "")
+	}
+	settings, err := validateIssueTracker(IssueTrackerSettings{
+		Provider:  provider,
+		Repo:      repo,
+		Token:     strings.TrimSpace(r.Form.Get("token")),
+		WriteBack: WriteBack(r.Form.Get("write-back")),
+	}, saved)
+	if err != nil {
+		importStories(w, session, user, settings.Provider, nil, err)
+		return
+	}
+
+	milestone := strings.TrimSpace(r.Form.Get("milestone"))
+	label := strings.TrimSpace(r.Form.Get("label"))
+
+	stories, err := newIssueTracker(settings).Issues(r.Context(), settings.Repo, milestone, label)
+	if err == nil {
+		// only settings that worked are saved
+		session.setIssueTrackerSettings(settings)
+	}
+	importStories(w, session, user, settings.Provider, stories, err)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeTracker serves the parts of the GitHub and GitLab APIs the import
+// and the write-back use. Issue 7 of every repository has labels and
+// comments.
+type fakeTracker struct {
+	*httptest.Server
+	sync.Mutex
+	labels   []string
+	comments []issueComment
+	nextId   int
+	// requests are the method and path of all requests that change issues
+	requests []string
+	// tokens are the tokens these requests were sent with
+	tokens []string
+	// queries are the query strings of the issue lists
+	queries []string
+	header  http.Header
+}
+
+func newFakeTracker(t *testing.T) *fakeTracker {
+	t.Helper()
+
+	f := &fakeTracker{
+		labels:   []string{"bug", "points/3"},
+		comments: []issueComment{{Id: 1, Body: "Looks big"}},
+		nextId:   2,
+	}
+
+	mux := http.NewServeMux()
+
+	// GitHub
+	mux.HandleFunc("GET /repos/{owner}/{repo}/milestones", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"number":2,"title":"Sprint 0"},{"number":3,"title":"Sprint 1"}]`))
+	})
+	mux.HandleFunc("GET /repos/{owner}/{repo}/issues", func(w http.ResponseWriter, r *http.Request) {
+		f.record(r)
+		var issues []map[string]any
+		switch r.URL.Query().Get("page") {
+		case "1":
+			for n := 1; n < 100; n++ {
+				issues = append(issues, map[string]any{"number": n, "title": fmt.Sprintf("Issue %d", n), "html_url": fmt.Sprintf("https://github.example.com/issues/%d", n)})
+			}
+			issues = append(issues, map[string]any{"number": 1000, "title": "Pull request", "pull_request": map[string]any{}})
+		case "2":
+			for n := 100; n <= 150; n++ {
+				issues = append(issues, map[string]any{"number": n, "title": fmt.Sprintf("Issue %d", n)})
+			}
+		}
+		json.NewEncoder(w).Encode(issues)
+	})
+	mux.HandleFunc("GET /repos/{owner}/{repo}/issues/7", func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		defer f.Unlock()
+
+		labels := []map[string]string{}
+		for _, label := range f.labels {
+			labels = append(labels, map[string]string{"name": label})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"number": 7, "labels": labels})
+	})
+	mux.HandleFunc("DELETE /repos/{owner}/{repo}/issues/7/labels/{label}", func(w http.ResponseWriter, r *http.Request) {
+		f.change(r, func() {
+			f.labels = slices.DeleteFunc(f.labels, func(label string) bool { return label == r.PathValue("label") })
+		})
+	})
+	mux.HandleFunc("POST /repos/{owner}/{repo}/issues/7/labels", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Labels []string `json:"labels"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.change(r, func() { f.labels = append(f.labels, body.Labels...) })
+	})
+	mux.HandleFunc("GET /repos/{owner}/{repo}/issues/7/comments", f.listComments)
+	mux.HandleFunc("POST /repos/{owner}/{repo}/issues/7/comments", f.addComment)
+	mux.HandleFunc("PATCH /repos/{owner}/{repo}/issues/comments/{id}", f.updateComment)
+
+	// GitLab
+	mux.HandleFunc("GET /api/v4/projects/{project}/issues", func(w http.ResponseWriter, r *http.Request) {
+		f.record(r)
+		w.Write([]byte(`[{"iid":4,"title":"Login","description":"As a user","web_url":"https://gitlab.example.com/issues/4"},{"iid":7,"title":"Logout"}]`))
+	})
+	mux.HandleFunc("GET /api/v4/projects/{project}/issues/7", func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		defer f.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"iid": 7, "labels": f.labels})
+	})
+	mux.HandleFunc("PUT /api/v4/projects/{project}/issues/7", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		f.change(r, func() {
+			f.labels = slices.DeleteFunc(f.labels, func(label string) bool {
+				return slices.Contains(strings.Split(body["remove_labels"], ","), label)
+			})
+			f.labels = append(f.labels, body["add_labels"])
+		})
+	})
+	mux.HandleFunc("GET /api/v4/projects/{project}/issues/7/notes", f.listComments)
+	mux.HandleFunc("POST /api/v4/projects/{project}/issues/7/notes", f.addComment)
+	mux.HandleFunc("PUT /api/v4/projects/{project}/issues/7/notes/{id}", f.updateComment)
+
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		f.header = r.Header.Clone()
+		f.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeTracker) record(r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.queries = append(f.queries, r.URL.RawQuery)
+}
+
+// change applies a change to issue 7 and records the request
+func (f *fakeTracker) change(r *http.Request, change func()) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.EscapedPath())
+	f.tokens = append(f.tokens, r.Header.Get("Authorization")+r.Header.Get("Private-Token"))
+	change()
+}
+
+func (f *fakeTracker) listComments(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	json.NewEncoder(w).Encode(f.comments)
+}
+
+func (f *fakeTracker) addComment(w http.ResponseWriter, r *http.Request) {
+	var comment issueComment
+	json.NewDecoder(r.Body).Decode(&comment)
+	f.change(r, func() {
+		comment.Id = f.nextId
+		f.nextId++
+		f.comments = append(f.comments, comment)
+	})
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeTracker) updateComment(w http.ResponseWriter, r *http.Request) {
+	var update issueComment
+	json.NewDecoder(r.Body).Decode(&update)
+	id, _ := strconv.Atoi(r.PathValue("id"))
+	f.change(r, func() {
+		for i := range f.comments {
+			if f.comments[i].Id == id {
+				f.comments[i].Body = update.Body
+			}
+		}
+	})
+}
+
+func (f *fakeTracker) state() (labels []string, comments []issueComment, requests []string) {
+	f.Lock()
+	defer f.Unlock()
+	return slices.Clone(f.labels), slices.Clone(f.comments), slices.Clone(f.requests)
+}
+
+// useFakeTracker points both providers at f
+func useFakeTracker(t *testing.T, f *fakeTracker) {
+	t.Helper()
+
+	config = loadConfig()
+	config.Issues = IssuesConfig{GitHubURL: f.URL, GitLabURL: f.URL}
+}
+
+func TestGitHubIssues(t *testing.T) {
+	f := newFakeTracker(t)
+	useFakeTracker(t, f)
+
+	tracker := newIssueTracker(IssueTrackerSettings{Provider: storySourceGitHub, Token: "ghp_secret"})
+	stories, err := tracker.Issues(context.Background(), "acme/shop", "Sprint 1", "ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stories) != 150 {
+		t.Fatalf("got %d stories, want 150 without the pull request", len(stories))
+	}
+	first := stories[0]
+	if first.Key != "acme/shop#1" || first.Title != "Issue 1" || first.Link != "https://github.example.com/issues/1" || first.Source != storySourceGitHub {
+		t.Errorf("first story = %+v", first)
+	}
+	if stories[149].Key != "acme/shop#150" {
+		t.Errorf("last story = %+v", stories[149])
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if len(f.queries) != 2 {
+		t.Fatalf("requested %d pages, want 2", len(f.queries))
+	}
+	for i, query := range f.queries {
+		want := fmt.Sprintf("labels=ready&milestone=3&page=%d&per_page=100&state=open", i+1)
+		if query != want {
+			t.Errorf("query %d = %s, want %s", i, query, want)
+		}
+	}
+	if f.header.Get("Authorization") != "Bearer ghp_secret" || f.header.Get("X-Github-Api-Version") == "" {
+		t.Errorf("headers = %v", f.header)
+	}
+}
+
+func TestGitLabIssues(t *testing.T) {
+	f := newFakeTracker(t)
+	useFakeTracker(t, f)
+
+	tracker := newIssueTracker(IssueTrackerSettings{Provider: storySourceGitLab, Token: "glpat-secret"})
+	stories, err := tracker.Issues(context.Background(), "acme/web/shop", "Sprint 1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stories) != 2 {
+		t.Fatalf("got %d stories, want 2", len(stories))
+	}
+	want := Story{Key: "acme/web/shop#4", Title: "Login", Description: "As a user", Link: "https://gitlab.example.com/issues/4", Source: storySourceGitLab}
+	if got := *stories[0]; got.Key != want.Key || got.Title != want.Title || got.Description != want.Description || got.Link != want.Link || got.Source != want.Source {
+		t.Errorf("first story = %+v, want %+v", got, want)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if len(f.queries) != 1 || f.queries[0] != "milestone=Sprint+1&page=1&per_page=100&state=opened" {
+		t.Errorf("queries = %v", f.queries)
+	}
+	if f.header.Get("Private-Token") != "glpat-secret" {
+		t.Errorf("headers = %v", f.header)
+	}
+}
+
+// writeBack runs the write-back of round for issue 7 of the provider
+func writeBack(session *Session, provider string, points int) {
+	story := &Story{Key: "acme/shop#7", Source: provider}
+	round := Round{Votes: map[string]RoundVote{"a": {Name: "Alex", Vote: points}}, Recommendation: points}
+	writeBackIssue(context.Background(), session, story, round)
+}
+
+func TestWriteBackLabel(t *testing.T) {
+	tests := []struct {
+		provider string
+		requests []string
+	}{
+		{storySourceGitHub, []string{
+			"DELETE /repos/acme/shop/issues/7/labels/points%2F3",
+			"POST /repos/acme/shop/issues/7/labels",
+		}},
+		{storySourceGitLab, []string{
+			"PUT /api/v4/projects/acme%2Fshop/issues/7",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			f := newFakeTracker(t)
+			useFakeTracker(t, f)
+
+			session := testSession()
+			session.setIssueTrackerSettings(IssueTrackerSettings{Provider: tt.provider, Repo: "acme/shop", Token: "secret", WriteBack: writeBackLabel})
+			writeBack(session, tt.provider, 5)
+
+			labels, _, requests := f.state()
+			if !slices.Equal(labels, []string{"bug", "points/5"}) {
+				t.Errorf("labels = %v", labels)
+			}
+			if !slices.Equal(requests, tt.requests) {
+				t.Errorf("requests = %v, want %v", requests, tt.requests)
+			}
+		})
+	}
+}
+
+func TestWriteBackComment(t *testing.T) {
+	tests := []struct {
+		provider string
+		requests []string
+	}{
+		{storySourceGitHub, []string{
+			"POST /repos/acme/shop/issues/7/comments",
+			"PATCH /repos/acme/shop/issues/comments/2",
+		}},
+		{storySourceGitLab, []string{
+			"POST /api/v4/projects/acme%2Fshop/issues/7/notes",
+			"PUT /api/v4/projects/acme%2Fshop/issues/7/notes/2",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			f := newFakeTracker(t)
+			useFakeTracker(t, f)
+
+			session := testSession()
+			session.setIssueTrackerSettings(IssueTrackerSettings{Provider: tt.provider, Repo: "acme/shop", Token: "secret", WriteBack: writeBackComment})
+
+			// the estimate of a re-vote updates the comment
+			writeBack(session, tt.provider, 5)
+			writeBack(session, tt.provider, 8)
+
+			labels, comments, requests := f.state()
+			want := []issueComment{{Id: 1, Body: "Looks big"}, {Id: 2, Body: estimateComment(8)}}
+			if !slices.Equal(comments, want) {
+				t.Errorf("comments = %v, want %v", comments, want)
+			}
+			if !slices.Equal(requests, tt.requests) {
+				t.Errorf("requests = %v, want %v", requests, tt.requests)
+			}
+			if !slices.Equal(labels, []string{"bug", "points/3"}) {
+				t.Errorf("labels = %v", labels)
+			}
+		})
+	}
+}
+
+func TestWriteBackNone(t *testing.T) {
+	f := newFakeTracker(t)
+	useFakeTracker(t, f)
+
+	session := testSession()
+	session.setIssueTrackerSettings(IssueTrackerSettings{Provider: storySourceGitHub, Repo: "acme/shop", Token: "secret", WriteBack: writeBackNone})
+	writeBack(session, storySourceGitHub, 5)
+
+	if _, _, requests := f.state(); len(requests) != 0 {
+		t.Errorf("requests = %v", requests)
+	}
+}
+
+func TestWriteBackWithSettingsOfRepo(t *testing.T) {
+	f := newFakeTracker(t)
+	useFakeTracker(t, f)
+
+	// repo B is imported after repo A of the same provider
+	session := testSession()
+	session.setIssueTrackerSettings(IssueTrackerSettings{Provider: storySourceGitLab, Repo: "acme/shop", Token: "token-a", WriteBack: writeBackLabel})
+	session.setIssueTrackerSettings(IssueTrackerSettings{Provider: storySourceGitLab, Repo: "acme/blog", Token: "token-b", WriteBack: writeBackComment})
+
+	round := Round{Votes: map[string]RoundVote{"a": {Name: "Alex", Vote: 5}}, Recommendation: 5}
+	writeBackIssue(context.Background(), session, &Story{Key: "acme/shop#7", Source: storySourceGitLab}, round)
+	writeBackIssue(context.Background(), session, &Story{Key: "acme/blog#7", Source: storySourceGitLab}, round)
+	// stories of repos without settings are not written back
+	writeBackIssue(context.Background(), session, &Story{Key: "acme/other#7", Source: storySourceGitLab}, round)
+
+	_, _, requests := f.state()
+	want := []string{
+		"PUT /api/v4/projects/acme%2Fshop/issues/7",
+		"POST /api/v4/projects/acme%2Fblog/issues/7/notes",
+	}
+	if !slices.Equal(requests, want) {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if !slices.Equal(f.tokens, []string{"token-a", "token-b"}) {
+		t.Errorf("tokens = %v", f.tokens)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The moderator can import Jira issues into the story list of a session,
+// either by a JQL query or from a sprint of a board. When the moderator
+// accepts a round of an imported issue, the estimate is written to the
+// story points field of the issue.
+//
+// All imports use the credentials of the server, and anyone can moderate a
+// session. So the import is only offered if the operator restricted it to
+// moderators of some groups, or to some projects or boards.
+
+const storySourceJira = "jira"
+
+// maxJQLLength keeps users from sending arbitrary large queries to Jira
+const maxJQLLength = 1000
+
+// jiraPageSize is the number of issues requested at once
+const jiraPageSize = 50
+
+// integrationTimeout limits requests to issue trackers
+const integrationTimeout = 30 * time.Second
+
+// httpDoer is implemented by *http.Client. Integrations only depend on it,
+// so that they can be pointed at fake servers.
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type JiraClient interface {
+	// Search returns the issues matching jql
+	Search(ctx context.Context, jql string) ([]*Story, error)
+	// SprintIssues returns the issues of a sprint of board. The active
+	// sprint is used if sprint is 0.
+	SprintIssues(ctx context.Context, board int, sprint int) ([]*Story, error)
+	SetStoryPoints(ctx context.Context, key string, points int) error
+}
+
+// jira is nil if the Jira integration is not configured
+var jira JiraClient
+
+type jiraClient struct {
+	baseURL string
+	// user is empty for personal access tokens, which are sent as bearer
+	// token. Otherwise user and token are sent with basic auth.
+	user             string
+	token            string
+	storyPointsField string
+	http             httpDoer
+}
+
+func newJiraClient(cfg JiraConfig, client httpDoer) *jiraClient {
+	return &jiraClient{
+		baseURL:          strings.TrimSuffix(cfg.URL, "/"),
+		user:             cfg.User,
+		token:            cfg.Token,
+		storyPointsField: cfg.StoryPointsField,
+		http:             client,
+	}
+}
+
+// JiraError is returned for responses of Jira with an error status
+type JiraError struct {
+	Status   int
+	Messages []string
+}
+
+func (e *JiraError) Error() string {
+	if len(e.Messages) == 0 {
+		return fmt.Sprintf("jira responded with status %d", e.Status)
+	}
+	return fmt.Sprintf("jira responded with status %d: %s", e.Status, strings.Join(e.Messages, ", "))
+}
+
+// do sends a request to the Jira API and decodes the response into result,
+// if it is not nil
+func (j *jiraClient) do(ctx context.Context, method string, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, j.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if j.user != "" {
+		req.SetBasicAuth(j.user, j.token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+j.token)
+	}
+
+	resp, err := j.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		jiraErr := &JiraError{Status: resp.StatusCode}
+		var errBody struct {
+			ErrorMessages []string          `json:"errorMessages"`
+			Errors        map[string]string `json:"errors"`
+		}
+		if json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&errBody) == nil {
+			jiraErr.Messages = errBody.ErrorMessages
+			for field, message := range errBody.Errors {
+				jiraErr.Messages = append(jiraErr.Messages, field+": "+message)
+			}
+		}
+		return jiraErr
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+type jiraIssue struct {
+	Key    string `json:"key"`
+	Fields struct {
+		Summary     string `json:"summary"`
+		Description string `json:"description"`
+	} `json:"fields"`
+}
+
+type jiraIssuePage struct {
+	StartAt    int         `json:"startAt"`
+	MaxResults int         `json:"maxResults"`
+	Total      int         `json:"total"`
+	Issues     []jiraIssue `json:"issues"`
+}
+
+func (j *jiraClient) story(issue jiraIssue) *Story {
+	return &Story{
+		Key:         issue.Key,
+		Title:       issue.Fields.Summary,
+		Description: issue.Fields.Description,
+		Link:        j.baseURL + "/browse/" + url.PathEscape(issue.Key),
+		Source:      storySourceJira,
+	}
+}
+
+// issues requests all pages of path, but no more than maxStories issues
+func (j *jiraClient) issues(ctx context.Context, path string, query url.Values) ([]*Story, error) {
+	query.Set("fields", "summary,description")
+	query.Set("maxResults", strconv.Itoa(jiraPageSize))
+
+	var stories []*Story
+	for len(stories) < maxStories {
+		query.Set("startAt", strconv.Itoa(len(stories)))
+
+		var page jiraIssuePage
+		if err := j.do(ctx, http.MethodGet, path+"?"+query.Encode(), nil, &page); err != nil {
+			return nil, err
+		}
+		for _, issue := range page.Issues {
+			stories = append(stories, j.story(issue))
+		}
+		if len(page.Issues) == 0 || len(stories) >= page.Total {
+			break
+		}
+	}
+	return stories, nil
+}
+
+func (j *jiraClient) Search(ctx context.Context, jql string) ([]*Story, error) {
+	return j.issues(ctx, "/rest/api/2/search", url.Values{"jql": {jql}})
+}
+
+var errNoActiveSprint = errors.New("the board has no active sprint")
+
+func (j *jiraClient) SprintIssues(ctx context.Context, board int, sprint int) ([]*Story, error) {
+	if sprint == 0 {
+		var sprints struct {
+			Values []struct {
+				Id int `json:"id"`
+			} `json:"values"`
+		}
+		path := fmt.Sprintf("/rest/agile/1.0/board/%d/sprint?state=active", board)
+		if err := j.do(ctx, http.MethodGet, path, nil, &sprints); err != nil {
+			return nil, err
+		}
+		if len(sprints.Values) == 0 {
+			return nil, errNoActiveSprint
+		}
+		sprint = sprints.Values[0].Id
+	}
+
+	return j.issues(ctx, fmt.Sprintf("/rest/agile/1.0/board/%d/sprint/%d/issue", board, sprint), url.Values{})
+}
+
+func (j *jiraClient) SetStoryPoints(ctx context.Context, key string, points int) error {
+	body := map[string]any{
+		"fields": map[string]any{j.storyPointsField: points},
+	}
+	return j.do(ctx, http.MethodPut, "/rest/api/2/issue/"+url.PathEscape(key), body, nil)
+}
+
+// writeBackJira is an accept hook that writes the estimate of Jira issues
+// back to Jira
+func writeBackJira(ctx context.Context, session *Session, story *Story, round Round) {
+	if story == nil || story.Source != storySourceJira || len(round.Votes) == 0 {
+		return
+	}
+
+	err := jira.SetStoryPoints(ctx, story.Key, round.Recommendation)
+	if err != nil {
+		// logger.Error("could not write estimate to jira", "session", session.Id, "issue", story.Key, "error", err)
+		writeBacks.WithLabelValues(storySourceJira, "error").Inc()
+		return
+	}
+	// logger.Info("wrote estimate to jira", "session", session.Id, "issue", story.Key, "points", round.Recommendation)
+	writeBacks.WithLabelValues(storySourceJira, "ok").Inc()
+}
+
+func postJiraImport(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("POST /stories/{sessionId}/jira").Inc()
+
+	if jira == nil {
+		http.Error(w, "jira is not configured", http.StatusNotFound)
+		return
+	}
+
+	session, user, ok := moderatorSession(w, r)
+	if !ok {
+		return
+	}
+	if !canImportJira(user) {
+		http.Error(w, "you are not allowed to import Jira issues", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "could not parse form", http.StatusBadRequest)
+		return
+	}
+
+	var stories []*Story
+	var err error
+
+	jql := strings.TrimSpace(r.Form.Get("jql"))
+	board := strings.TrimSpace(r.Form.Get("board"))
+
+	switch {
+	case jql != "":
+		if len(config.Jira.Groups) == 0 && len(config.Jira.Projects) == 0 {
+			http.Error(w, "JQL queries are not allowed, import a board instead", http.StatusForbidden)
+			return
+		}
+		if len(jql) > maxJQLLength {
+			err = invalid("jql", "JQL must not be longer than %d characters", maxJQLLength)
+			break
+		}
+		stories, err = jira.Search(r.Context(), jql)
+	case board != "":
+		boardId, boardErr := strconv.Atoi(board)
+		sprintId, sprintErr := strconv.Atoi(strings.TrimSpace(r.Form.Get("sprint")))
+		if r.Form.Get("sprint") == "" {
+			sprintId, sprintErr = 0, nil
+		}
+		if boardErr != nil || sprintErr != nil || boardId <= 0 || sprintId < 0 {
+			err = invalid("board", "Board and sprint have to be numbers")
+			break
+		}
+		if len(config.Jira.Boards) > 0 && !slices.Contains(config.Jira.Boards, strconv.Itoa(boardId)) {
+			http.Error(w, "you are not allowed to import this board", http.StatusForbidden)
+			return
+		}
+		stories, err = jira.SprintIssues(r.Context(), boardId, sprintId)
+	default:
+		err = invalid("jql", "Please enter a JQL query or a board")
+	}
+
+	importStories(w, session, user, storySourceJira, jiraProjectStories(stories), err)
+}
+
+// canImportJira reports whether user may import issues with the
+// credentials of the server. If groups are configured, user has to be a
+// member of one of them. Otherwise the import is only allowed if it is
+// restricted to projects or boards.
+func canImportJira(user *User) bool {
+	if len(config.Jira.Groups) > 0 {
+		return user != nil && user.Subject != "" && slices.ContainsFunc(user.Groups, func(group string) bool {
+			return slices.Contains(config.Jira.Groups, group)
+		})
+	}
+	return len(config.Jira.Projects) > 0 || len(config.Jira.Boards) > 0
+}
+
+// jiraProjectStories drops the stories that don't belong to the configured
+// projects. All stories are kept if no projects are configured.
+func jiraProjectStories(stories []*Story) []*Story {
+	if len(config.Jira.Projects) == 0 {
+		return stories
+	}
+	return slices.DeleteFunc(stories, func(story *Story) bool {
+		project, _, _ := strings.Cut(story.Key, "-")
+		return !slices.ContainsFunc(config.Jira.Projects, func(allowed string) bool {
+			return strings.EqualFold(allowed, project)
+		})
+	})
+}
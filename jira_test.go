@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeJira records the requests it receives
+type fakeJira struct {
+	*httptest.Server
+	sync.Mutex
+	requests []*http.Request
+	bodies   []string
+}
+
+func newFakeJira(t *testing.T, handler http.HandlerFunc) *fakeJira {
+	t.Helper()
+
+	f := &fakeJira{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		f.Lock()
+		f.requests = append(f.requests, r)
+		f.bodies = append(f.bodies, string(body))
+		f.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeJira) received() ([]*http.Request, []string) {
+	f.Lock()
+	defer f.Unlock()
+	return append([]*http.Request(nil), f.requests...), append([]string(nil), f.bodies...)
+}
+
+// jiraPage answers a search with total issues PROJ-0, PROJ-1, ... in pages
+func jiraPage(w http.ResponseWriter, r *http.Request, total int) {
+	startAt, _ := strconv.Atoi(r.URL.Query().Get("startAt"))
+	maxResults, _ := strconv.Atoi(r.URL.Query().Get("maxResults"))
+
+	page := jiraIssuePage{StartAt: startAt, MaxResults: maxResults, Total: total, Issues: []jiraIssue{}}
+	for i := startAt; i < total && i < startAt+maxResults; i++ {
+		issue := jiraIssue{Key: fmt.Sprintf("PROJ-%d", i)}
+		issue.Fields.Summary = fmt.Sprintf("Story %d", i)
+		issue.Fields.Description = "Description"
+		page.Issues = append(page.Issues, issue)
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func TestJiraSearch(t *testing.T) {
+	server := newFakeJira(t, func(w http.ResponseWriter, r *http.Request) {
+		jiraPage(w, r, 120)
+	})
+	client := newJiraClient(JiraConfig{URL: server.URL + "/", User: "bot@example.com", Token: "secret"}, server.Client())
+
+	stories, err := client.Search(context.Background(), `project = PROJ AND sprint in openSprints()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stories) != 120 {
+		t.Fatalf("got %d stories, want 120", len(stories))
+	}
+	want := Story{
+		Key:         "PROJ-51",
+		Title:       "Story 51",
+		Description: "Description",
+		Link:        server.URL + "/browse/PROJ-51",
+		Source:      storySourceJira,
+	}
+	if got := *stories[51]; got.Key != want.Key || got.Title != want.Title || got.Description != want.Description || got.Link != want.Link || got.Source != want.Source {
+		t.Errorf("story 51 = %+v, want %+v", got, want)
+	}
+
+	requests, _ := server.received()
+	if len(requests) != 3 {
+		t.Fatalf("sent %d requests, want 3 pages", len(requests))
+	}
+	for i, r := range requests {
+		query := r.URL.Query()
+		if r.Method != http.MethodGet || r.URL.Path != "/rest/api/2/search" {
+			t.Errorf("request %d: %s %s", i, r.Method, r.URL.Path)
+		}
+		if query.Get("jql") != `project = PROJ AND sprint in openSprints()` || query.Get("fields") != "summary,description" {
+			t.Errorf("request %d: query %v", i, query)
+		}
+		if query.Get("startAt") != strconv.Itoa(i*jiraPageSize) || query.Get("maxResults") != strconv.Itoa(jiraPageSize) {
+			t.Errorf("request %d: startAt %s, maxResults %s", i, query.Get("startAt"), query.Get("maxResults"))
+		}
+		if user, password, ok := r.BasicAuth(); !ok || user != "bot@example.com" || password != "secret" {
+			t.Errorf("request %d: basic auth %q, %q", i, user, password)
+		}
+	}
+}
+
+func TestJiraSearchIsLimited(t *testing.T) {
+	server := newFakeJira(t, func(w http.ResponseWriter, r *http.Request) {
+		jiraPage(w, r, 1000)
+	})
+	client := newJiraClient(JiraConfig{URL: server.URL, Token: "secret"}, server.Client())
+
+	stories, err := client.Search(context.Background(), "project = PROJ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stories) != maxStories {
+		t.Errorf("got %d stories, want %d", len(stories), maxStories)
+	}
+}
+
+func TestJiraSprintIssues(t *testing.T) {
+	server := newFakeJira(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rest/agile/1.0/board/7/sprint":
+			w.Write([]byte(`{"values":[{"id":42}]}`))
+		case "/rest/agile/1.0/board/7/sprint/42/issue":
+			jiraPage(w, r, 2)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	client := newJiraClient(JiraConfig{URL: server.URL, Token: "pat"}, server.Client())
+
+	stories, err := client.SprintIssues(context.Background(), 7, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stories) != 2 || stories[1].Key != "PROJ-1" {
+		t.Errorf("stories = %v", stories)
+	}
+
+	requests, _ := server.received()
+	if len(requests) != 2 || requests[0].URL.Query().Get("state") != "active" {
+		t.Fatalf("requests = %v", requests)
+	}
+	for _, r := range requests {
+		if r.Header.Get("Authorization") != "Bearer pat" {
+			t.Errorf("%s: authorization %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+	}
+}
+
+func TestJiraSprintIssuesWithoutActiveSprint(t *testing.T) {
+	server := newFakeJira(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"values":[]}`))
+	})
+	client := newJiraClient(JiraConfig{URL: server.URL, Token: "pat"}, server.Client())
+
+	if _, err := client.SprintIssues(context.Background(), 7, 0); !errors.Is(err, errNoActiveSprint) {
+		t.Errorf("err = %v, want %v", err, errNoActiveSprint)
+	}
+}
+
+func TestJiraSetStoryPoints(t *testing.T) {
+	server := newFakeJira(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	client := newJiraClient(JiraConfig{URL: server.URL, User: "bot@example.com", Token: "secret", StoryPointsField: "customfield_10016"}, server.Client())
+
+	if err := client.SetStoryPoints(context.Background(), "PROJ-1", 8); err != nil {
+		t.Fatal(err)
+	}
+
+	requests, bodies := server.received()
+	if len(requests) != 1 {
+		t.Fatalf("sent %d requests, want 1", len(requests))
+	}
+	r := requests[0]
+	if r.Method != http.MethodPut || r.URL.Path != "/rest/api/2/issue/PROJ-1" {
+		t.Errorf("request %s %s", r.Method, r.URL.Path)
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("content type %q", r.Header.Get("Content-Type"))
+	}
+	if user, password, ok := r.BasicAuth(); !ok || user != "bot@example.com" || password != "secret" {
+		t.Errorf("basic auth %q, %q", user, password)
+	}
+	if bodies[0] != `{"fields":{"customfield_10016":8}}` {
+		t.Errorf("body %s", bodies[0])
+	}
+}
+
+func TestJiraError(t *testing.T) {
+	server := newFakeJira(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"errorMessages":["Issue does not exist"],"errors":{}}`))
+	})
+	client := newJiraClient(JiraConfig{URL: server.URL, Token: "pat", StoryPointsField: "customfield_10016"}, server.Client())
+
+	err := client.SetStoryPoints(context.Background(), "PROJ-404", 3)
+	var jiraErr *JiraError
+	if !errors.As(err, &jiraErr) || jiraErr.Status != http.StatusBadRequest || len(jiraErr.Messages) != 1 || jiraErr.Messages[0] != "Issue does not exist" {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestJiraImportPermissions(t *testing.T) {
+	server := newFakeJira(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rest/api/2/search":
+			w.Write([]byte(`{"startAt":0,"maxResults":50,"total":3,"issues":[{"key":"PROJ-1"},{"key":"SECRET-1"},{"key":"proj-2"}]}`))
+		case "/rest/agile/1.0/board/7/sprint/1/issue":
+			jiraPage(w, r, 2)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	jira = newJiraClient(JiraConfig{URL: server.URL, Token: "pat"}, server.Client())
+	t.Cleanup(func() { jira = nil })
+
+	tests := []struct {
+		name   string
+		config JiraConfig
+		form   url.Values
+		cookie *http.Cookie
+		want   int
+		// imported is the number of stories that were imported
+		imported int
+	}{
+		{"unrestricted", JiraConfig{}, url.Values{"jql": {"project = SECRET"}}, identityCookie("alice-id", "Alice"), http.StatusForbidden, 0},
+		{"anonymous moderator", JiraConfig{Groups: []string{"team-a"}}, url.Values{"jql": {"project = SECRET"}}, identityCookie("alice-id", "Alice"), http.StatusForbidden, 0},
+		{"other group", JiraConfig{Groups: []string{"team-a"}}, url.Values{"jql": {"project = SECRET"}}, loginCookie("alice-id", "Alice", "team-b"), http.StatusForbidden, 0},
+		{"member", JiraConfig{Groups: []string{"team-a"}}, url.Values{"jql": {"project = SECRET"}}, loginCookie("alice-id", "Alice", "team-a"), http.StatusOK, 3},
+		{"projects", JiraConfig{Projects: []string{"PROJ"}}, url.Values{"jql": {"project = SECRET"}}, identityCookie("alice-id", "Alice"), http.StatusOK, 2},
+		{"jql without projects", JiraConfig{Boards: []string{"7"}}, url.Values{"jql": {"project = SECRET"}}, identityCookie("alice-id", "Alice"), http.StatusForbidden, 0},
+		{"allowed board", JiraConfig{Boards: []string{"7"}}, url.Values{"board": {"7"}, "sprint": {"1"}}, identityCookie("alice-id", "Alice"), http.StatusOK, 2},
+		{"other board", JiraConfig{Boards: []string{"7"}}, url.Values{"board": {"8"}, "sprint": {"1"}}, identityCookie("alice-id", "Alice"), http.StatusForbidden, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestServer(t, func(c *Config) { c.Jira = tt.config })
+			session := startTestSession(t, "alice-id")
+
+			before, _ := server.received()
+			resp := postForm(t, app.URL+"/stories/"+session.Id+"/jira", tt.form, tt.cookie)
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("import responded with %d %s, want %d", resp.StatusCode, body, tt.want)
+			}
+			if after, _ := server.received(); tt.want == http.StatusForbidden && len(after) != len(before) {
+				t.Errorf("a forbidden import sent %d requests to jira", len(after)-len(before))
+			}
+			if tt.want == http.StatusOK && !strings.Contains(string(body), fmt.Sprintf("Imported %d stories", tt.imported)) {
+				t.Errorf("import answered %s, want %d stories", body, tt.imported)
+			}
+		})
+	}
+}
@@ -1,21 +1,26 @@
 package main
 
 import (
+	"context"
 	"embed"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"html/template"
+	"io/fs"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/collectors"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 	"nhooyr.io/websocket"
 )
 
@@ -27,8 +32,59 @@ const (
 	USER_JOINED
 	USER_VOTED
 	RESET
+	TIMEOUT
+	BANNER
+	CLOSED
+	EXPIRING
+	EXTENDED
+	COUNTDOWN
+	STORIES_ADDED
+	NEXT_STORY
+	REVEAL
+	REVOTE
+	ASYNC_CHANGED
+	ACCEPT
 )
 
+func (e Event) String() string {
+	switch e {
+	case USER_LEFT:
+		return "user_left"
+	case USER_JOINED:
+		return "user_joined"
+	case USER_VOTED:
+		return "user_voted"
+	case RESET:
+		return "reset"
+	case TIMEOUT:
+		return "timeout"
+	case BANNER:
+		return "banner"
+	case CLOSED:
+		return "closed"
+	case EXPIRING:
+		return "expiring"
+	case EXTENDED:
+		return "extended"
+	case COUNTDOWN:
+		return "countdown"
+	case STORIES_ADDED:
+		return "stories_added"
+	case NEXT_STORY:
+		return "next_story"
+	case REVEAL:
+		return "reveal"
+	case REVOTE:
+		return "revote"
+	case ASYNC_CHANGED:
+		return "async_changed"
+	case ACCEPT:
+		return "accept"
+	default:
+		return "default"
+	}
+}
+
 type HtmxWsHeaders struct {
 	HxRequest     string `json:"HX-Request"`
 	HxTrigger     string `json:"HX-Trigger"`
@@ -43,17 +99,54 @@ type HtmxWsResponse struct {
 }
 
 type Data struct {
+	ctx            context.Context
 	event          Event
-	Scale          Scale
+	publishedAt    time.Time
+	Scale          ScaleDefinition
 	AllVoted       bool
 	SessionName    string
 	MyUser         *User
 	OtherUsers     []*User
 	SessionId      string
+	JoinCode       string
 	Vote           string
 	Average        float64
 	Median         float64
 	Recommendation int
+	Banner         string
+	// Moderator is true if MyUser is the moderator of the session
+	Moderator bool
+	ExpiresAt time.Time
+	Reason    string
+	// Error is shown to the user if a form could not be processed
+	Error string
+	// Protected is true if the session requires a passphrase or invite
+	Protected  bool
+	InviteLink string
+	// CSRFToken is sent by htmx with every request of a full page
+	CSRFToken string
+	// Countdown is the number of seconds until the votes are revealed
+	Countdown int
+	// Result is the revealed round
+	Result *Round
+	// Accepted is true once the moderator accepted Result
+	Accepted bool
+	// Backlog is the story that is estimated and its position in the list
+	Backlog Backlog
+	// Imported is the number of stories added by an import
+	Imported int
+	// CSVPreview shows the stories of an uploaded CSV file
+	CSVPreview *CSVPreview
+	// IssueTracker are the most recently saved settings of the GitHub or
+	// GitLab import
+	IssueTracker *IssueTrackerSettings
+	// Async is the queue of async sessions, which replaces the deck
+	Async *AsyncView
+}
+
+// LoginEnabled reports whether users can log in via OIDC
+func (d Data) LoginEnabled() bool {
+	return oidcLogin != nil
 }
 
 //go:embed web/template/*.html
@@ -68,35 +161,36 @@ var templateSession = template.Must(template.ParseFS(templatesFS, "web/template/
 var lockSessions sync.RWMutex
 var sessions = make(map[string]*Session)
 
+// joinCodes maps short, readable join codes to session ids
+var joinCodes = make(map[string]string)
+
+func getSessionById(id string) (*Session, bool) {
+	lockSessions.RLock()
+	defer lockSessions.RUnlock()
+
+	session, ok := sessions[id]
+	return session, ok
+}
+
+// listSessions returns a snapshot of all active sessions
+func listSessions() []*Session {
+	lockSessions.RLock()
+	defer lockSessions.RUnlock()
+
+	list := make([]*Session, 0, len(sessions))
+	for _, session := range sessions {
+		list = append(list, session)
+	}
+	return list
+}
+
 // TODO: Log info about requester (ip, ...)
 // TODO: Instrumentation with Prometheus?
 // TODO: Current solution with fixed element for voting-candidates is not good -> Maybe sticky footer?
-// TODO: Write test cmd that spawns websocket clients
-// TODO: username collisions
 // TODO: Safari isn't saving cookies
 // TODO: Styling: Dark Mode / Light Mode
 // TODO: Styling: Responsive Design
 
-var httpReqs = prometheus.NewCounterVec(
-	prometheus.CounterOpts{
-		Name: "http_requests_total",
-		Help: "How many HTTP requests processed, partitioned by endpoint path",
-	},
-	[]string{"path"},
-)
-
-func newUserNameCookie(userName string) *http.Cookie {
-	return &http.Cookie{
-		Name:     "username",
-		Value:    base64.URLEncoding.EncodeToString([]byte(userName)),
-		Path:     "/",
-		MaxAge:   3600 * 24 * 365 * 5, // 5 years
-		Secure:   true,
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-	}
-}
-
 func index(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -105,29 +199,9 @@ func index(w http.ResponseWriter, r *http.Request) {
 
 	httpReqs.WithLabelValues("GET /").Inc()
 
-	cookieUserName, err := r.Cookie("username")
-
-	user := &User{
-		Name: "",
-		Vote: -1,
-	}
-
-	if errors.Is(err, http.ErrNoCookie) {
-		// logger.Info("new user wants to create session")
-	} else if err != nil {
-		// logger.Error("unexpected error while checking cookie", "error", err)
-		return
-	} else {
-		un, err := base64.URLEncoding.DecodeString(cookieUserName.Value)
-		if err != nil {
-			// logger.Error("unexpected error while decoding cookie value")
-		}
-		// logger.Info("known user wants to create session", "userName", string(un))
-		user.Name = string(un)
-	}
-
-	err = templateIndex.Execute(w, Data{
-		MyUser: user,
+	err := templateIndex.Execute(w, Data{
+		MyUser:    identify(w, r),
+		CSRFToken: csrfToken(w, r),
 	})
 
 	if err != nil {
@@ -164,69 +238,228 @@ func newSession(w http.ResponseWriter, r *http.Request) {
 	}
 
 	form := r.Form
-	sessionName := form.Get("session-name")
-	sessionName = strings.TrimSpace(sessionName)
+	user := identify(w, r)
 
-	cookieUserName, err := r.Cookie("username")
+	sessionName, err := validateSessionName(form.Get("session-name"))
+	if err != nil {
+		createSessionError(w, user, err)
+		return
+	}
 
-	user := &User{
-		Name: "",
-		Vote: -1,
+	userName := ""
+	if user.Id == "" {
+		userName, err = validateUserName(form.Get("username"))
+		if err != nil {
+			createSessionError(w, user, err)
+			return
+		}
 	}
-	if errors.Is(err, http.ErrNoCookie) {
-		userName := form.Get("username")
-		userName = strings.TrimSpace(userName)
-		user.Name = userName
 
-		cookieUserName = newUserNameCookie(userName)
-		http.SetCookie(w, cookieUserName)
-	} else if err != nil {
-		// logger.Error("unexpected error while checking cookie", "error", err)
-	} else {
-		un, err := base64.URLEncoding.DecodeString(cookieUserName.Value)
+	scaleName := form.Get("scale")
+	scale, err := validateScale(scaleName)
+	if err != nil {
+		createSessionError(w, user, err)
+		return
+	}
+
+	strategy, err := validateStrategy(form.Get("strategy"))
+	if err != nil {
+		createSessionError(w, user, err)
+		return
+	}
+
+	role, err := validateRole(form.Get("role"))
+	if err != nil {
+		createSessionError(w, user, err)
+		return
+	}
+
+	passphrase := form.Get("passphrase")
+	if err = validatePassphrase(passphrase); err != nil {
+		createSessionError(w, user, err)
+		return
+	}
+
+	async, err := validateAsync(form.Get("async") != "", form.Get("async-days"), form.Get("async-quorum"))
+	if err != nil {
+		createSessionError(w, user, err)
+		return
+	}
+
+	slug := strings.TrimSpace(form.Get("room"))
+	if async != nil && slug == "" {
+		createSessionError(w, user, invalid("room", "Async sessions need a room, so that stories and votes are kept"))
+		return
+	}
+
+	requireLogin := oidcLogin != nil && form.Get("require-login") != ""
+	var allowedGroups []string
+	if requireLogin {
+		allowedGroups = parseGroups(form.Get("allowed-groups"))
+	}
+
+	if requireLogin && user.Subject == "" {
+		createSessionError(w, user, errors.New("Please log in to restrict the session to logged in users"))
+		return
+	}
+
+	if user.Id != "" {
+		userName = user.Name
+	}
+	login(w, user, userName, role)
+
+	var passphraseHash []byte
+	if passphrase != "" {
+		passphraseHash, err = hashPassphrase(passphrase)
 		if err != nil {
-			// logger.Error("unexpected error while decoding cookie value")
+			// logger.Error("could not hash passphrase", "error", err)
+			http.Error(w, "could not hash passphrase", http.StatusInternalServerError)
+			return
 		}
-		// logger.Info("known user wants to create session", "userName", string(un))
-		user.Name = string(un)
 	}
 
-	scale := form.Get("scale")
-	sessionId := randSeq(16)
+	var session *Session
+	pushUrl := ""
+
+	if slug != "" {
+		room := &Room{
+			Slug:  slug,
+			Name:  sessionName,
+			Scale: scaleName,
+			Settings: RoomSettings{
+				ModeratorId:    user.Id,
+				PassphraseHash: passphraseHash,
+				RequireLogin:   requireLogin,
+				AllowedGroups:  allowedGroups,
+				Strategy:       strategy.Name,
+				Async:          async,
+			},
+			CreatedAt: time.Now(),
+			LastUsed:  time.Now(),
+		}
+
+		if !validSlug(slug) {
+			err = ErrInvalidSlug
+		} else {
+			err = rooms.Create(room)
+		}
+
+		if err != nil {
+			// logger.Info("could not create room", "room", slug, "error", err)
+			createSessionError(w, user, err)
+			return
+		}
 
-	session := &Session{
-		Users:     make(map[string]*User),
-		scale:     scales[scale],
-		broadcast: make(chan Data),
-		Id:        sessionId,
-		Name:      sessionName,
+		session, err = activateRoom(room)
+		pushUrl = "/r/" + slug
+	} else {
+		session = newSessionState(sessionName, user.Id, scale, config.Expiry)
+		session.passphraseHash = passphraseHash
+		session.requireLogin = requireLogin
+		session.allowedGroups = allowedGroups
+		session.strategy = strategy
+		err = startSession(session)
+		pushUrl = "/" + session.Id
 	}
 
-	lockSessions.Lock()
-	sessions[sessionId] = session
-	lockSessions.Unlock()
+	if err != nil {
+		// logger.Warn("could not start session", "error", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
-	activeSessions.Inc()
-	go session.handleBroadcast()
+	session.grantAccess(w)
 
-	w.Header().Add("HX-Push-Url", "/"+sessionId)
+	w.Header().Add("HX-Push-Url", pushUrl)
 	err = templates.ExecuteTemplate(w, "session", Data{
-		Scale:       scales[scale],
+		Banner:      getBanner(),
+		Scale:       session.scale,
 		MyUser:      user,
-		SessionId:   sessionId,
-		SessionName: sessionName,
+		Moderator:   session.isModerator(user),
+		Protected:   session.protected(),
+		SessionId:   session.Id,
+		JoinCode:    session.JoinCode,
+		SessionName: session.Name,
+		Async:       session.asyncView(user),
 	})
 
 	if err != nil {
-		// logger.Error("could not execute template", "template", "session", "session", sessionId, "error", err)
+		// logger.Error("could not execute template", "template", "session", "session", session.Id, "error", err)
 	}
 
 	if _, err = w.Write([]byte("<title>Pointing Poker | " + session.Name + "</title>")); err != nil {
-		// logger.Error("could not write to response", "session", sessionId, "error", err)
+		// logger.Error("could not write to response", "session", session.Id, "error", err)
 	}
+}
 
-	if _, err = w.Write([]byte("<title>Pointing Poker | " + session.Name + "</title>")); err != nil {
-		// logger.Error("could not write to response", "session", sessionId, "error", err)
+// createSessionError shows err in the form to create a session
+func createSessionError(w http.ResponseWriter, user *User, err error) {
+	err = templateIndex.ExecuteTemplate(w, "content", Data{
+		MyUser: user,
+		Error:  err.Error(),
+	})
+	if err != nil {
+		// logger.Error("could not execute template", "template", "index", "error", err)
+	}
+}
+
+// startSession registers session and starts its broadcast loop
+func startSession(session *Session) error {
+	lockSessions.Lock()
+	err := registerSession(session)
+	lockSessions.Unlock()
+	if err != nil {
+		return err
+	}
+
+	activeSessions.Inc()
+	go session.handleBroadcast()
+	session.emitCreated()
+	return nil
+}
+
+var ErrTooManySessions = errors.New("too many active sessions, please try again later")
+
+// registerSession assigns a unique id and join code to session and adds it
+// to the active sessions. It fails if the maximum number of sessions is
+// reached. lockSessions has to be held by the caller.
+func registerSession(session *Session) error {
+	if max := config.Limits.MaxSessions; max > 0 && len(sessions) >= max {
+		rateLimited.WithLabelValues(limitSessions).Inc()
+		return ErrTooManySessions
+	}
+
+	cfg := config.SessionIds
+
+	for {
+		session.Id = randSeq(cfg.Length, cfg.Alphabet)
+		if _, ok := sessions[session.Id]; !ok {
+			break
+		}
+		// logger.Warn("session id collision", "session", session.Id)
+	}
+	sessions[session.Id] = session
+
+	if !cfg.JoinCodes {
+		return nil
+	}
+
+	for {
+		session.JoinCode = randSeq(3, joinCodeLetters) + "-" + randSeq(3, joinCodeDigits)
+		if _, ok := joinCodes[session.JoinCode]; !ok {
+			break
+		}
+	}
+	joinCodes[session.JoinCode] = session.Id
+	return nil
+}
+
+// unregisterSession removes session from the active sessions. lockSessions
+// has to be held by the caller.
+func unregisterSession(session *Session) {
+	delete(sessions, session.Id)
+	if session.JoinCode != "" {
+		delete(joinCodes, session.JoinCode)
 	}
 }
 
@@ -240,64 +473,121 @@ func getSession(w http.ResponseWriter, r *http.Request) {
 	// route := fmt.Sprintf("GET /%s", sessionId)
 	httpReqs.WithLabelValues("GET /{sessionId}").Inc()
 
-	cookieUserName, err := r.Cookie("username")
-
-	user := &User{
-		Name: "",
-		Vote: -1,
-	}
-
-	if errors.Is(err, http.ErrNoCookie) {
-		// logger.Info("new user wants to join session")
-	} else if err != nil {
-		// logger.Error("unexpected error while checking cookie", "error", err)
-	} else {
-		un, err := base64.URLEncoding.DecodeString(cookieUserName.Value)
-		if err != nil {
-			// logger.Error("unexpected error while decoding cookie value")
-		}
-		// logger.Info("known user wants to create session", "userName", string(un))
-		user.Name = string(un)
-	}
-
-	if _, ok := sessions[sessionId]; !ok {
+	session, ok := getSessionById(sessionId)
+	if !ok {
 		// logger.Warn("session does not exist", "session", sessionId)
+		// cookies have to be set before the status is written
+		data := Data{
+			SessionId: sessionId,
+			MyUser:    identify(w, r),
+			CSRFToken: csrfToken(w, r),
+		}
 		w.WriteHeader(http.StatusNotFound)
 
-		err := templateNotFound.Execute(w, Data{
-			SessionId: sessionId,
-			MyUser:    user,
-		})
+		err := templateNotFound.Execute(w, data)
 		if err != nil {
 			// logger.Error("could not execute template", "template", "not-found", "route", route, "error", err, "session", sessionId)
 		}
 		return
 	}
 
-	if len(user.Name) > 0 {
-		session := sessions[sessionId]
-		err = templateSession.Execute(w, Data{
-			MyUser:      user,
-			OtherUsers:  session.getOtherUsers(user.Name),
-			SessionId:   session.Id,
-			SessionName: session.Name,
-			Scale:       session.scale,
+	showSession(w, r, session)
+}
+
+// showSession renders the full page of session. Unknown users are asked
+// for their name first, and for the passphrase if the session is protected.
+func showSession(w http.ResponseWriter, r *http.Request, session *Session) {
+	user := identify(w, r)
+
+	if !session.admits(user) {
+		rejectUser(w, r, session, user)
+		return
+	}
+
+	access := session.hasAccess(r)
+	if !access && session.checkInvite(r.URL.Query().Get("invite")) {
+		session.grantAccess(w)
+		access = true
+	}
+
+	if len(user.Name) > 0 && access {
+		err := templateSession.Execute(w, Data{
+			Banner:       getBanner(),
+			MyUser:       user,
+			Moderator:    session.isModerator(user),
+			Protected:    session.protected(),
+			OtherUsers:   session.getOtherUsers(user.Id),
+			SessionId:    session.Id,
+			JoinCode:     session.JoinCode,
+			SessionName:  session.Name,
+			Scale:        session.scale,
+			Countdown:    session.countdownRemaining(),
+			Backlog:      session.backlog(),
+			CSRFToken:    csrfToken(w, r),
+			IssueTracker: session.issueTrackerSettings("", ""),
+			Async:        session.asyncView(user),
 		})
 		if err != nil {
-			// logger.Error("could not execute template", "template", "session", "session", sessionId, "error", err)
+			// logger.Error("could not execute template", "template", "session", "session", session.Id, "error", err)
 		}
 		return
 	}
 
-	sessionName := sessions[sessionId].Name
-	err = templateJoinSession.Execute(w, Data{
-		SessionId:   sessionId,
-		SessionName: sessionName,
+	err := templateJoinSession.Execute(w, Data{
+		MyUser:      user,
+		CSRFToken:   csrfToken(w, r),
+		Protected:   !access,
+		SessionId:   session.Id,
+		SessionName: session.Name,
 	})
 
 	if err != nil {
-		// logger.Error("could not execute template", "template", "join-session", "session", sessionId, "error", err)
+		// logger.Error("could not execute template", "template", "join-session", "session", session.Id, "error", err)
+	}
+}
+
+// getJoinCode redirects to the session a join code belongs to. The code
+// is either part of the path or sent as query parameter by the join form.
+func getJoinCode(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("GET /join/{code}").Inc()
+
+	code := r.PathValue("code")
+	if code == "" {
+		code = r.URL.Query().Get("code")
+	}
+	code = normalizeJoinCode(code)
+
+	lockSessions.RLock()
+	sessionId, ok := joinCodes[code]
+	lockSessions.RUnlock()
+
+	if !ok {
+		// logger.Warn("join code does not exist", "code", code)
+		// cookies have to be set before the status is written
+		data := Data{
+			SessionId: code,
+			MyUser:    identify(w, r),
+			CSRFToken: csrfToken(w, r),
+		}
+		w.WriteHeader(http.StatusNotFound)
+
+		err := templateNotFound.Execute(w, data)
+		if err != nil {
+			// logger.Error("could not execute template", "template", "not-found", "error", err, "code", code)
+		}
+		return
 	}
+
+	http.Redirect(w, r, "/"+sessionId, http.StatusSeeOther)
+}
+
+// normalizeJoinCode accepts codes in lower case and without dash, e.g. abc123
+func normalizeJoinCode(code string) string {
+	code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if len(code) != 6 {
+		return code
+	}
+	return code[:3] + "-" + code[3:]
 }
 
 func joinSession(w http.ResponseWriter, r *http.Request) {
@@ -310,7 +600,8 @@ func joinSession(w http.ResponseWriter, r *http.Request) {
 	// route := fmt.Sprintf("POST /join-session/%s", sessionId)
 	httpReqs.WithLabelValues("POST /join-session/{sessionId}").Inc()
 
-	if _, ok := sessions[sessionId]; !ok {
+	session, ok := getSessionById(sessionId)
+	if !ok {
 		// logger.Warn("session does not exist", "sessionId", sessionId)
 		w.WriteHeader(http.StatusNotFound)
 
@@ -331,19 +622,74 @@ func joinSession(w http.ResponseWriter, r *http.Request) {
 	}
 
 	form := r.Form
-	userName := form.Get("username")
-	userName = strings.TrimSpace(userName)
+	user := identify(w, r)
 
-	cookieUserName := newUserNameCookie(userName)
-	http.SetCookie(w, cookieUserName)
+	if !session.admits(user) {
+		rejectUser(w, r, session, user)
+		return
+	}
 
-	session := sessions[sessionId]
-	err := templates.ExecuteTemplate(w, "session", Data{
-		Scale:       session.scale,
-		OtherUsers:  session.getOtherUsers(userName),
-		MyUser:      &User{Name: userName, Vote: -1},
-		SessionId:   sessionId,
-		SessionName: session.Name,
+	if session.full(user) {
+		rateLimited.WithLabelValues(limitParticipants).Inc()
+		http.Error(w, "this session is full", http.StatusServiceUnavailable)
+		return
+	}
+
+	access := session.hasAccess(r)
+
+	userName := user.Name
+	if user.Subject == "" {
+		name, err := validateUserName(form.Get("username"))
+		if err != nil {
+			joinSessionError(w, session, user, form.Get("username"), !access, err.Error())
+			return
+		}
+		userName = name
+	}
+
+	role, err := validateRole(form.Get("role"))
+	if err != nil {
+		joinSessionError(w, session, user, userName, !access, err.Error())
+		return
+	}
+
+	if !access {
+		key := clientIP(r) + "|" + session.accessScope()
+
+		joinError := ""
+		if !joinAttempts.allow(key) {
+			// logger.Warn("too many failed attempts to join session", "session", sessionId, "ip", clientIP(r))
+			w.Header().Set("Retry-After", strconv.Itoa(int(config.Protection.FailedAttemptsWindow.Seconds())))
+			joinError = "Too many failed attempts. Please try again later."
+		} else if !session.checkPassphrase(form.Get("passphrase")) {
+			joinAttempts.fail(key)
+			joinError = "Wrong passphrase"
+		}
+
+		if joinError != "" {
+			joinSessionError(w, session, user, userName, true, joinError)
+			return
+		}
+
+		session.grantAccess(w)
+	}
+
+	login(w, user, userName, role)
+
+	err = templates.ExecuteTemplate(w, "session", Data{
+		Banner:       getBanner(),
+		Scale:        session.scale,
+		OtherUsers:   session.getOtherUsers(user.Id),
+		MyUser:       user,
+		Moderator:    session.isModerator(user),
+		Protected:    session.protected(),
+		SessionId:    sessionId,
+		JoinCode:     session.JoinCode,
+		SessionName:  session.Name,
+		Countdown:    session.countdownRemaining(),
+		Backlog:      session.backlog(),
+		IssueTracker: session.issueTrackerSettings("", ""),
+		Async:        session.asyncView(user),
 	})
 	if err != nil {
 		// logger.Error("could not execute template", "template", "session", "session", sessionId, "error", err)
@@ -354,88 +700,91 @@ func joinSession(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// joinSessionError shows message in the join form of session, prefilled
+// with the name the user entered
+func joinSessionError(w http.ResponseWriter, session *Session, user *User, userName string, protected bool, message string) {
+	err := templateJoinSession.ExecuteTemplate(w, "content", Data{
+		MyUser:      &User{Id: user.Id, Name: userName, Subject: user.Subject, Role: user.Role, Vote: noVote},
+		Protected:   protected,
+		Error:       message,
+		SessionId:   session.Id,
+		SessionName: session.Name,
+	})
+	if err != nil {
+		// logger.Error("could not execute template", "template", "join-session", "session", session.Id, "error", err)
+	}
+}
+
 func handleWsConnection(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	sessionId := r.PathValue("id")
-	cookieUserName, err := r.Cookie("username")
-
 	httpReqs.WithLabelValues("GET /ws/{sessionId}").Inc()
 
-	if errors.Is(err, http.ErrNoCookie) {
-		// logger.Error("username-cookie not set. Could not join session")
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("username-cookie not set. Could not join session"))
-		return
-	} else if err != nil {
-		// logger.Error("unexpected error while checking cookie", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Something went wrong."))
+	session, user, ok := admitUser(w, r)
+	if !ok {
 		return
 	}
+	sessionId := session.Id
 
-	user := &User{
-		Name: "",
-		Vote: -1,
-	}
-	un, err := base64.URLEncoding.DecodeString(cookieUserName.Value)
-	if err != nil {
-		// logger.Error("unexpected error while decoding cookie value")
-	}
-	// logger.Info("known user wants to create session", "userName", string(un))
-	user.Name = string(un)
-
-	// route := fmt.Sprintf("GET /ws/%s", sessionId)
-	// logger.Info("incoming request", "route", route)
-
-	if _, ok := sessions[sessionId]; !ok {
-		// logger.Warn("session does not exist", "session", sessionId)
-		w.WriteHeader(http.StatusNotFound)
-
-		err := templateNotFound.Execute(w, Data{
-			SessionId: sessionId,
-		})
-		if err != nil {
-			// logger.Error("could not execute template", "template", "not-found", "route", route, "error", err, "session", sessionId)
-		}
-		return
-	}
-
-	c, err := websocket.Accept(w, r, nil)
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		OriginPatterns: config.Security.AllowedOrigins,
+	})
 	if err != nil {
 		// logger.Error("session could not be joined", "user", user.Name, "session", sessionId, "error", err)
 		return
 	}
 
-	user.Connection = c
-
-	session := sessions[sessionId]
+	maxMessageSize := config.Limits.MaxMessageSize
+	if maxMessageSize > 0 {
+		// readMessage enforces the limit, so that it can be counted
+		c.SetReadLimit(int64(maxMessageSize) + 1)
+	} else {
+		c.SetReadLimit(-1)
+	}
+	messages := rate.NewLimiter(perSecondLimit(config.Limits.MessageRate), config.Limits.MessageBurst)
 
-	session.Lock()
-	session.Users[user.Name] = user
-	session.Unlock()
+	user.Connection = wsConn{c}
+	session.addUser(user)
 
-	defer delete(session.Users, user.Name)
+	wsConnects.Inc()
+	activeUsers.Inc()
+	defer activeUsers.Dec()
 
-	session.broadcast <- Data{
+	session.publish(Data{
+		ctx:       r.Context(),
 		event:     USER_JOINED,
 		MyUser:    user,
 		SessionId: sessionId,
-	}
+	})
+
+	reason := closeReasonError
 
 	for {
-		_, d, err := c.Read(r.Context())
+		d, err := readMessage(r.Context(), c, maxMessageSize)
+
+		if errors.Is(err, errMessageTooBig) {
+			// logger.Warn("websocket message too big. Closing connection", "session", sessionId, "user", user.Name)
+			rateLimited.WithLabelValues(limitMessageSize).Inc()
+			reason = closeReasonTooBig
+			break
+		}
+
+		if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
+			reason = closeReasonNormal
+			break
+		}
 
-		if websocket.CloseStatus(err) == websocket.StatusNormalClosure || websocket.CloseStatus(err) == websocket.StatusGoingAway {
-			session.broadcast <- Data{event: USER_LEFT, MyUser: user}
+		if websocket.CloseStatus(err) == websocket.StatusGoingAway {
+			reason = closeReasonGoingAway
 			break
 		}
 
 		if websocket.CloseStatus(err) == websocket.StatusNoStatusRcvd {
 			// logger.Info("websocket connection closed, possibly by timeout?", "session", sessionId, "user", user.Name)
+			reason = closeReasonNoStatus
 			break
 		}
 
@@ -446,67 +795,178 @@ func handleWsConnection(w http.ResponseWriter, r *http.Request) {
 
 		// logger.Info("message from websocket", "user", user.Name, "message", string(d))
 
+		if !messages.Allow() {
+			// logger.Warn("dropping websocket message, rate limit exceeded", "session", sessionId, "user", user.Name)
+			rateLimited.WithLabelValues(limitMessages).Inc()
+			continue
+		}
+
+		// Every message starts its own trace. Otherwise all votes would end
+		// up in the trace of the connection, which lives for hours.
+		ctx, span := tracer.Start(context.Background(), "websocket.message",
+			trace.WithNewRoot(),
+			trace.WithLinks(trace.LinkFromContext(r.Context())),
+			trace.WithAttributes(sessionAttributes(session)...),
+			trace.WithAttributes(attribute.String("user.id", user.Id)),
+		)
+
 		wsResponse := &HtmxWsResponse{}
 
 		if err = json.Unmarshal(d, wsResponse); err != nil {
 			// logger.Error("could not unmarshal json", "error", err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "could not unmarshal json")
+			span.End()
 			continue
 		}
 
-		data := Data{
-			MyUser: user,
+		data, err := session.messageEvent(ctx, user, *wsResponse)
+		if err != nil {
+			// logger.Error("invalid vote", "vote", wsResponse.Vote, "error", err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "invalid vote")
+			span.End()
+			continue
 		}
 
-		if wsResponse.Vote != "" {
-			vote, err := strconv.Atoi(wsResponse.Vote)
-			if err != nil {
-				// logger.Error("couldn't parse vote to int", "vote", wsResponse.Vote, "error", err)
-			}
+		span.SetAttributes(attribute.Stringer("session.event", data.event))
 
-			session.Lock()
-			session.Users[user.Name].Vote = vote
-			session.Unlock()
+		ok := session.publish(data)
+		span.End()
 
-			data.event = USER_VOTED
-		} else if wsResponse.Headers.HxTrigger == "restart-session" {
-			data.event = RESET
+		if !ok {
+			reason = closeReasonSessionClosed
+			break
 		}
+	}
 
-		session.broadcast <- data
+	session.removeUser(user)
+	if !session.publish(Data{ctx: r.Context(), event: USER_LEFT, MyUser: user}) || session.closed() {
+		reason = closeReasonSessionClosed
 	}
+	wsDisconnects.WithLabelValues(reason).Inc()
 
 	if err = c.Close(websocket.StatusNormalClosure, "Connection closed"); err != nil {
 		// logger.Error("could not close websocket connection", "user", user.Name, "session", sessionId)
 	}
 }
 
+// serve runs listen and exits the process if the server stops for any
+// other reason than a shutdown.
+func serve(listen func() error) {
+	if err := listen(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		// logger.Error("server exited unexpectedly", "error", err)
+		os.Exit(1)
+	}
+}
+
 //go:embed third_party/*
 var scripts embed.FS
 
+//go:embed web/static/*
+var static embed.FS
+
 func main() {
-	http.HandleFunc("/", index)
-	http.HandleFunc("/favicon.ico", getFavicon)
-	http.HandleFunc("/robots.txt", getRobotsTxt)
-	http.HandleFunc("/create-session", newSession)
-	http.HandleFunc("/{id}", getSession)
-	http.HandleFunc("/join-session/{id}", joinSession)
-	http.HandleFunc("/ws/{id}", handleWsConnection)
+	config = loadConfig()
+
+	if err := config.SessionIds.validate(); err != nil {
+		// logger.Error("invalid session id configuration", "error", err)
+		os.Exit(1)
+	}
+
+	if err := config.Security.validate(); err != nil {
+		// logger.Error("invalid security configuration", "error", err)
+		os.Exit(1)
+	}
+
+	if len(config.Secrets) > 0 {
+		signingKeys = nil
+		for _, secret := range config.Secrets {
+			signingKeys = append(signingKeys, []byte(secret))
+		}
+	}
+	joinAttempts = newAttemptLimiter(config.Protection.MaxFailedAttempts, config.Protection.FailedAttemptsWindow)
+	createLimiter = newKeyedLimiter(config.Limits.CreateRate, config.Limits.CreateBurst)
+	joinLimiter = newKeyedLimiter(config.Limits.JoinRate, config.Limits.JoinBurst)
+	connectLimiter = newKeyedLimiter(config.Limits.ConnectRate, config.Limits.ConnectBurst)
+	weights, err := parseRoleWeights(config.RoleWeights)
+	if err != nil {
+		// logger.Error("invalid role weights", "error", err)
+		os.Exit(1)
+	}
+	roleWeights = weights
+
+	list, err := parseNotifiers(config.Notify.Notifiers)
+	if err != nil {
+		// logger.Error("invalid notifier configuration", "error", err)
+		os.Exit(1)
+	}
+	notifiers = list
+	if err := loadScales(config.ScalesFile); err != nil {
+		// logger.Error("could not load scales", "file", config.ScalesFile, "error", err)
+		os.Exit(1)
+	}
+	if _, ok := scales.Get(config.Slack.Scale); config.Slack.SigningSecret != "" && !ok {
+		// logger.Error("unknown slack scale", "scale", config.Slack.Scale)
+		os.Exit(1)
+	}
+	if err := loadNotifyTemplate(config.Notify.TemplateFile); err != nil {
+		// logger.Error("could not load notification template", "file", config.Notify.TemplateFile, "error", err)
+		os.Exit(1)
+	}
+
+	if config.DataDir != "" {
+		store, err := newFileRoomStore(config.DataDir)
+		if err != nil {
+			// logger.Error("could not open room store", "dir", config.DataDir, "error", err)
+			os.Exit(1)
+		}
+		rooms = store
+	}
+
+	if config.OIDC.Issuer != "" {
+		client, err := newOIDCClient(context.Background(), config.OIDC)
+		if err != nil {
+			// logger.Error("could not set up OIDC login", "issuer", config.OIDC.Issuer, "error", err)
+			os.Exit(1)
+		}
+		oidcLogin = client
+	}
 
-	http.Handle("/scripts/", http.StripPrefix("/scripts/", http.FileServerFS(scripts)))
+	if config.Jira.URL != "" {
+		jira = newJiraClient(config.Jira, &http.Client{Timeout: integrationTimeout})
+		if len(config.Jira.Groups) == 0 && len(config.Jira.Projects) == 0 && len(config.Jira.Boards) == 0 {
+			// logger.Warn("the jira import is disabled until POKER_JIRA_GROUPS, POKER_JIRA_PROJECTS or POKER_JIRA_BOARDS is set")
+		}
+		acceptHooks = append(acceptHooks, writeBackJira)
+	}
+	acceptHooks = append(acceptHooks, writeBackIssue)
+	webhooks = newWebhookDispatcher(config.Webhooks, &http.Client{Timeout: config.Webhooks.Timeout})
+	roundHooks = append(roundHooks, emitRevealed, postNotifications)
+	if config.Slack.SigningSecret != "" {
+		roundHooks = append(roundHooks, postSlackResult)
+	}
 
-	reg := prometheus.NewRegistry()
+	shutdownTracing, err := setupTracing(context.Background(), config.Tracing)
+	if err != nil {
+		// logger.Error("could not set up tracing", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
 
-	reg.MustRegister(
-		collectors.NewGoCollector(),
-		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	mux, err := newMux()
+	if err != nil {
+		// logger.Error("could not open static files", "error", err)
+		os.Exit(1)
+	}
 
-		httpReqs,
-		activeSessions,
-		activeUsers,
-		totalEstimations,
-	)
+	handler := secureHeaders(config.Security, mux)
 
-	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	reg := newRegistry()
+
+	admin := &http.Server{Addr: config.Admin.Addr, Handler: newAdminMux(config.Admin, reg)}
+	go serve(admin.ListenAndServe)
+	servers := []*http.Server{admin}
 
 	certDir := "/etc/letsencrypt/live/pointing-poker.duckdns.org"
 	cert := path.Join(certDir, "fullchain.pem")
@@ -516,18 +976,84 @@ func main() {
 
 	if _, err := os.Stat(certDir); err == nil {
 		// certificate found
-		go http.ListenAndServeTLS("0.0.0.0:443", cert, key, nil)
+		https := &http.Server{Addr: "0.0.0.0:443", Handler: handler}
+		go serve(func() error { return https.ListenAndServeTLS(cert, key) })
 
-		if err = http.ListenAndServe("0.0.0.0:80", nil); err != nil {
-			// logger.Error("server exited unexpectedly", "error", err)
-		}
+		plain := &http.Server{Addr: "0.0.0.0:80", Handler: handler}
+		go serve(plain.ListenAndServe)
 
+		servers = append(servers, https, plain)
 	} else if errors.Is(err, os.ErrNotExist) {
-		if err = http.ListenAndServe(":8000", nil); err != nil {
-			// logger.Error("server exited unexpectedly", "error", err)
-		}
+		server := &http.Server{Addr: ":8000", Handler: handler}
+		go serve(server.ListenAndServe)
+
+		servers = append(servers, server)
 	} else {
 		// logger.Error("unexpected error", "error", err)
+		os.Exit(1)
+	}
+
+	ready.Store(true)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	// logger.Info("shutting down")
+	ready.Store(false)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			// logger.Error("could not shut down server", "addr", server.Addr, "error", err)
+		}
+	}
+}
+
+// newMux returns the routes of the public server
+func newMux() (*http.ServeMux, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", traced("GET /", index))
+	mux.HandleFunc("/favicon.ico", getFavicon)
+	mux.HandleFunc("/robots.txt", getRobotsTxt)
+	mux.HandleFunc("/healthz", getHealthz)
+	mux.HandleFunc("/readyz", getReadyz)
+	mux.HandleFunc("/create-session", traced("POST /create-session", rateLimit(createLimiter, limitCreate, requireCSRF(newSession))))
+	mux.HandleFunc("/{id}", traced("GET /{sessionId}", getSession))
+	mux.HandleFunc("GET /r/{slug}", traced("GET /r/{slug}", getRoom))
+	mux.HandleFunc("GET /join", traced("GET /join", getJoinCode))
+	mux.HandleFunc("POST /invite/{id}", traced("POST /invite/{sessionId}", requireCSRF(postInvite)))
+	mux.HandleFunc("GET /join/{code}", traced("GET /join/{code}", getJoinCode))
+	mux.HandleFunc("/join-session/{id}", traced("POST /join-session/{sessionId}", rateLimit(joinLimiter, limitJoin, requireCSRF(joinSession))))
+	mux.HandleFunc("/ws/{id}", traced("GET /ws/{sessionId}", rateLimit(connectLimiter, limitConnect, handleWsConnection)))
+	mux.HandleFunc("GET /sse/{id}", traced("GET /sse/{sessionId}", rateLimit(connectLimiter, limitConnect, handleSSEConnection)))
+	mux.HandleFunc("POST /sse/{id}/vote", traced("POST /sse/{sessionId}/vote", requireCSRF(postSSEVote)))
+	mux.HandleFunc("POST /sse/{id}/reset", traced("POST /sse/{sessionId}/reset", requireCSRF(postSSEReset)))
+	mux.HandleFunc("POST /sse/{id}/trigger", traced("POST /sse/{sessionId}/trigger", requireCSRF(postSSETrigger)))
+	mux.HandleFunc("POST /stories/{id}/jira", traced("POST /stories/{sessionId}/jira", requireCSRF(postJiraImport)))
+	mux.HandleFunc("POST /stories/{id}/issues", traced("POST /stories/{sessionId}/issues", requireCSRF(postIssueImport)))
+	mux.HandleFunc("POST /stories/{id}/csv/preview", traced("POST /stories/{sessionId}/csv/preview", requireCSRF(postCSVPreview)))
+	mux.HandleFunc("POST /stories/{id}/csv", traced("POST /stories/{sessionId}/csv", requireCSRF(postCSVImport)))
+	mux.HandleFunc("POST /async/{id}/vote", traced("POST /async/{sessionId}/vote", requireCSRF(postAsyncVote)))
+	mux.HandleFunc("POST /async/{id}/discussed", traced("POST /async/{sessionId}/discussed", requireCSRF(postAsyncDiscussed)))
+	mux.HandleFunc("POST /async/{id}/accept", traced("POST /async/{sessionId}/accept", requireCSRF(postAsyncAccept)))
+	mux.HandleFunc("GET /stories/{id}/csv", traced("GET /stories/{sessionId}/csv", getStoriesCSV))
+	if config.Slack.SigningSecret != "" {
+		mux.HandleFunc("POST /slack/commands", traced("POST /slack/commands", postSlackCommand))
+		mux.HandleFunc("POST /slack/interactions", traced("POST /slack/interactions", postSlackInteraction))
 	}
+	mux.HandleFunc("GET /auth/login", traced("GET /auth/login", getLogin))
+	mux.HandleFunc("GET /auth/callback", traced("GET /auth/callback", getCallback))
+	mux.HandleFunc("GET /auth/logout", traced("GET /auth/logout", getLogout))
+
+	mux.Handle("/scripts/", http.StripPrefix("/scripts/", http.FileServerFS(scripts)))
+	staticFiles, err := fs.Sub(static, "web/static")
+	if err != nil {
+		return nil, err
+	}
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServerFS(staticFiles)))
+
+	return mux, nil
 }
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"nhooyr.io/websocket"
+)
+
+// newTestServer serves the public routes with the default configuration
+// and without rate limits. configure changes the configuration, including
+// the limits, before the routes are set up.
+func newTestServer(t *testing.T, configure ...func(*Config)) *httptest.Server {
+	t.Helper()
+
+	config = loadConfig()
+	config.Limits = LimitsConfig{MaxMessageSize: 4096}
+	for _, f := range configure {
+		f(&config)
+	}
+	joinAttempts = newAttemptLimiter(config.Protection.MaxFailedAttempts, config.Protection.FailedAttemptsWindow)
+	createLimiter = newKeyedLimiter(config.Limits.CreateRate, config.Limits.CreateBurst)
+	joinLimiter = newKeyedLimiter(config.Limits.JoinRate, config.Limits.JoinBurst)
+	connectLimiter = newKeyedLimiter(config.Limits.ConnectRate, config.Limits.ConnectBurst)
+
+	mux, err := newMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(secureHeaders(config.Security, mux))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// startTestSession starts a session with the fibonacci scale that is
+// closed at the end of the test
+func startTestSession(t *testing.T, moderator string) *Session {
+	t.Helper()
+
+	scale, _ := scales.Get("fibonacci")
+	session := newSessionState("Test", moderator, scale, config.Expiry)
+	if err := startSession(session); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.publish(Data{event: CLOSED}) })
+	return session
+}
+
+// identityCookie returns a signed identity cookie for the participant
+func identityCookie(id string, name string) *http.Cookie {
+	payload, _ := json.Marshal(Identity{Id: id, Name: name, IssuedAt: time.Now().Unix()})
+	return &http.Cookie{Name: identityCookieName, Value: sign(string(payload))}
+}
+
+// withCSRF adds a valid CSRF cookie and token to r
+func withCSRF(r *http.Request) *http.Request {
+	nonce := strings.Repeat("n", 32)
+	r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: nonce})
+	r.Header.Set(csrfHeader, sign(csrfPayload(nonce)))
+	return r
+}
+
+// postForm sends form to url with the cookies and a valid CSRF token
+func postForm(t *testing.T, u string, form url.Values, cookies ...*http.Cookie) *http.Response {
+	t.Helper()
+
+	r, err := http.NewRequest(http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	resp, err := http.DefaultClient.Do(withCSRF(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// receive waits for a message that contains want
+func receive(t *testing.T, messages <-chan string, want string) string {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				t.Fatalf("connection closed while waiting for %q", want)
+			}
+			if strings.Contains(msg, want) {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("no message containing %q", want)
+		}
+	}
+}
+
+func dialWebsocket(t *testing.T, server *httptest.Server, session *Session, cookie *http.Cookie) (*websocket.Conn, <-chan string) {
+	t.Helper()
+
+	header := http.Header{}
+	header.Add("Cookie", cookie.String())
+	c, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+"/ws/"+session.Id, &websocket.DialOptions{HTTPHeader: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.CloseNow() })
+
+	messages := make(chan string, 16)
+	go func() {
+		defer close(messages)
+		for {
+			_, msg, err := c.Read(context.Background())
+			if err != nil {
+				return
+			}
+			messages <- string(msg)
+		}
+	}()
+	return c, messages
+}
+
+func openEventStream(t *testing.T, server *httptest.Server, session *Session, cookie *http.Cookie) <-chan string {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/sse/"+session.Id, nil)
+	r.AddCookie(cookie)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("event stream responded with %d", resp.StatusCode)
+	}
+
+	// every event is passed on as the joined data lines
+	messages := make(chan string, 16)
+	go func() {
+		defer close(messages)
+		defer resp.Body.Close()
+
+		var event []string
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 1<<20), 1<<20)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				event = append(event, data)
+			} else if line == "" && event != nil {
+				messages <- strings.Join(event, "\n")
+				event = nil
+			}
+		}
+	}()
+	return messages
+}
+
+func TestVotingOverWebsocketAndEventStream(t *testing.T) {
+	server := newTestServer(t)
+	session := startTestSession(t, "alice-id")
+
+	connects := testutil.ToFloat64(wsConnects)
+	streams := testutil.ToFloat64(sseConnects)
+	votes := testutil.ToFloat64(sessionEvents.WithLabelValues(USER_VOTED.String()))
+
+	alice := identityCookie("alice-id", "Alice")
+	ws, aliceMessages := dialWebsocket(t, server, session, alice)
+
+	bob := identityCookie("bob-id", "Bob")
+	bobMessages := openEventStream(t, server, session, bob)
+
+	// Alice is told that Bob joined
+	receive(t, aliceMessages, "Bob")
+
+	err := ws.Write(context.Background(), websocket.MessageText, []byte(`{"vote":"5","HEADERS":{"HX-Trigger":"vote"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, bobMessages, "Voted")
+
+	resp := postForm(t, server.URL+"/sse/"+session.Id+"/vote", url.Values{"vote": {"8"}}, bob)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("vote responded with %d", resp.StatusCode)
+	}
+
+	// both see the result
+	receive(t, aliceMessages, "Recommendation")
+	receive(t, bobMessages, "Recommendation")
+
+	if got := testutil.ToFloat64(wsConnects) - connects; got != 1 {
+		t.Errorf("websocket connects = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(sseConnects) - streams; got != 1 {
+		t.Errorf("event stream connects = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(sessionEvents.WithLabelValues(USER_VOTED.String())) - votes; got != 2 {
+		t.Errorf("vote events = %v, want 2", got)
+	}
+}
+
+func TestEventStreamRequiresIdentity(t *testing.T) {
+	server := newTestServer(t)
+	session := startTestSession(t, "alice-id")
+
+	resp, err := http.Get(server.URL + "/sse/" + session.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	resp = postForm(t, server.URL+"/sse/"+session.Id+"/vote", url.Values{"vote": {"8"}}, identityCookie("bob-id", "Bob"))
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("vote without stream responded with %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+}
+
+func TestActiveUsersAfterCloseWithoutStatus(t *testing.T) {
+	server := newTestServer(t)
+	session := startTestSession(t, "alice-id")
+
+	users := testutil.ToFloat64(activeUsers)
+	disconnects := testutil.ToFloat64(wsDisconnects.WithLabelValues(closeReasonNoStatus))
+
+	ws, _ := dialWebsocket(t, server, session, identityCookie("alice-id", "Alice"))
+	waitFor(t, "the connected user", func() bool { return testutil.ToFloat64(activeUsers) == users+1 })
+
+	ws.Close(websocket.StatusNoStatusRcvd, "")
+	waitFor(t, "the disconnect", func() bool {
+		return testutil.ToFloat64(wsDisconnects.WithLabelValues(closeReasonNoStatus)) > disconnects
+	})
+	waitFor(t, "the active users", func() bool { return testutil.ToFloat64(activeUsers) == users })
+}
+
+// isolateSessions replaces the active sessions with an empty registry
+// until the end of the test
+func isolateSessions(t *testing.T) {
+	lockSessions.Lock()
+	active, codes := sessions, joinCodes
+	sessions, joinCodes = make(map[string]*Session), make(map[string]string)
+	lockSessions.Unlock()
+
+	t.Cleanup(func() {
+		lockSessions.Lock()
+		sessions, joinCodes = active, codes
+		lockSessions.Unlock()
+	})
+}
+
+func TestRegisterSession(t *testing.T) {
+	config = loadConfig()
+	isolateSessions(t)
+
+	register := func() (*Session, error) {
+		session := &Session{}
+		lockSessions.Lock()
+		defer lockSessions.Unlock()
+		return session, registerSession(session)
+	}
+
+	seen := make(map[string]bool)
+	for range 100 {
+		session, err := register()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(session.Id) != config.SessionIds.Length || strings.Trim(session.Id, letters) != "" {
+			t.Errorf("id %q doesn't match the configuration", session.Id)
+		}
+		if seen[session.Id] || seen[session.JoinCode] {
+			t.Errorf("id %q or join code %q was assigned twice", session.Id, session.JoinCode)
+		}
+		seen[session.Id] = true
+		seen[session.JoinCode] = true
+	}
+}
+
+func TestRegisterSessionCollisions(t *testing.T) {
+	config = loadConfig()
+	config.SessionIds = SessionIdConfig{Length: 1, Alphabet: "ab"}
+	config.Limits.MaxSessions = 2
+	isolateSessions(t)
+
+	// with two possible ids, the second session has to retry until it gets
+	// the one that is left
+	var ids []string
+	for range 2 {
+		session := &Session{}
+		lockSessions.Lock()
+		err := registerSession(session)
+		lockSessions.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, session.Id)
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("ids = %v", ids)
+	}
+	for _, id := range ids {
+		if _, ok := getSessionById(id); !ok {
+			t.Errorf("session %s was not registered", id)
+		}
+	}
+
+	lockSessions.Lock()
+	err := registerSession(&Session{})
+	lockSessions.Unlock()
+	if err != ErrTooManySessions {
+		t.Errorf("registration above the maximum returned %v", err)
+	}
+}
+
+func TestJoinCodeLookup(t *testing.T) {
+	server := newTestServer(t)
+	session := startTestSession(t, "alice-id")
+	code := session.JoinCode
+
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{"code", "/join/" + code, http.StatusSeeOther},
+		{"lower case without dash", "/join/" + strings.ToLower(strings.ReplaceAll(code, "-", "")), http.StatusSeeOther},
+		{"form", "/join?code=" + url.QueryEscape(" "+strings.ToLower(code)+" "), http.StatusSeeOther},
+		{"unknown", "/join/XXX-000", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := get(t, server.URL+tt.path)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("lookup responded with %d, want %d", resp.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusSeeOther && resp.Header.Get("Location") != "/"+session.Id {
+				t.Errorf("redirected to %s", resp.Header.Get("Location"))
+			}
+		})
+	}
+}
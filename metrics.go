@@ -0,0 +1,179 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+var httpReqs = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "How many HTTP requests processed, partitioned by endpoint path",
+	},
+	[]string{"path"},
+)
+
+var activeSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "sessions_active",
+	Help: "How many sessions are currently active",
+})
+
+var activeUsers = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "users_active",
+	Help: "How many users are currently active",
+})
+
+var totalEstimations = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "estimations_total",
+	Help: "How many estimations have been processed",
+})
+
+var sessionEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "session_events_total",
+		Help: "How many session events have been handled, partitioned by event type",
+	},
+	[]string{"event"},
+)
+
+var broadcastDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "broadcast_duration_seconds",
+		Help:    "Time from publishing an event until it was written to all recipients, partitioned by event type",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14), // 0.5ms .. ~4s
+	},
+	[]string{"event"},
+)
+
+var clientWriteDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "client_write_duration_seconds",
+	Help:    "Time it took to write a single message to a client",
+	Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16), // 0.1ms .. ~3s
+})
+
+var wsConnects = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "websocket_connects_total",
+	Help: "How many websocket connections have been accepted",
+})
+
+var wsDisconnects = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "websocket_disconnects_total",
+		Help: "How many websocket connections have been closed, partitioned by close reason",
+	},
+	[]string{"reason"},
+)
+
+var sessionLifetime = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "session_lifetime_seconds",
+	Help:    "How long sessions lived before they were closed",
+	Buckets: []float64{60, 300, 600, 1800, 3600, 2 * 3600, 4 * 3600, 8 * 3600, 24 * 3600},
+})
+
+var sessionParticipants = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "session_participants",
+	Help:    "Peak number of participants per session",
+	Buckets: []float64{1, 2, 3, 4, 5, 6, 8, 10, 12, 15, 20, 30, 50},
+})
+
+var voteSpread = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "vote_spread",
+	Help:    "Difference between the highest and the lowest vote per round",
+	Buckets: []float64{0, 1, 2, 3, 5, 8, 13, 21, 34, 55, 89, 144},
+})
+
+var rateLimited = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rate_limited_total",
+		Help: "How many requests and messages have been rejected by a limit, partitioned by limit",
+	},
+	[]string{"limit"},
+)
+
+var writeBacks = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "estimate_write_backs_total",
+		Help: "How many estimates have been written back to issue trackers, partitioned by tracker and result",
+	},
+	[]string{"tracker", "result"},
+)
+
+var webhookDeliveries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "webhook_deliveries_total",
+		Help: "How many webhook deliveries have been attempted, partitioned by event and result",
+	},
+	[]string{"event", "result"},
+)
+
+var notifications = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "notifications_total",
+		Help: "How many results have been posted to notifiers, partitioned by format and result",
+	},
+	[]string{"format", "result"},
+)
+
+var sseConnects = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "sse_connects_total",
+	Help: "How many event streams have been opened by clients that can't use websockets",
+})
+
+var sseDisconnects = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "sse_disconnects_total",
+		Help: "How many event streams have been closed, partitioned by reason",
+	},
+	[]string{"reason"},
+)
+
+// Close reasons used as label values for wsDisconnects
+const (
+	closeReasonNormal        = "normal"
+	closeReasonGoingAway     = "going_away"
+	closeReasonNoStatus      = "no_status"
+	closeReasonError         = "error"
+	closeReasonSessionClosed = "session_closed"
+	closeReasonTooBig        = "message_too_big"
+)
+
+// Limits used as label values for rateLimited
+const (
+	limitCreate       = "create"
+	limitJoin         = "join"
+	limitConnect      = "connect"
+	limitMessages     = "messages"
+	limitSessions     = "sessions"
+	limitParticipants = "participants"
+	limitMessageSize  = "message_size"
+)
+
+func newRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+
+		httpReqs,
+		activeSessions,
+		activeUsers,
+		totalEstimations,
+		sessionEvents,
+		broadcastDuration,
+		clientWriteDuration,
+		wsConnects,
+		wsDisconnects,
+		sessionLifetime,
+		sessionParticipants,
+		voteSpread,
+		rateLimited,
+		writeBacks,
+		webhookDeliveries,
+		notifications,
+		sseConnects,
+		sseDisconnects,
+	)
+
+	return reg
+}
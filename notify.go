@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// When a round is completed, its result can be posted to team channels via
+// incoming webhooks of Mattermost or Microsoft Teams, or as plain JSON to
+// any other URL. Notifiers are configured globally and per room. The
+// message is rendered from a text/template that can be replaced.
+
+// NotifierFormat is the payload format a notifier sends
+type NotifierFormat string
+
+const (
+	// notifierMattermost sends {"text": message}, which Slack understands
+	// as well
+	notifierMattermost NotifierFormat = "mattermost"
+	// notifierTeams sends an Adaptive Card, as expected by the workflows
+	// of Microsoft Teams
+	notifierTeams NotifierFormat = "teams"
+	// notifierGeneric sends the message together with the raw result
+	notifierGeneric NotifierFormat = "generic"
+)
+
+var notifierFormats = []NotifierFormat{notifierMattermost, notifierTeams, notifierGeneric}
+
+// maxNotifyTemplateLength limits the templates of rooms
+const maxNotifyTemplateLength = 4000
+
+const defaultNotifyTemplate = `{{ if .Story }}**{{ .Story.Key }}{{ with .Story.Title }} {{ . }}{{ end }}** in {{ .Session }}{{ else }}**{{ .Session }}**{{ end }}
+{{ range .Votes }}
+- {{ .Name }}: {{ .Vote }}{{ end }}{{ range .Abstained }}
+- {{ . }}: ?{{ end }}
+
+{{ if .Votes }}Average {{ printf "%.1f" .Average }} · Median {{ printf "%.1f" .Median }} · Recommendation **{{ .Recommendation }}**{{ else }}Nobody voted{{ end }}
+{{- if eq .Consensus "unanimous" }}
+Consensus!{{ else if eq .Consensus "near" }}
+Almost a consensus, all votes are within one card.{{ end }}`
+
+// Notifier posts results to a URL
+type Notifier struct {
+	Format NotifierFormat `json:"format"`
+	URL    string         `json:"url"`
+	// Template replaces the global template if it is not empty
+	Template string `json:"template,omitempty"`
+}
+
+// NotificationVote is the vote of one user
+type NotificationVote struct {
+	Name string
+	Vote int
+}
+
+// Notification is passed to the template
+type Notification struct {
+	Session string
+	Room    string
+	Story   *Story
+	// Votes are sorted by name
+	Votes          []NotificationVote
+	Abstained      []string
+	Average        float64
+	Median         float64
+	Recommendation int
+	Strategy       string
+	Consensus      Consensus
+	Round          Round
+}
+
+// notifiers and notifyTemplate are set up on startup
+var notifiers []Notifier
+var notifyTemplate = template.Must(parseNotifyTemplate(defaultNotifyTemplate))
+
+var notifyClient httpDoer = &http.Client{Timeout: integrationTimeout}
+
+// parseNotifyTemplate parses text and renders it once with an example, so
+// that unknown fields are reported right away
+func parseNotifyTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("notification").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	example := Notification{
+		Session: "Example",
+		Story:   &Story{Key: "EX-1", Title: "Example"},
+		Votes:   []NotificationVote{{Name: "alice", Vote: 3}},
+	}
+	if err := tmpl.Execute(io.Discard, example); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// loadNotifyTemplate reads the global template from path. The default
+// template is kept if path is empty.
+func loadNotifyTemplate(path string) error {
+	if path == "" {
+		return nil
+	}
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tmpl, err := parseNotifyTemplate(string(text))
+	if err != nil {
+		return err
+	}
+	notifyTemplate = tmpl
+	return nil
+}
+
+// parseNotifiers parses entries of the form format=url
+func parseNotifiers(entries []string) ([]Notifier, error) {
+	var list []Notifier
+	for _, entry := range entries {
+		format, u, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid notifier %q, expected format=url", entry)
+		}
+		notifier, err := validateNotifier(Notifier{Format: NotifierFormat(strings.TrimSpace(format)), URL: strings.TrimSpace(u)})
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, notifier)
+	}
+	return list, nil
+}
+
+func validateNotifier(notifier Notifier) (Notifier, error) {
+	if !slices.Contains(notifierFormats, notifier.Format) {
+		return notifier, invalid("format", "%q is not a notifier format", notifier.Format)
+	}
+	u, err := url.Parse(notifier.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return notifier, invalid("url", "%q is not a valid notifier URL", notifier.URL)
+	}
+	if len(notifier.Template) > maxNotifyTemplateLength {
+		return notifier, invalid("template", "Templates must not be longer than %d characters", maxNotifyTemplateLength)
+	}
+	if notifier.Template != "" {
+		if _, err := parseNotifyTemplate(notifier.Template); err != nil {
+			return notifier, invalid("template", "Invalid template: %s", err)
+		}
+	}
+	return notifier, nil
+}
+
+func (s *Session) notification(story *Story, round Round) Notification {
+	n := Notification{
+		Session:        s.Name,
+		Story:          story,
+		Average:        round.Average,
+		Median:         round.Median,
+		Recommendation: round.Recommendation,
+		Strategy:       round.Strategy,
+		Consensus:      round.Consensus,
+		Round:          round,
+	}
+	if s.room != nil {
+		n.Room = s.room.Slug
+	}
+	for _, voter := range round.voters() {
+		n.Votes = append(n.Votes, NotificationVote{Name: voter.Name, Vote: round.Votes[voter.Id].Vote})
+	}
+	for _, voter := range round.Abstained {
+		n.Abstained = append(n.Abstained, voter.Name)
+	}
+	return n
+}
+
+func (n Notification) render(notifier Notifier) (string, error) {
+	tmpl := notifyTemplate
+	if notifier.Template != "" {
+		var err error
+		if tmpl, err = parseNotifyTemplate(notifier.Template); err != nil {
+			return "", err
+		}
+	}
+
+	var message strings.Builder
+	if err := tmpl.Execute(&message, n); err != nil {
+		return "", err
+	}
+	return message.String(), nil
+}
+
+func (n Notification) payload(format NotifierFormat, message string) any {
+	switch format {
+	case notifierTeams:
+		return map[string]any{
+			"type": "message",
+			"attachments": []any{map[string]any{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content": map[string]any{
+					"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+					"type":    "AdaptiveCard",
+					"version": "1.4",
+					"body": []any{map[string]any{
+						"type": "TextBlock",
+						"text": message,
+						"wrap": true,
+					}},
+				},
+			}},
+		}
+	case notifierGeneric:
+		return map[string]any{
+			"text":    message,
+			"session": n.Session,
+			"room":    n.Room,
+			"story":   n.Story,
+			"round":   n.Round,
+		}
+	default:
+		return map[string]any{"text": message}
+	}
+}
+
+func (n Notification) post(ctx context.Context, notifier Notifier) error {
+	message, err := n.render(notifier)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(n.payload(notifier.Format, message))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, notifier.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with status %d", notifier.Format, resp.StatusCode)
+	}
+	return nil
+}
+
+// notifiersOf returns the global notifiers and the notifiers of the room of
+// session
+func (s *Session) notifiersOf() []Notifier {
+	list := slices.Clone(notifiers)
+	if s.room != nil {
+		s.room.Lock()
+		list = append(list, s.room.Settings.Notifiers...)
+		s.room.Unlock()
+	}
+	return list
+}
+
+// postNotifications is a round hook that posts the result to all notifiers
+func postNotifications(ctx context.Context, session *Session, story *Story, round Round) {
+	n := session.notification(story, round)
+	for _, notifier := range session.notifiersOf() {
+		if err := n.post(ctx, notifier); err != nil {
+			// logger.Error("could not post notification", "session", session.Id, "format", notifier.Format, "error", err)
+			notifications.WithLabelValues(string(notifier.Format), "error").Inc()
+			continue
+		}
+		notifications.WithLabelValues(string(notifier.Format), "ok").Inc()
+	}
+}
+
+func adminGetRoomNotifiers(w http.ResponseWriter, r *http.Request) {
+	room, err := rooms.Get(r.PathValue("slug"))
+	if err != nil {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+
+	room.Lock()
+	list := append([]Notifier{}, room.Settings.Notifiers...)
+	room.Unlock()
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// adminPutRoomNotifiers replaces the notifiers of a room
+func adminPutRoomNotifiers(w http.ResponseWriter, r *http.Request) {
+	room, err := rooms.Get(r.PathValue("slug"))
+	if err != nil {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+
+	var list []Notifier
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	for i, notifier := range list {
+		if list[i], err = validateNotifier(notifier); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	room.Lock()
+	room.Settings.Notifiers = list
+	room.Unlock()
+
+	if err := rooms.Save(room); err != nil {
+		// logger.Error("could not save room", "room", room.Slug, "error", err)
+		http.Error(w, "could not save room", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
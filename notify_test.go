@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotificationsOncePerRound(t *testing.T) {
+	var lock sync.Mutex
+	posts := make(map[string][]string)
+	channel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message struct {
+			Text string `json:"text"`
+		}
+		json.NewDecoder(r.Body).Decode(&message)
+
+		lock.Lock()
+		posts[r.URL.Path] = append(posts[r.URL.Path], message.Text)
+		lock.Unlock()
+	}))
+	t.Cleanup(channel.Close)
+	received := func(path string) []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, posts[path]...)
+	}
+
+	notifiers = []Notifier{
+		{Format: notifierMattermost, URL: channel.URL + "/mattermost"},
+		{Format: notifierTeams, URL: channel.URL + "/teams"},
+	}
+	roundHooks = []RoundHook{postNotifications}
+	t.Cleanup(func() {
+		notifiers = nil
+		roundHooks = nil
+	})
+
+	config = loadConfig()
+	session := startTestSession(t, "alice-id")
+	alice := &User{Id: "alice-id", Name: "Alice", Vote: noVote}
+	bob := &User{Id: "bob-id", Name: "Bob", Vote: noVote}
+	session.addUser(alice)
+	session.addUser(bob)
+
+	playRound(t, session, alice, bob, "5", "8")
+	revealAgain(t, session, alice, bob)
+
+	trigger(session, alice, "revote")
+	waitFor(t, "the new round", func() bool { return !session.isRevealed() })
+	playRound(t, session, alice, bob, "8", "8")
+	revealAgain(t, session, alice, bob)
+
+	waitFor(t, "the notifications", func() bool {
+		return len(received("/mattermost")) >= 2 && len(received("/teams")) >= 2
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	for _, path := range []string{"/mattermost", "/teams"} {
+		if got := received(path); len(got) != 2 {
+			t.Errorf("%s got %d posts, want one per round", path, len(got))
+		}
+	}
+
+	// the hooks of both rounds run concurrently
+	texts := strings.Join(received("/mattermost"), "\n")
+	if !strings.Contains(texts, "- Alice: 5\n- Bob: 8") || !strings.Contains(texts, "Consensus!") {
+		t.Errorf("posts = %q", texts)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Sessions can be protected by a passphrase. Users that entered the
+// passphrase or opened a signed invite link get an access cookie for the
+// session, which is checked by every handler of the session.
+
+type Grant string
+
+const (
+	grantAccess Grant = "access"
+	grantInvite Grant = "invite"
+)
+
+func hashPassphrase(passphrase string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(passphrase), bcrypt.DefaultCost)
+}
+
+func (s *Session) protected() bool {
+	return len(s.passphraseHash) > 0
+}
+
+func (s *Session) checkPassphrase(passphrase string) bool {
+	return bcrypt.CompareHashAndPassword(s.passphraseHash, []byte(passphrase)) == nil
+}
+
+// accessScope identifies what an access cookie or invite is valid for.
+// Rooms get a new session id every time they are reactivated, so access is
+// granted to the room instead.
+func (s *Session) accessScope() string {
+	if s.room != nil {
+		return "room." + s.room.Slug
+	}
+	return "session." + s.Id
+}
+
+func (s *Session) accessCookieName() string {
+	return "access." + s.accessScope()
+}
+
+// newGrantToken returns a signed token for kind that is valid for scope until expiry
+func newGrantToken(kind Grant, scope string, expiry time.Time) string {
+	return sign(string(kind) + "|" + scope + "|" + strconv.FormatInt(expiry.Unix(), 10))
+}
+
+// verifyGrantToken checks that token was created by newGrantToken for kind
+// and scope and has not expired yet.
+func verifyGrantToken(token string, kind Grant, scope string) bool {
+	payload, _, ok := verify(token)
+	if !ok {
+		return false
+	}
+
+	parts := strings.Split(payload, "|")
+	if len(parts) != 3 || parts[0] != string(kind) || parts[1] != scope {
+		return false
+	}
+
+	expiry, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().Before(time.Unix(expiry, 0))
+}
+
+// hasAccess reports whether the request may enter session
+func (s *Session) hasAccess(r *http.Request) bool {
+	if !s.protected() {
+		return true
+	}
+
+	cookie, err := r.Cookie(s.accessCookieName())
+	if err != nil {
+		return false
+	}
+	return verifyGrantToken(cookie.Value, grantAccess, s.accessScope())
+}
+
+// grantAccess sets the access cookie for session
+func (s *Session) grantAccess(w http.ResponseWriter) {
+	if !s.protected() {
+		return
+	}
+
+	ttl := config.Protection.AccessTTL
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.accessCookieName(),
+		Value:    newGrantToken(grantAccess, s.accessScope(), time.Now().Add(ttl)),
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func (s *Session) newInviteToken() (string, time.Time) {
+	expiry := time.Now().Add(config.Protection.InviteTTL)
+	return newGrantToken(grantInvite, s.accessScope(), expiry), expiry
+}
+
+func (s *Session) checkInvite(token string) bool {
+	return token != "" && verifyGrantToken(token, grantInvite, s.accessScope())
+}
+
+// postInvite creates an invite link for a protected session. Only the
+// moderator may create invites.
+func postInvite(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("POST /invite/{sessionId}").Inc()
+
+	session, ok := getSessionById(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	user := identify(w, r)
+	if !session.isModerator(user) || !session.hasAccess(r) {
+		http.Error(w, "only the moderator can create invites", http.StatusForbidden)
+		return
+	}
+
+	token, expiry := session.newInviteToken()
+
+	err := templates.ExecuteTemplate(w, "invite", Data{
+		InviteLink: publicURL(r) + "/" + session.Id + "?invite=" + token,
+		ExpiresAt:  expiry,
+	})
+	if err != nil {
+		// logger.Error("could not execute template", "template", "invite", "session", session.Id, "error", err)
+	}
+}
+
+// attemptLimiter counts failed attempts per key and blocks a key after
+// max failures within window.
+type attemptLimiter struct {
+	max      int
+	window   time.Duration
+	failures map[string][]time.Time
+	sync.Mutex
+}
+
+func newAttemptLimiter(max int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{
+		max:      max,
+		window:   window,
+		failures: make(map[string][]time.Time),
+	}
+}
+
+// recent drops all failures of key that are outside the window. l has to
+// be locked by the caller.
+func (l *attemptLimiter) recent(key string) []time.Time {
+	cutoff := time.Now().Add(-l.window)
+
+	failures := l.failures[key]
+	for len(failures) > 0 && failures[0].Before(cutoff) {
+		failures = failures[1:]
+	}
+
+	if len(failures) == 0 {
+		delete(l.failures, key)
+	} else {
+		l.failures[key] = failures
+	}
+	return failures
+}
+
+func (l *attemptLimiter) allow(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	return len(l.recent(key)) < l.max
+}
+
+func (l *attemptLimiter) fail(key string) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.failures[key] = append(l.recent(key), time.Now())
+}
+
+var joinAttempts = newAttemptLimiter(5, 15*time.Minute)
+
+// clientIP returns the IP address of the client without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// protectTestSession starts a session of alice that is protected by the
+// passphrase "secret"
+func protectTestSession(t *testing.T) *Session {
+	t.Helper()
+
+	session := startTestSession(t, "alice-id")
+	hash, err := hashPassphrase("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.passphraseHash = hash
+	return session
+}
+
+// tamper replaces the payload of the signed token with payload, keeping
+// the signature
+func tamper(token string, payload string) string {
+	_, signature, _ := strings.Cut(token, ".")
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + signature
+}
+
+func TestVerifyGrantToken(t *testing.T) {
+	config = loadConfig()
+	in := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{"valid", newGrantToken(grantInvite, "session.a", in), true},
+		{"expired", newGrantToken(grantInvite, "session.a", time.Now().Add(-time.Second)), false},
+		{"other scope", newGrantToken(grantInvite, "session.b", in), false},
+		{"other kind", newGrantToken(grantAccess, "session.a", in), false},
+		{"unsigned", "invite|session.a|9999999999", false},
+		{"tampered", tamper(newGrantToken(grantInvite, "session.b", in), "invite|session.a|9999999999"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyGrantToken(tt.token, grantInvite, "session.a"); got != tt.want {
+				t.Errorf("verifyGrantToken(%q) = %v, want %v", tt.token, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJoinWithPassphrase(t *testing.T) {
+	server := newTestServer(t, func(c *Config) {
+		c.Protection.MaxFailedAttempts = 2
+	})
+	session := protectTestSession(t)
+
+	join := func(passphrase string) (*http.Response, string) {
+		t.Helper()
+
+		resp := postForm(t, server.URL+"/join-session/"+session.Id, url.Values{"username": {"Bob"}, "passphrase": {passphrase}}, identityCookie("bob-id", ""))
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := join("wrong")
+	if !strings.Contains(body, "Wrong passphrase") || responseCookie(resp, session.accessCookieName()) != nil {
+		t.Errorf("wrong passphrase was not rejected: %s", body)
+	}
+
+	resp, _ = join("secret")
+	cookie := responseCookie(resp, session.accessCookieName())
+	if cookie == nil || !verifyGrantToken(cookie.Value, grantAccess, session.accessScope()) {
+		t.Errorf("right passphrase got access cookie %v", cookie)
+	}
+
+	// the second failure reaches the limit, even the right passphrase is
+	// rejected afterwards
+	join("wrong")
+	resp, body = join("secret")
+	if !strings.Contains(body, "Too many failed attempts") || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("attempt limit did not trigger: %s", body)
+	}
+	if responseCookie(resp, session.accessCookieName()) != nil {
+		t.Error("access was granted above the attempt limit")
+	}
+}
+
+func TestJoinWithInvite(t *testing.T) {
+	server := newTestServer(t)
+	session := protectTestSession(t)
+	bob := identityCookie("bob-id", "Bob")
+
+	valid, _ := session.newInviteToken()
+	tests := []struct {
+		name   string
+		invite string
+		want   bool
+	}{
+		{"valid", valid, true},
+		{"expired", newGrantToken(grantInvite, session.accessScope(), time.Now().Add(-time.Minute)), false},
+		{"other session", newGrantToken(grantInvite, "session.other", time.Now().Add(time.Hour)), false},
+		{"access token", newGrantToken(grantAccess, session.accessScope(), time.Now().Add(time.Hour)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := get(t, server.URL+"/"+session.Id+"?invite="+url.QueryEscape(tt.invite), bob)
+			if got := responseCookie(resp, session.accessCookieName()) != nil; got != tt.want {
+				t.Errorf("invite admitted = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostInviteModeratorOnly(t *testing.T) {
+	server := newTestServer(t)
+	session := protectTestSession(t)
+	access := &http.Cookie{Name: session.accessCookieName(), Value: newGrantToken(grantAccess, session.accessScope(), time.Now().Add(time.Hour))}
+
+	resp := postForm(t, server.URL+"/invite/"+session.Id, nil, identityCookie("bob-id", "Bob"), access)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("invite of participant responded with %d", resp.StatusCode)
+	}
+
+	resp = postForm(t, server.URL+"/invite/"+session.Id, nil, identityCookie("alice-id", "Alice"), access)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "?invite=") {
+		t.Errorf("invite of moderator responded with %d %s", resp.StatusCode, body)
+	}
+}
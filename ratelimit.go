@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"nhooyr.io/websocket"
+)
+
+// limiterIdleTime is how long the limiter of a client is kept after its
+// last request. A new client starts with a full bucket anyway.
+const limiterIdleTime = 10 * time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// keyedLimiter is a token bucket per key, e.g. per client IP
+type keyedLimiter struct {
+	limit     rate.Limit
+	burst     int
+	clients   map[string]*clientLimiter
+	lastPrune time.Time
+	sync.Mutex
+}
+
+// newKeyedLimiter allows perMinute requests per key and minute. A rate of
+// zero disables the limiter.
+func newKeyedLimiter(perMinute float64, burst int) *keyedLimiter {
+	return &keyedLimiter{
+		limit:     perMinuteLimit(perMinute),
+		burst:     burst,
+		clients:   make(map[string]*clientLimiter),
+		lastPrune: time.Now(),
+	}
+}
+
+func perMinuteLimit(perMinute float64) rate.Limit {
+	if perMinute <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(perMinute / 60)
+}
+
+func perSecondLimit(perSecond float64) rate.Limit {
+	if perSecond <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(perSecond)
+}
+
+func (l *keyedLimiter) allow(key string) bool {
+	if l.limit == rate.Inf {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) > limiterIdleTime {
+		for k, client := range l.clients {
+			if now.Sub(client.lastSeen) > limiterIdleTime {
+				delete(l.clients, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	client, ok := l.clients[key]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[key] = client
+	}
+	client.lastSeen = now
+
+	return client.limiter.AllowN(now, 1)
+}
+
+// retryAfter is the number of seconds a client has to wait for a new token
+func (l *keyedLimiter) retryAfter() string {
+	if l.limit == rate.Inf {
+		return "1"
+	}
+	return strconv.Itoa(int(math.Ceil(1 / float64(l.limit))))
+}
+
+var createLimiter = newKeyedLimiter(10, 5)
+var joinLimiter = newKeyedLimiter(30, 10)
+var connectLimiter = newKeyedLimiter(60, 20)
+
+// rateLimit rejects requests of clients that exceeded limiter
+func rateLimit(limiter *keyedLimiter, name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.allow(clientIP(r)) {
+			// logger.Warn("rate limit exceeded", "limit", name, "ip", clientIP(r))
+			rateLimited.WithLabelValues(name).Inc()
+			w.Header().Set("Retry-After", limiter.retryAfter())
+			http.Error(w, "too many requests, please try again later", http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// full reports whether user can't join the session because it has the
+// maximum number of participants. Users that are in the session already
+// may always reconnect.
+func (s *Session) full(user *User) bool {
+	max := config.Limits.MaxParticipants
+	if max <= 0 {
+		return false
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if _, ok := s.Users[user.Id]; ok {
+		return false
+	}
+	return len(s.Users) >= max
+}
+
+var errMessageTooBig = errors.New("websocket message too big")
+
+// readMessage reads the next message from c. If the message is larger than
+// limit, the connection is closed and errMessageTooBig is returned.
+func readMessage(ctx context.Context, c *websocket.Conn, limit int) ([]byte, error) {
+	_, reader, err := c.Reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit <= 0 {
+		return io.ReadAll(reader)
+	}
+
+	d, err := io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(d) > limit {
+		c.Close(websocket.StatusMessageTooBig, "message too big")
+		return nil, errMessageTooBig
+	}
+	return d, nil
+}
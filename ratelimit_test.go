@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"nhooyr.io/websocket"
+)
+
+func TestKeyedLimiter(t *testing.T) {
+	limiter := newKeyedLimiter(1, 2)
+	for i := range 2 {
+		if !limiter.allow("a") {
+			t.Fatalf("request %d within the burst was rejected", i)
+		}
+	}
+	if limiter.allow("a") {
+		t.Error("request above the burst was allowed")
+	}
+	if !limiter.allow("b") {
+		t.Error("request of another client was rejected")
+	}
+	if got := limiter.retryAfter(); got != "60" {
+		t.Errorf("retry after %s, want 60", got)
+	}
+
+	disabled := newKeyedLimiter(0, 0)
+	for i := range 100 {
+		if !disabled.allow("a") {
+			t.Fatalf("request %d was rejected without limit", i)
+		}
+	}
+}
+
+func TestCreateLimit(t *testing.T) {
+	server := newTestServer(t, func(c *Config) {
+		c.Limits.CreateRate = 1
+		c.Limits.CreateBurst = 1
+	})
+	limited := testutil.ToFloat64(rateLimited.WithLabelValues(limitCreate))
+
+	// the form is invalid, so that no session is created
+	if resp := postForm(t, server.URL+"/create-session", url.Values{}); resp.StatusCode == http.StatusTooManyRequests {
+		t.Fatal("first create was rate limited")
+	}
+	resp := postForm(t, server.URL+"/create-session", url.Values{})
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "60" {
+		t.Errorf("second create responded with %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if got := testutil.ToFloat64(rateLimited.WithLabelValues(limitCreate)) - limited; got != 1 {
+		t.Errorf("rate limited creates = %v, want 1", got)
+	}
+}
+
+func TestJoinLimitSeparateFromConnects(t *testing.T) {
+	server := newTestServer(t, func(c *Config) {
+		c.Limits.JoinRate = 1
+		c.Limits.JoinBurst = 1
+		c.Limits.ConnectRate = 1
+		c.Limits.ConnectBurst = 1
+	})
+	session := startTestSession(t, "alice-id")
+	bob := identityCookie("bob-id", "Bob")
+
+	join := url.Values{"username": {"Bob"}}
+	if resp := postForm(t, server.URL+"/join-session/"+session.Id, join, bob); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first join responded with %d", resp.StatusCode)
+	}
+	if resp := postForm(t, server.URL+"/join-session/"+session.Id, join, bob); resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("second join responded with %d", resp.StatusCode)
+	}
+
+	// the exhausted join limit doesn't prevent the connection, but
+	// reconnecting in a loop is limited
+	dialWebsocket(t, server, session, bob)
+	header := http.Header{}
+	header.Add("Cookie", bob.String())
+	_, resp, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+"/ws/"+session.Id, &websocket.DialOptions{HTTPHeader: header})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second connect was not rate limited: %v", err)
+	}
+}
+
+func TestMessageLimit(t *testing.T) {
+	server := newTestServer(t, func(c *Config) {
+		c.Limits.MessageRate = 0.001
+		c.Limits.MessageBurst = 1
+	})
+	session := startTestSession(t, "alice-id")
+	limited := testutil.ToFloat64(rateLimited.WithLabelValues(limitMessages))
+
+	ws, messages := dialWebsocket(t, server, session, identityCookie("alice-id", "Alice"))
+	for _, card := range []string{"5", "8"} {
+		err := ws.Write(context.Background(), websocket.MessageText, []byte(`{"vote":"`+card+`","HEADERS":{"HX-Trigger":"vote"}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	receive(t, messages, "Recommendation")
+	waitFor(t, "the dropped message", func() bool {
+		return testutil.ToFloat64(rateLimited.WithLabelValues(limitMessages))-limited == 1
+	})
+	session.RLock()
+	vote := session.Users["alice-id"].Vote
+	session.RUnlock()
+	if vote != 5 {
+		t.Errorf("vote = %d, want the first vote 5", vote)
+	}
+}
+
+func TestParticipantLimit(t *testing.T) {
+	server := newTestServer(t, func(c *Config) {
+		c.Limits.MaxParticipants = 1
+	})
+	session := startTestSession(t, "alice-id")
+	alice := identityCookie("alice-id", "Alice")
+	bob := identityCookie("bob-id", "Bob")
+
+	dialWebsocket(t, server, session, alice)
+	waitFor(t, "the first participant", func() bool { return session.full(&User{Id: "bob-id"}) })
+
+	join := func(cookie *http.Cookie, name string) int {
+		t.Helper()
+		return postForm(t, server.URL+"/join-session/"+session.Id, url.Values{"username": {name}}, cookie).StatusCode
+	}
+	if status := join(bob, "Bob"); status != http.StatusServiceUnavailable {
+		t.Errorf("join above the limit responded with %d", status)
+	}
+	if status := join(alice, "Alice"); status != http.StatusOK {
+		t.Errorf("join of a participant of the full session responded with %d", status)
+	}
+
+	header := http.Header{}
+	header.Add("Cookie", bob.String())
+	_, resp, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+"/ws/"+session.Id, &websocket.DialOptions{HTTPHeader: header})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("connect above the limit was not rejected: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Teams disagree about how the recommendation should be derived from the
+// votes, so every session chooses a Recommender when it is created.
+
+// WeightedVote is a vote together with the weight of the role of the user
+type WeightedVote struct {
+	Value  int
+	Weight float64
+}
+
+type Recommender interface {
+	// Recommend returns a card of scale for votes. votes is never empty.
+	Recommend(votes []WeightedVote, scale Scale) int
+}
+
+type Strategy struct {
+	Name        string
+	Description string
+	Recommender Recommender
+}
+
+// defaultStrategy is the strategy that was used before strategies could
+// be chosen
+const defaultStrategy = "average-median"
+
+// strategies are offered in this order in the form to create a session
+var strategies = []Strategy{
+	{defaultStrategy, "Mean of average and median, rounded up to the next card", averageMedian{}},
+	{"median-nearest", "Median, rounded to the nearest card", medianNearest{}},
+	{"mode", "Card most people voted for", mode{}},
+	{"average-up", "Average, rounded up to the next card", averageUp{}},
+	{"trimmed-mean", "Average without the highest and the lowest vote, rounded to the nearest card", trimmedMean{}},
+	{"weighted", "Average weighted by the role of the participants, rounded up to the next card", weightedAverage{}},
+}
+
+func getStrategy(name string) (Strategy, bool) {
+	i := slices.IndexFunc(strategies, func(s Strategy) bool {
+		return s.Name == name
+	})
+	if i < 0 {
+		return Strategy{}, false
+	}
+	return strategies[i], true
+}
+
+// Strategies is used by the form to create a session
+func (d Data) Strategies() []Strategy {
+	return strategies
+}
+
+func values(votes []WeightedVote) []int {
+	v := make([]int, len(votes))
+	for i, vote := range votes {
+		v[i] = vote.Value
+	}
+	return v
+}
+
+// roundUp returns the smallest card that is at least value
+func roundUp(value float64, scale Scale) int {
+	for _, card := range scale {
+		if float64(card) >= value {
+			return card
+		}
+	}
+	return scale[len(scale)-1]
+}
+
+// nearest returns the card closest to value. Ties go to the higher card.
+func nearest(value float64, scale Scale) int {
+	best := scale[0]
+	for _, card := range scale {
+		if math.Abs(float64(card)-value) <= math.Abs(float64(best)-value) {
+			best = card
+		}
+	}
+	return best
+}
+
+type averageMedian struct{}
+
+func (averageMedian) Recommend(votes []WeightedVote, scale Scale) int {
+	v := values(votes)
+	return recommendation(average(v), median(v), scale)
+}
+
+type medianNearest struct{}
+
+func (medianNearest) Recommend(votes []WeightedVote, scale Scale) int {
+	return nearest(median(values(votes)), scale)
+}
+
+type mode struct{}
+
+// Recommend returns the card with the most votes. If several cards have
+// the same number of votes, the highest one wins. Votes that aren't on the
+// scale, e.g. after the scale of a room changed, are rounded to the nearest
+// card.
+func (mode) Recommend(votes []WeightedVote, scale Scale) int {
+	counts := make(map[int]int)
+	for _, vote := range votes {
+		counts[vote.Value]++
+	}
+
+	best, bestCount := 0, 0
+	for value, count := range counts {
+		if count > bestCount || (count == bestCount && value > best) {
+			best, bestCount = value, count
+		}
+	}
+	return nearest(float64(best), scale)
+}
+
+type averageUp struct{}
+
+func (averageUp) Recommend(votes []WeightedVote, scale Scale) int {
+	return roundUp(average(values(votes)), scale)
+}
+
+type trimmedMean struct{}
+
+// Recommend drops the highest and the lowest vote if there are at least
+// three votes
+func (trimmedMean) Recommend(votes []WeightedVote, scale Scale) int {
+	v := values(votes)
+	slices.Sort(v)
+	if len(v) >= 3 {
+		v = v[1 : len(v)-1]
+	}
+	return nearest(average(v), scale)
+}
+
+type weightedAverage struct{}
+
+func (weightedAverage) Recommend(votes []WeightedVote, scale Scale) int {
+	sum, weights := 0.0, 0.0
+	for _, vote := range votes {
+		sum += float64(vote.Value) * vote.Weight
+		weights += vote.Weight
+	}
+	if weights == 0 {
+		return averageUp{}.Recommend(votes, scale)
+	}
+	return roundUp(sum/weights, scale)
+}
+
+// roleWeights maps the roles participants can choose to the weight of
+// their votes in the weighted strategy. Users without role have weight 1.
+// It is set from the config on startup.
+var roleWeights = map[string]float64{}
+
+func roleWeight(role string) float64 {
+	if weight, ok := roleWeights[role]; ok {
+		return weight
+	}
+	return 1
+}
+
+// parseRoleWeights parses a list of role=weight pairs. Weights have to be
+// finite and must not be negative.
+func parseRoleWeights(list []string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, entry := range list {
+		role, value, ok := strings.Cut(entry, "=")
+		role = strings.TrimSpace(role)
+		if !ok || role == "" {
+			return nil, fmt.Errorf("invalid role weight %q, expected role=weight", entry)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || math.IsNaN(weight) || math.IsInf(weight, 0) || weight < 0 {
+			return nil, fmt.Errorf("invalid weight %q of role %s", value, role)
+		}
+		weights[role] = weight
+	}
+	return weights, nil
+}
+
+// Roles is used by the forms to let users choose their role
+func (d Data) Roles() []string {
+	roles := make([]string, 0, len(roleWeights))
+	for role := range roleWeights {
+		roles = append(roles, role)
+	}
+	slices.Sort(roles)
+	return roles
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"maps"
+	"math"
+	"slices"
+	"testing"
+)
+
+var fibonacciCards = Scale{1, 2, 3, 5, 8, 13, 21, 34, 55, 89, 144}
+
+func votesOf(values ...int) []WeightedVote {
+	votes := make([]WeightedVote, len(values))
+	for i, value := range values {
+		votes[i] = WeightedVote{Value: value, Weight: 1}
+	}
+	return votes
+}
+
+func TestRecommend(t *testing.T) {
+	tests := []struct {
+		strategy string
+		name     string
+		votes    []WeightedVote
+		want     int
+	}{
+		{"average-median", "single vote", votesOf(13), 13},
+		{"average-median", "rounded up", votesOf(1, 2, 8), 3},
+		{"average-median", "between cards", votesOf(3, 5), 5},
+		{"average-median", "above the scale", votesOf(200), 144},
+
+		{"median-nearest", "odd number of votes", votesOf(1, 2, 8), 2},
+		{"median-nearest", "tie goes up", votesOf(3, 5), 5},
+		{"median-nearest", "rounded down", votesOf(2, 3, 8, 13), 5},
+		{"median-nearest", "off the scale", votesOf(100), 89},
+
+		{"mode", "most votes", votesOf(3, 3, 5), 3},
+		{"mode", "tie goes up", votesOf(3, 5), 5},
+		{"mode", "tie with several votes", votesOf(1, 5, 5, 8, 8), 8},
+		{"mode", "snapped to the scale", votesOf(4, 4, 1), 5},
+		{"mode", "above the scale", votesOf(200, 200, 1), 144},
+
+		{"average-up", "rounded up", votesOf(1, 2), 2},
+		{"average-up", "next card", votesOf(3, 5, 8), 8},
+		{"average-up", "above the scale", votesOf(1000), 144},
+
+		{"trimmed-mean", "extremes dropped", votesOf(1, 1, 2, 3, 13), 2},
+		{"trimmed-mean", "two votes are kept", votesOf(1, 13), 8},
+		{"trimmed-mean", "three votes", votesOf(1, 2, 21), 2},
+
+		{"weighted", "weights", []WeightedVote{{Value: 8, Weight: 1}, {Value: 1, Weight: 0.5}}, 8},
+		{"weighted", "weight 0 is ignored", []WeightedVote{{Value: 3, Weight: 1}, {Value: 13, Weight: 0}}, 3},
+		{"weighted", "only weight 0", []WeightedVote{{Value: 2, Weight: 0}, {Value: 5, Weight: 0}}, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy+"/"+tt.name, func(t *testing.T) {
+			strategy, ok := getStrategy(tt.strategy)
+			if !ok {
+				t.Fatalf("unknown strategy %s", tt.strategy)
+			}
+			if got := strategy.Recommender.Recommend(tt.votes, fibonacciCards); got != tt.want {
+				t.Errorf("Recommend(%v) = %d, want %d", tt.votes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecommendWithoutVotes(t *testing.T) {
+	tests := []struct {
+		name    string
+		ballots []Ballot
+	}{
+		{"empty", nil},
+		{"nobody voted", []Ballot{{Id: "a", Name: "Alex", Vote: noVote}}},
+		{"all abstained", []Ballot{{Id: "a", Name: "Alex", Vote: abstained}, {Id: "b", Name: "Kim", Vote: abstained}}},
+	}
+
+	for _, strategy := range strategies {
+		for _, tt := range tests {
+			t.Run(strategy.Name+"/"+tt.name, func(t *testing.T) {
+				s := testSession()
+				s.strategy = strategy
+
+				round := s.tally(tt.ballots)
+				if len(round.Votes) != 0 || round.Recommendation != 0 || round.Average != 0 || round.Median != 0 {
+					t.Errorf("round = %+v, want no votes and no recommendation", round)
+				}
+				if round.Strategy != strategy.Name {
+					t.Errorf("strategy = %s, want %s", round.Strategy, strategy.Name)
+				}
+			})
+		}
+	}
+}
+
+// closestCards returns the cards of scale with the smallest distance to
+// value
+func closestCards(value float64, scale Scale) []int {
+	var closest []int
+	for _, card := range scale {
+		switch {
+		case len(closest) == 0 || math.Abs(float64(card)-value) < math.Abs(float64(closest[0])-value):
+			closest = []int{card}
+		case math.Abs(float64(card)-value) == math.Abs(float64(closest[0])-value):
+			closest = append(closest, card)
+		}
+	}
+	return closest
+}
+
+// isNextCard reports whether card is the smallest card of scale that is at
+// least value, or the highest card if value is above the scale
+func isNextCard(card int, value float64, scale Scale) bool {
+	i := slices.Index(scale, card)
+	if i < 0 {
+		return false
+	}
+	if float64(card) < value {
+		return i == len(scale)-1
+	}
+	return i == 0 || float64(scale[i-1]) < value
+}
+
+// TestRecommendAgainstHelpers checks the strategies against the average and
+// median helpers that the old recommendation was built on
+func TestRecommendAgainstHelpers(t *testing.T) {
+	inputs := [][]int{
+		{1}, {1, 2}, {3, 5}, {1, 2, 8}, {2, 3, 8, 13}, {5, 5, 5}, {1, 1, 2, 3, 13}, {1, 13, 89, 144}, {8, 21, 34, 55, 2}, {100, 200},
+	}
+
+	for _, v := range inputs {
+		votes := votesOf(v...)
+		sorted := slices.Clone(v)
+		slices.Sort(sorted)
+		trimmed := sorted
+		if len(trimmed) >= 3 {
+			trimmed = trimmed[1 : len(trimmed)-1]
+		}
+
+		if got := (medianNearest{}).Recommend(votes, fibonacciCards); !slices.Contains(closestCards(median(v), fibonacciCards), got) {
+			t.Errorf("median-nearest of %v = %d, median is %.1f", v, got, median(v))
+		}
+		if got := (averageUp{}).Recommend(votes, fibonacciCards); !isNextCard(got, average(v), fibonacciCards) {
+			t.Errorf("average-up of %v = %d, average is %.1f", v, got, average(v))
+		}
+		if got := (trimmedMean{}).Recommend(votes, fibonacciCards); !slices.Contains(closestCards(average(trimmed), fibonacciCards), got) {
+			t.Errorf("trimmed-mean of %v = %d, trimmed average is %.1f", v, got, average(trimmed))
+		}
+		if got, want := (averageMedian{}).Recommend(votes, fibonacciCards), recommendation(average(v), median(v), fibonacciCards); got != want {
+			t.Errorf("average-median of %v = %d, want %d", v, got, want)
+		}
+		// with equal weights, the weighted average is the average
+		if got := (weightedAverage{}).Recommend(votes, fibonacciCards); !isNextCard(got, average(v), fibonacciCards) {
+			t.Errorf("weighted of %v = %d, average is %.1f", v, got, average(v))
+		}
+	}
+}
+
+func TestParseRoleWeights(t *testing.T) {
+	weights, err := parseRoleWeights([]string{"developer=1", " product =0.5", "tester= 2 ", "observer=0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"developer": 1, "product": 0.5, "tester": 2, "observer": 0}
+	if !maps.Equal(weights, want) {
+		t.Errorf("weights = %v, want %v", weights, want)
+	}
+
+	for _, entry := range []string{"invalid", "=1", "negative=-1", "word=x", "nan=NaN", "inf=Inf", "plus=+Inf", "minus=-Inf", "empty="} {
+		if _, err := parseRoleWeights([]string{"developer=1", entry}); err == nil {
+			t.Errorf("%q was accepted", entry)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+)
+
+// After a discussion the team often votes again on the same story. A
+// re-vote keeps the previous round, so that the result shows how the votes
+// and the spread changed. Like every completed round, re-votes are recorded
+// in the history.
+
+// VoteChange is the vote of a user in the previous and the current round.
+// A vote is "?" if the user abstained and empty if the user didn't take
+// part in the round.
+type VoteChange struct {
+	// Id is the participant id of the user
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (c VoteChange) Changed() bool {
+	return c.From != c.To
+}
+
+// Spread are the spread metrics of a round
+type Spread struct {
+	Min    int     `json:"min"`
+	Max    int     `json:"max"`
+	StdDev float64 `json:"stdDev"`
+}
+
+// card returns the vote of the participant with the given id as shown in a
+// VoteChange
+func (round Round) card(id string) string {
+	if vote, ok := round.Votes[id]; ok {
+		return strconv.Itoa(vote.Vote)
+	}
+	if slices.ContainsFunc(round.Abstained, func(voter Voter) bool { return voter.Id == id }) {
+		return "?"
+	}
+	return ""
+}
+
+// compare records how round changed since previous, the round that was
+// re-voted
+func (round *Round) compare(previous Round) {
+	round.Revote = previous.Revote + 1
+	if len(previous.Votes) > 0 {
+		round.PreviousSpread = &Spread{Min: previous.Min, Max: previous.Max, StdDev: previous.StdDev}
+	}
+
+	// the name of the current round is shown if the user renamed
+	// themselves in between
+	var voters []Voter
+	for _, r := range []Round{*round, previous} {
+		voters = append(voters, r.voters()...)
+		voters = append(voters, r.Abstained...)
+	}
+	seen := make(map[string]bool)
+	voters = slices.DeleteFunc(voters, func(voter Voter) bool {
+		duplicate := seen[voter.Id]
+		seen[voter.Id] = true
+		return duplicate
+	})
+	slices.SortFunc(voters, compareVoters)
+
+	for _, voter := range voters {
+		round.Changes = append(round.Changes, VoteChange{
+			Id:   voter.Id,
+			Name: voter.Name,
+			From: previous.card(voter.Id),
+			To:   round.card(voter.Id),
+		})
+	}
+}
+
+// changeOf describes the previous vote of the participant with the given id
+// if it changed in a re-vote, e.g. " (was 3)"
+func (round Round) changeOf(id string) string {
+	for _, change := range round.Changes {
+		if change.Id == id && change.Changed() && change.From != "" {
+			return " (was " + change.From + ")"
+		}
+	}
+	return ""
+}
+
+// lastRound returns a copy of the last completed round of the current
+// story, or of the session if there is no current story. s has to be
+// locked by the caller.
+func (s *Session) lastRound() *Round {
+	rounds := s.rounds
+	if story := s.currentStory(); story != nil {
+		rounds = story.Rounds
+	}
+	if len(rounds) == 0 {
+		return nil
+	}
+	last := rounds[len(rounds)-1]
+	return &last
+}
+
+// handleRevote starts a new round on the same story that is compared with
+// the last one
+func (s *Session) handleRevote(msg Data) {
+	// logger.Info("re-voting", "session", s.Id, "user", msg.MyUser.Name)
+	s.Lock()
+	s.revoting = s.lastRound()
+	s.Unlock()
+
+	s.restartRound(msg)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func testSession() *Session {
+	scale, _ := scales.Get("fibonacci")
+	return newSessionState("Test", "moderator-id", scale, ExpiryPolicy{})
+}
+
+func TestTallyParticipantsWithTheSameName(t *testing.T) {
+	round := testSession().tally([]Ballot{
+		{Id: "a", Name: "Alex", Vote: 1},
+		{Id: "b", Name: "Alex", Vote: 8},
+		{Id: "c", Name: "Alex", Vote: abstained},
+		{Id: "d", Name: "Kim", Vote: noVote},
+	})
+
+	want := map[string]RoundVote{"a": {Name: "Alex", Vote: 1}, "b": {Name: "Alex", Vote: 8}}
+	if len(round.Votes) != len(want) || round.Votes["a"] != want["a"] || round.Votes["b"] != want["b"] {
+		t.Errorf("votes = %v, want %v", round.Votes, want)
+	}
+	if !slices.Equal(round.Abstained, []Voter{{Id: "c", Name: "Alex"}}) {
+		t.Errorf("abstained = %v", round.Abstained)
+	}
+	if round.Min != 1 || round.Max != 8 || round.Consensus != consensusNone {
+		t.Errorf("min %d, max %d, consensus %q", round.Min, round.Max, round.Consensus)
+	}
+	if !slices.Equal(round.Lowest, []string{"Alex"}) || !slices.Equal(round.Highest, []string{"Alex"}) {
+		t.Errorf("lowest %v, highest %v", round.Lowest, round.Highest)
+	}
+}
+
+func TestCompareParticipantsWithTheSameName(t *testing.T) {
+	s := testSession()
+	previous := s.tally([]Ballot{
+		{Id: "a", Name: "Alex", Vote: 3},
+		{Id: "b", Name: "Alex", Vote: 8},
+		{Id: "c", Name: "Sam", Vote: abstained},
+	})
+	round := s.tally([]Ballot{
+		{Id: "a", Name: "Alex", Vote: 5},
+		{Id: "b", Name: "Alex", Vote: 8},
+		{Id: "d", Name: "Kim", Vote: 5},
+	})
+	round.compare(previous)
+
+	want := []VoteChange{
+		{Id: "a", Name: "Alex", From: "3", To: "5"},
+		{Id: "b", Name: "Alex", From: "8", To: "8"},
+		{Id: "d", Name: "Kim", From: "", To: "5"},
+		{Id: "c", Name: "Sam", From: "?", To: ""},
+	}
+	if !slices.Equal(round.Changes, want) {
+		t.Errorf("changes = %v, want %v", round.Changes, want)
+	}
+	if round.Revote != 1 || round.PreviousSpread == nil || *round.PreviousSpread != (Spread{Min: 3, Max: 8, StdDev: previous.StdDev}) {
+		t.Errorf("revote %d, previous spread %v", round.Revote, round.PreviousSpread)
+	}
+	if got := round.changeOf("a"); got != " (was 3)" {
+		t.Errorf("change of a = %q", got)
+	}
+	if got := round.changeOf("b"); got != "" {
+		t.Errorf("change of b = %q", got)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Room is a persistent session with a stable, human-readable URL. While
+// nobody uses it, the room is dormant. It is reactivated as soon as
+// someone opens its URL.
+type Room struct {
+	Slug      string       `json:"slug"`
+	Name      string       `json:"name"`
+	Scale     string       `json:"scale"`
+	Settings  RoomSettings `json:"settings"`
+	Members   []string     `json:"members"`
+	History   []Round      `json:"history"`
+	CreatedAt time.Time    `json:"createdAt"`
+	LastUsed  time.Time    `json:"lastUsed"`
+	// Queue are the stories of an async room
+	Queue []*AsyncStory `json:"queue,omitempty"`
+	sync.Mutex
+}
+
+type RoomSettings struct {
+	// ModeratorId is the participant id of the user that created the room
+	ModeratorId string `json:"moderatorId"`
+	// PassphraseHash is the bcrypt hash of the passphrase protecting the room
+	PassphraseHash []byte `json:"passphraseHash,omitempty"`
+	// RequireLogin restricts the room to users that logged in via OIDC
+	RequireLogin  bool     `json:"requireLogin,omitempty"`
+	AllowedGroups []string `json:"allowedGroups,omitempty"`
+	// Strategy is the name of the recommendation strategy
+	Strategy string `json:"strategy,omitempty"`
+	// IssueTrackers hold the credentials of the GitHub and GitLab imports
+	IssueTrackers []IssueTrackerSettings `json:"issueTrackers,omitempty"`
+	// Webhooks receive the events of the room in addition to the global
+	// webhooks
+	Webhooks []Webhook `json:"webhooks,omitempty"`
+	// Notifiers post the results of the room in addition to the global
+	// notifiers
+	Notifiers []Notifier `json:"notifiers,omitempty"`
+	// Async makes the room an async room if it is set
+	Async *AsyncSettings `json:"async,omitempty"`
+}
+
+// RoundVote is the vote of a participant in a round
+type RoundVote struct {
+	Name string `json:"name"`
+	Vote int    `json:"vote"`
+}
+
+// Voter is a participant of a round
+type Voter struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Round is the result of one estimation round
+type Round struct {
+	// Votes maps participant ids to votes. Names are only shown, since
+	// several participants can have the same name.
+	Votes map[string]RoundVote `json:"votes"`
+	// Abstained are the users that voted "?" or didn't vote, sorted by name
+	Abstained      []Voter `json:"abstained,omitempty"`
+	Average        float64 `json:"average"`
+	Median         float64 `json:"median"`
+	Recommendation int     `json:"recommendation"`
+	// Story is the key of the story that was estimated, if any
+	Story string `json:"story,omitempty"`
+	// Strategy is the name of the strategy the recommendation came from
+	Strategy  string    `json:"strategy,omitempty"`
+	Min       int       `json:"min"`
+	Max       int       `json:"max"`
+	StdDev    float64   `json:"stdDev"`
+	Consensus Consensus `json:"consensus,omitempty"`
+	// Highest and Lowest are the names of the users with the highest and
+	// the lowest vote. They are only set if there is no consensus.
+	Highest     []string  `json:"highest,omitempty"`
+	Lowest      []string  `json:"lowest,omitempty"`
+	CompletedAt time.Time `json:"completedAt"`
+	// Revote counts the re-votes of the story before this round. It is 0
+	// for the first round.
+	Revote int `json:"revote,omitempty"`
+	// Changes and PreviousSpread compare a re-vote with the round before
+	Changes        []VoteChange `json:"changes,omitempty"`
+	PreviousSpread *Spread      `json:"previousSpread,omitempty"`
+}
+
+// UnmarshalJSON also reads rounds that were stored before votes were keyed
+// by participant id. Their names are used as ids.
+func (round *Round) UnmarshalJSON(data []byte) error {
+	type plain Round
+	var stored struct {
+		plain
+		Votes     json.RawMessage `json:"votes"`
+		Abstained json.RawMessage `json:"abstained"`
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	*round = Round(stored.plain)
+
+	if len(stored.Votes) > 0 && json.Unmarshal(stored.Votes, &round.Votes) != nil {
+		var byName map[string]int
+		if err := json.Unmarshal(stored.Votes, &byName); err != nil {
+			return err
+		}
+		round.Votes = make(map[string]RoundVote, len(byName))
+		for name, vote := range byName {
+			round.Votes[name] = RoundVote{Name: name, Vote: vote}
+		}
+	}
+
+	if len(stored.Abstained) > 0 && json.Unmarshal(stored.Abstained, &round.Abstained) != nil {
+		var names []string
+		if err := json.Unmarshal(stored.Abstained, &names); err != nil {
+			return err
+		}
+		round.Abstained = nil
+		for _, name := range names {
+			round.Abstained = append(round.Abstained, Voter{Id: name, Name: name})
+		}
+	}
+	return nil
+}
+
+var ErrRoomNotFound = errors.New("room not found")
+var ErrRoomExists = errors.New("room already exists")
+var ErrInvalidSlug = errors.New("slug must consist of 3 to 64 lowercase letters, digits and dashes")
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+func validSlug(slug string) bool {
+	return len(slug) >= 3 && len(slug) <= 64 && slugPattern.MatchString(slug)
+}
+
+type RoomStore interface {
+	Get(slug string) (*Room, error)
+	// Create stores a new room. It fails with ErrRoomExists if the slug is taken.
+	Create(room *Room) error
+	Save(room *Room) error
+}
+
+// rooms is the store all rooms are persisted in
+var rooms RoomStore = newMemoryRoomStore()
+
+type memoryRoomStore struct {
+	rooms map[string]*Room
+	sync.RWMutex
+}
+
+func newMemoryRoomStore() *memoryRoomStore {
+	return &memoryRoomStore{rooms: make(map[string]*Room)}
+}
+
+func (m *memoryRoomStore) Get(slug string) (*Room, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	room, ok := m.rooms[slug]
+	if !ok {
+		return nil, ErrRoomNotFound
+	}
+	return room, nil
+}
+
+func (m *memoryRoomStore) Create(room *Room) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.rooms[room.Slug]; ok {
+		return ErrRoomExists
+	}
+	m.rooms[room.Slug] = room
+	return nil
+}
+
+func (m *memoryRoomStore) Save(room *Room) error {
+	return nil
+}
+
+// fileRoomStore keeps every room as JSON file in a directory. Rooms that
+// were loaded once are cached, so that all sessions share the same *Room.
+type fileRoomStore struct {
+	dir   string
+	cache *memoryRoomStore
+	sync.Mutex
+}
+
+func newFileRoomStore(dir string) (*fileRoomStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &fileRoomStore{dir: dir, cache: newMemoryRoomStore()}, nil
+}
+
+func (f *fileRoomStore) path(slug string) string {
+	return filepath.Join(f.dir, slug+".json")
+}
+
+func (f *fileRoomStore) Get(slug string) (*Room, error) {
+	if !validSlug(slug) {
+		return nil, ErrRoomNotFound
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if room, err := f.cache.Get(slug); err == nil {
+		return room, nil
+	}
+
+	b, err := os.ReadFile(f.path(slug))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrRoomNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	room := &Room{}
+	if err := json.Unmarshal(b, room); err != nil {
+		return nil, err
+	}
+
+	f.cache.Create(room)
+	return room, nil
+}
+
+func (f *fileRoomStore) Create(room *Room) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if _, err := os.Stat(f.path(room.Slug)); err == nil {
+		return ErrRoomExists
+	}
+	if err := f.cache.Create(room); err != nil {
+		return err
+	}
+	return f.write(room)
+}
+
+func (f *fileRoomStore) Save(room *Room) error {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.write(room)
+}
+
+// write atomically replaces the file of room
+func (f *fileRoomStore) write(room *Room) error {
+	room.Lock()
+	b, err := json.MarshalIndent(room, "", "  ")
+	room.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(f.dir, room.Slug+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path(room.Slug))
+}
+
+func (room *Room) addMember(name string) {
+	room.Lock()
+	defer room.Unlock()
+
+	if !slices.Contains(room.Members, name) {
+		room.Members = append(room.Members, name)
+	}
+	room.LastUsed = time.Now()
+}
+
+func (room *Room) addRound(round Round) {
+	room.Lock()
+	defer room.Unlock()
+
+	room.History = append(room.History, round)
+	room.LastUsed = time.Now()
+}
+
+// activeRooms maps the slug of a room to its currently active session.
+// It is guarded by lockSessions.
+var activeRooms = make(map[string]*Session)
+
+// activateRoom returns the active session of room. If the room is dormant,
+// a new session is started for it.
+func activateRoom(room *Room) (*Session, error) {
+	lockSessions.Lock()
+	if session, ok := activeRooms[room.Slug]; ok && !session.closed() {
+		lockSessions.Unlock()
+		return session, nil
+	}
+
+	// logger.Info("reactivating room", "room", room.Slug)
+	room.Lock()
+	scale, ok := scales.Get(room.Scale)
+	if !ok {
+		// logger.Warn("scale of room is not registered anymore", "room", room.Slug, "scale", room.Scale)
+		scale, _ = scales.Get(defaultScale)
+	}
+	expiry := config.Expiry
+	if room.Settings.Async != nil {
+		expiry = config.AsyncExpiry
+	}
+	session := newSessionState(room.Name, room.Settings.ModeratorId, scale, expiry)
+	session.passphraseHash = room.Settings.PassphraseHash
+	session.requireLogin = room.Settings.RequireLogin
+	session.allowedGroups = room.Settings.AllowedGroups
+	if strategy, ok := getStrategy(room.Settings.Strategy); ok {
+		session.strategy = strategy
+	}
+	session.issueTrackers = slices.Clone(room.Settings.IssueTrackers)
+	room.Unlock()
+	session.room = room
+
+	if err := registerSession(session); err != nil {
+		lockSessions.Unlock()
+		return nil, err
+	}
+	activeRooms[room.Slug] = session
+	// the lock only guards the registration, the session is started
+	// without blocking other sessions
+	lockSessions.Unlock()
+
+	activeSessions.Inc()
+	// stories might have reached their deadline while the room was dormant
+	session.revealDueStories()
+	go session.handleBroadcast()
+	session.emitCreated()
+
+	return session, nil
+}
+
+func getRoom(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	httpReqs.WithLabelValues("GET /r/{slug}").Inc()
+
+	room, err := rooms.Get(slug)
+	if errors.Is(err, ErrRoomNotFound) {
+		// logger.Warn("room does not exist", "room", slug)
+		// cookies have to be set before the status is written
+		data := Data{
+			SessionId: slug,
+			MyUser:    identify(w, r),
+			CSRFToken: csrfToken(w, r),
+		}
+		w.WriteHeader(http.StatusNotFound)
+
+		err := templateNotFound.Execute(w, data)
+		if err != nil {
+			// logger.Error("could not execute template", "template", "not-found", "error", err, "room", slug)
+		}
+		return
+	} else if err != nil {
+		// logger.Error("could not load room", "room", slug, "error", err)
+		http.Error(w, "could not load room", http.StatusInternalServerError)
+		return
+	}
+
+	session, err := activateRoom(room)
+	if err != nil {
+		// logger.Warn("could not activate room", "room", slug, "error", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	showSession(w, r, session)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestRoundJSON(t *testing.T) {
+	round := Round{
+		Votes:     map[string]RoundVote{"a": {Name: "Alex", Vote: 5}, "b": {Name: "Alex", Vote: 8}},
+		Abstained: []Voter{{Id: "c", Name: "Sam"}},
+		Max:       8,
+	}
+	data, err := json.Marshal(round)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded Round
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Votes) != 2 || decoded.Votes["b"] != round.Votes["b"] || !slices.Equal(decoded.Abstained, round.Abstained) || decoded.Max != 8 {
+		t.Errorf("decoded %+v, want %+v", decoded, round)
+	}
+}
+
+func TestRoundJSONKeyedByName(t *testing.T) {
+	var round Round
+	err := json.Unmarshal([]byte(`{"votes":{"Alex":5,"Kim":8},"abstained":["Sam"],"max":8}`), &round)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if round.Votes["Alex"] != (RoundVote{Name: "Alex", Vote: 5}) || round.Votes["Kim"] != (RoundVote{Name: "Kim", Vote: 8}) {
+		t.Errorf("votes = %v", round.Votes)
+	}
+	if !slices.Equal(round.Abstained, []Voter{{Id: "Sam", Name: "Sam"}}) {
+		t.Errorf("abstained = %v", round.Abstained)
+	}
+	if round.Max != 8 {
+		t.Errorf("max = %d, want 8", round.Max)
+	}
+}
+
+func TestActivateRoomOnce(t *testing.T) {
+	config = loadConfig()
+	room := &Room{Slug: "activate", Name: "Activate", Scale: defaultScale}
+
+	var wg sync.WaitGroup
+	activated := make([]*Session, 8)
+	for i := range activated {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session, err := activateRoom(room)
+			if err != nil {
+				t.Error(err)
+			}
+			activated[i] = session
+		}()
+	}
+	wg.Wait()
+	t.Cleanup(func() { activated[0].publish(Data{event: CLOSED}) })
+
+	for _, session := range activated {
+		if session != activated[0] {
+			t.Fatal("the room was activated more than once")
+		}
+	}
+}
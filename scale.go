@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Scales are kept in a registry. The voting deck and the create form are
+// rendered from it, so operators can add presets through a JSON file
+// without changing templates.
+
+// Scale are the cards of a deck in ascending order
+type Scale []int
+
+// ScaleDefinition is a deck users vote with
+type ScaleDefinition struct {
+	// Name identifies the scale in forms and rooms
+	Name  string `json:"name"`
+	Title string `json:"title"`
+	// Description explains when to use the scale
+	Description string `json:"description,omitempty"`
+	Cards       Scale  `json:"cards"`
+	// Special are cards without a value, like "?". Voting one of them
+	// abstains.
+	Special []string `json:"special,omitempty"`
+}
+
+// maxSpecialCardLength keeps special cards short enough for a card
+const maxSpecialCardLength = 8
+
+// defaultScale is used by rooms whose scale was removed from the registry
+const defaultScale = "fibonacci"
+
+// Summary lists all cards, e.g. for the create form
+func (d ScaleDefinition) Summary() string {
+	cards := make([]string, 0, len(d.Cards)+len(d.Special))
+	for _, card := range d.Cards {
+		cards = append(cards, strconv.Itoa(card))
+	}
+	return strings.Join(append(cards, d.Special...), ", ")
+}
+
+// validate checks that the cards are ascending, which the recommendation
+// strategies rely on, and that special cards can't be mistaken for numbers
+func (d ScaleDefinition) validate() error {
+	if !validSlug(d.Name) {
+		return fmt.Errorf("invalid scale name %q", d.Name)
+	}
+	if strings.TrimSpace(d.Title) == "" {
+		return fmt.Errorf("scale %q has no title", d.Name)
+	}
+	if len(d.Cards) == 0 {
+		return fmt.Errorf("scale %q has no cards", d.Name)
+	}
+	for i, card := range d.Cards {
+		if card < 0 {
+			return fmt.Errorf("scale %q has negative card %d", d.Name, card)
+		}
+		if i > 0 && card <= d.Cards[i-1] {
+			return fmt.Errorf("cards of scale %q have to be ascending and unique", d.Name)
+		}
+	}
+	for i, card := range d.Special {
+		if card == "" || utf8.RuneCountInString(card) > maxSpecialCardLength {
+			return fmt.Errorf("special cards of scale %q have to be 1 to %d characters long", d.Name, maxSpecialCardLength)
+		}
+		if _, err := strconv.Atoi(card); err == nil {
+			return fmt.Errorf("special card %q of scale %q is a number", card, d.Name)
+		}
+		if slices.Contains(d.Special[:i], card) {
+			return fmt.Errorf("special card %q of scale %q is not unique", card, d.Name)
+		}
+	}
+	return nil
+}
+
+// ScaleRegistry holds the scales in the order they are offered
+type ScaleRegistry struct {
+	definitions []ScaleDefinition
+}
+
+func newScaleRegistry(definitions ...ScaleDefinition) *ScaleRegistry {
+	registry := &ScaleRegistry{}
+	for _, definition := range definitions {
+		if err := registry.Add(definition); err != nil {
+			panic(err)
+		}
+	}
+	return registry
+}
+
+func (r *ScaleRegistry) Get(name string) (ScaleDefinition, bool) {
+	i := slices.IndexFunc(r.definitions, func(d ScaleDefinition) bool { return d.Name == name })
+	if i < 0 {
+		return ScaleDefinition{}, false
+	}
+	return r.definitions[i], true
+}
+
+func (r *ScaleRegistry) All() []ScaleDefinition {
+	return slices.Clone(r.definitions)
+}
+
+// Add registers definition. A scale with the same name is replaced.
+func (r *ScaleRegistry) Add(definition ScaleDefinition) error {
+	if err := definition.validate(); err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(r.definitions, func(d ScaleDefinition) bool { return d.Name == definition.Name })
+	if i >= 0 {
+		r.definitions[i] = definition
+	} else {
+		r.definitions = append(r.definitions, definition)
+	}
+	return nil
+}
+
+// scales are the built-in scales and the presets of the operator, which
+// are added on startup
+var scales = newScaleRegistry(
+	ScaleDefinition{
+		Name:        "fibonacci",
+		Title:       "Fibonacci",
+		Description: "Story points that grow with the uncertainty of large stories",
+		Cards:       Scale{1, 2, 3, 5, 8, 13, 21, 34, 55, 89, 144},
+		Special:     []string{"?"},
+	},
+	ScaleDefinition{
+		Name:        "workingdays",
+		Title:       "Working Days",
+		Description: "The number of days a story takes",
+		Cards:       Scale{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14},
+		Special:     []string{"?"},
+	},
+)
+
+// loadScales adds the scales in the JSON file at path to the registry
+func loadScales(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var definitions []ScaleDefinition
+	if err := json.Unmarshal(b, &definitions); err != nil {
+		return fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	for _, definition := range definitions {
+		if err := scales.Add(definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scales are offered in the create form
+func (d Data) Scales() []ScaleDefinition {
+	return scales.All()
+}
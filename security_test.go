@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"nhooyr.io/websocket"
+)
+
+func TestRequireCSRF(t *testing.T) {
+	server := newTestServer(t)
+	session := startTestSession(t, "alice-id")
+	alice := identityCookie("alice-id", "Alice")
+	openEventStream(t, server, session, alice)
+	nonce := strings.Repeat("n", 32)
+
+	tests := []struct {
+		name   string
+		cookie string
+		token  string
+		want   int
+	}{
+		{"without token", nonce, "", http.StatusForbidden},
+		{"without cookie", "", sign(csrfPayload(nonce)), http.StatusForbidden},
+		{"token of another nonce", nonce, sign(csrfPayload(strings.Repeat("m", 32))), http.StatusForbidden},
+		{"unsigned token", nonce, csrfPayload(nonce), http.StatusForbidden},
+		{"valid token", nonce, sign(csrfPayload(nonce)), http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodPost, server.URL+"/sse/"+session.Id+"/vote", strings.NewReader(url.Values{"vote": {"5"}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.AddCookie(alice)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: tt.cookie})
+			}
+			if tt.token != "" {
+				r.Header.Set(csrfHeader, tt.token)
+			}
+
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("vote responded with %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebsocketRejectsForeignOrigin(t *testing.T) {
+	server := newTestServer(t)
+	session := startTestSession(t, "alice-id")
+
+	header := http.Header{}
+	header.Add("Cookie", identityCookie("alice-id", "Alice").String())
+	header.Set("Origin", "https://evil.example.com")
+	c, resp, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+"/ws/"+session.Id, &websocket.DialOptions{HTTPHeader: header})
+	if err == nil {
+		c.CloseNow()
+		t.Fatal("websocket of a foreign origin was accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("websocket of a foreign origin responded with %v", resp)
+	}
+}
+
+func TestSecureHeaders(t *testing.T) {
+	newTestServer(t)
+	handler := secureHeaders(config.Security, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	plain := httptest.NewServer(handler)
+	t.Cleanup(plain.Close)
+	tls := httptest.NewTLSServer(handler)
+	t.Cleanup(tls.Close)
+
+	tests := []struct {
+		name   string
+		url    string
+		client *http.Client
+		hsts   bool
+	}{
+		{"plain", plain.URL, plain.Client(), false},
+		{"tls", tls.URL, tls.Client(), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.client.Get(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			want := map[string]string{
+				"Content-Security-Policy": contentSecurityPolicy,
+				"X-Content-Type-Options":  "nosniff",
+				"X-Frame-Options":         "DENY",
+				"Referrer-Policy":         "same-origin",
+			}
+			for name, value := range want {
+				if got := resp.Header.Get(name); got != value {
+					t.Errorf("%s = %q, want %q", name, got, value)
+				}
+			}
+
+			hsts := resp.Header.Get("Strict-Transport-Security")
+			if tt.hsts && !strings.HasPrefix(hsts, "max-age=31536000") {
+				t.Errorf("Strict-Transport-Security = %q over TLS", hsts)
+			}
+			if !tt.hsts && hsts != "" {
+				t.Errorf("Strict-Transport-Security = %q without TLS", hsts)
+			}
+		})
+	}
+}
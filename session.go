@@ -3,32 +3,136 @@ package main
 import (
 	"bytes"
 	"context"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"nhooyr.io/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// noVote means the user has not voted in the current round yet
+	noVote = -1
+	// abstained means the user voted "?" or didn't vote before the
+	// countdown ran out
+	abstained = -2
 )
 
 type User struct {
-	Name       string
-	Vote       int
-	Connection *websocket.Conn
+	// Id is the participant id from the identity cookie
+	Id   string
+	Name string
+	// Subject and Groups are set for users that logged in via OIDC
+	Subject string
+	Groups  []string
+	// Role weighs the vote of the user in the weighted recommendation
+	Role string
+	Vote int
+	// Special is the special card the user abstained with, e.g. "?". It is
+	// empty if the user abstained because the votes were revealed early.
+	Special string
+	// Connection is a websocket or an event stream. It is nil for users
+	// that vote from Slack.
+	Connection Conn
+}
+
+// Voted reports whether user voted or abstained in the current round
+func (u *User) Voted() bool {
+	return u.Vote != noVote
+}
+
+func (u *User) Abstained() bool {
+	return u.Vote == abstained
 }
 
 type Session struct {
+	// Users maps participant ids to users
 	Users     map[string]*User
-	scale     Scale
+	scale     ScaleDefinition
 	broadcast chan Data
+	done      chan struct{}
 	Id        string
-	Name      string
+	// JoinCode is a short code like ABC-123 that can be used instead of Id
+	JoinCode string
+	Name     string
+	// moderator is the participant id of the user that created the session
+	moderator string
+	createdAt time.Time
+	// lastActivity is the time the last event was handled
+	lastActivity time.Time
+	// emptySince is the time the last user left the session
+	emptySince time.Time
+	peakUsers  int
+	expiry     ExpiryPolicy
+	// extension is the time moderators added to the lifetime of the session
+	extension time.Duration
+	// warned is true while users are shown that the session expires soon
+	warned bool
+	// strategy derives the recommendation from the votes
+	strategy Strategy
+	// passphraseHash protects the session if it is set
+	passphraseHash []byte
+	// requireLogin restricts the session to users that logged in via OIDC.
+	// If allowedGroups is not empty, they have to be member of one of them.
+	requireLogin  bool
+	allowedGroups []string
+	// room is the persistent room the session belongs to, if any
+	room *Room
+	// rounds are all completed rounds of the session
+	rounds []Round
+	// revoting is the round the current round is a re-vote of, if any
+	revoting *Round
+	// revealed is set when the votes of the current round are revealed
+	// and cleared when the next round starts
+	revealed *revealedRound
+	// stories is the story list and story the index of the story that is
+	// estimated right now. It is len(stories) if all have been estimated.
+	stories []*Story
+	story   int
+	// slack is the message of sessions started from Slack. It is set
+	// before the session is started.
+	slack *slackThread
+	// issueTrackers are the settings of the GitHub and GitLab imports, one
+	// per repo. The most recently saved ones are last.
+	issueTrackers []IssueTrackerSettings
+	// countdown ticks while the moderator's countdown for the current round
+	// runs. It is only used by the broadcast loop.
+	countdown *time.Ticker
+	// deadline is when the countdown runs out and the votes are revealed
+	deadline time.Time
 	sync.RWMutex
 }
 
+// newSessionState returns a session that has not been registered yet. Its
+// id is assigned by registerSession.
+func newSessionState(name string, moderator string, scale ScaleDefinition, expiry ExpiryPolicy) *Session {
+	now := time.Now()
+	strategy, _ := getStrategy(defaultStrategy)
+	return &Session{
+		Users:        make(map[string]*User),
+		scale:        scale,
+		broadcast:    make(chan Data),
+		done:         make(chan struct{}),
+		Name:         name,
+		moderator:    moderator,
+		createdAt:    now,
+		lastActivity: now,
+		emptySince:   now,
+		expiry:       expiry,
+		strategy:     strategy,
+	}
+}
+
 func (s *Session) getOtherUsers(me string) []*User {
+	s.RLock()
+	defer s.RUnlock()
+
 	users := make([]*User, 0, len(s.Users))
-	for userName, user := range s.Users {
-		if userName == me {
+	for id, user := range s.Users {
+		if id == me {
 			continue
 		}
 		users = append(users, user)
@@ -37,50 +141,231 @@ func (s *Session) getOtherUsers(me string) []*User {
 }
 
 func (s *Session) allUsersVoted() bool {
+	s.RLock()
+	defer s.RUnlock()
+
 	for _, user := range s.Users {
-		if user.Vote < 0 {
+		if !user.Voted() {
 			return false
 		}
 	}
 	return true
 }
 
+// getVotes returns the votes of all users that voted for a number
 func (s *Session) getVotes() []int {
+	s.RLock()
+	defer s.RUnlock()
+
 	votes := make([]int, 0, len(s.Users))
 	for _, user := range s.Users {
-		votes = append(votes, user.Vote)
+		if user.Voted() && !user.Abstained() {
+			votes = append(votes, user.Vote)
+		}
 	}
 	return votes
 }
 
-var activeSessions = prometheus.NewGauge(prometheus.GaugeOpts{
-	Name: "sessions_active",
-	Help: "How many sessions are currently active",
-})
+// addUser registers user as a participant of the session
+func (s *Session) addUser(user *User) {
+	s.Lock()
+	s.Users[user.Id] = user
+	if len(s.Users) > s.peakUsers {
+		s.peakUsers = len(s.Users)
+	}
+	s.Unlock()
+
+	if s.room != nil {
+		s.room.addMember(user.Name)
+		s.saveRoom()
+	}
+}
+
+func (s *Session) saveRoom() {
+	if err := rooms.Save(s.room); err != nil {
+		// logger.Error("could not save room", "room", s.room.Slug, "error", err)
+	}
+}
+
+// completeRound records the result of a round in which everyone voted
+// and runs the round hooks. It reports whether the round was completed,
+// a round that has been revealed already is never completed again.
+func (s *Session) completeRound(round Round) bool {
+	s.Lock()
+	if s.revealed != nil {
+		s.Unlock()
+		return false
+	}
+	story := s.estimate(&round)
+	s.rounds = append(s.rounds, round)
+	s.revealed = &revealedRound{round: round, story: story}
+	s.Unlock()
+
+	if s.room != nil {
+		s.room.addRound(round)
+		s.saveRoom()
+	}
+
+	runRoundHooks(s, story, round)
+	return true
+}
+
+// Ballot is the vote of one user that is counted in a round
+type Ballot struct {
+	// Id is the participant id of the user
+	Id   string
+	Name string
+	Role string
+	Vote int
+}
 
-var activeUsers = prometheus.NewGauge(prometheus.GaugeOpts{
-	Name: "users_active",
-	Help: "How many users are currently active",
-})
+// newRound returns the result of the current votes
+func (s *Session) newRound() Round {
+	s.RLock()
+	ballots := make([]Ballot, 0, len(s.Users))
+	for _, user := range s.Users {
+		ballots = append(ballots, Ballot{Id: user.Id, Name: user.Name, Role: user.Role, Vote: user.Vote})
+	}
+	previous := s.revoting
+	s.RUnlock()
+
+	round := s.tally(ballots)
+	if previous != nil {
+		round.compare(*previous)
+	}
+	return round
+}
+
+// tally returns the result of ballots. Users that abstained are listed,
+// but their ballots are not counted.
+func (s *Session) tally(ballots []Ballot) Round {
+	round := Round{
+		Votes:       make(map[string]RoundVote),
+		Strategy:    s.strategy.Name,
+		CompletedAt: time.Now(),
+	}
+
+	votes := make([]int, 0, len(ballots))
+	weighted := make([]WeightedVote, 0, len(ballots))
+	for _, ballot := range ballots {
+		switch ballot.Vote {
+		case noVote:
+		case abstained:
+			round.Abstained = append(round.Abstained, Voter{Id: ballot.Id, Name: ballot.Name})
+		default:
+			round.Votes[ballot.Id] = RoundVote{Name: ballot.Name, Vote: ballot.Vote}
+			votes = append(votes, ballot.Vote)
+			weighted = append(weighted, WeightedVote{Value: ballot.Vote, Weight: roleWeight(ballot.Role)})
+		}
+	}
 
-var totalEstimations = prometheus.NewCounter(prometheus.CounterOpts{
-	Name: "estimations_total",
-	Help: "How many estimations have been processed",
-})
+	slices.SortFunc(round.Abstained, compareVoters)
+
+	round.Average = average(votes)
+	round.Median = median(votes)
+	if len(weighted) > 0 {
+		round.Recommendation = s.strategy.Recommender.Recommend(weighted, s.scale.Cards)
+	}
+
+	round.analyze(s.scale.Cards)
+	return round
+}
+
+// compareVoters orders voters by name, and by id if the names are the same
+func compareVoters(a, b Voter) int {
+	if c := strings.Compare(a.Name, b.Name); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Id, b.Id)
+}
+
+// voters returns the participants that voted in round, sorted by name
+func (round Round) voters() []Voter {
+	voters := make([]Voter, 0, len(round.Votes))
+	for id, vote := range round.Votes {
+		voters = append(voters, Voter{Id: id, Name: vote.Name})
+	}
+	slices.SortFunc(voters, compareVoters)
+	return voters
+}
+
+func (s *Session) removeUser(user *User) {
+	s.Lock()
+	defer s.Unlock()
+
+	// The user might have reconnected in the meantime with a new connection
+	if s.Users[user.Id] == user {
+		delete(s.Users, user.Id)
+	}
+
+	if len(s.Users) == 0 {
+		s.emptySince = time.Now()
+	}
+}
+
+// publish hands msg over to the broadcast loop of the session. It returns
+// false if the session has already been closed and nobody is listening anymore.
+func (s *Session) publish(msg Data) bool {
+	msg.publishedAt = time.Now()
+	if msg.ctx == nil {
+		msg.ctx = context.Background()
+	}
+	// The event is handled after the request of the publisher might have
+	// finished, so only the trace is carried over, not the cancellation.
+	msg.ctx = context.WithoutCancel(msg.ctx)
+	select {
+	case s.broadcast <- msg:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *Session) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
 
 func (s *Session) handleBroadcast() {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case msg := <-s.broadcast:
 			s.handleEvent(msg)
-		case <-time.After(1 * time.Hour):
-			s.handleTimeout()
-			return
+			if msg.event == CLOSED {
+				return
+			}
+		case <-ticker.C:
+			if s.revealDueStories() {
+				s.handleAsyncChanged(Data{ctx: context.Background(), event: ASYNC_CHANGED, publishedAt: time.Now()})
+			}
+			if s.checkExpiry() {
+				return
+			}
+		case <-s.countdownTick():
+			s.checkCountdown()
 		}
 	}
 }
 
 func (s *Session) handleEvent(msg Data) {
+	ctx, span := tracer.Start(msg.ctx, "Session.handleEvent", trace.WithAttributes(sessionAttributes(s)...))
+	span.SetAttributes(attribute.Stringer("session.event", msg.event))
+	defer span.End()
+	msg.ctx = ctx
+
+	sessionEvents.WithLabelValues(msg.event.String()).Inc()
+
+	s.Lock()
+	s.lastActivity = time.Now()
+	s.Unlock()
+
 	switch msg.event {
 	case USER_JOINED:
 		s.handleUserJoined(msg)
@@ -90,6 +375,26 @@ func (s *Session) handleEvent(msg Data) {
 		s.handleUserVoted(msg)
 	case RESET:
 		s.handleReset(msg)
+	case REVOTE:
+		s.handleRevote(msg)
+	case ACCEPT:
+		s.handleAccept(msg)
+	case ASYNC_CHANGED:
+		s.handleAsyncChanged(msg)
+	case EXTENDED:
+		s.handleExtend(msg)
+	case COUNTDOWN:
+		s.handleCountdown(msg)
+	case STORIES_ADDED:
+		s.handleStoriesAdded(msg)
+	case NEXT_STORY:
+		s.handleNextStory(msg)
+	case REVEAL:
+		s.handleReveal(msg)
+	case BANNER:
+		s.handleBanner(msg)
+	case CLOSED:
+		s.handleClosed(msg)
 	case DEFAULT:
 		fallthrough
 	default:
@@ -97,184 +402,280 @@ func (s *Session) handleEvent(msg Data) {
 	}
 }
 
-func (s *Session) handleTimeout() {
-	// logger.Info("deleting session after one hour of inactivity", "session", s.Id)
-	s.executeAllUsers(func(user *User) {
-		var buf bytes.Buffer
-		err := templates.ExecuteTemplate(&buf, "timeout", Data{
+func (s *Session) handleTimeout(reason string) {
+	// logger.Info("deleting expired session", "session", s.Id, "reason", reason)
+	ctx, span := tracer.Start(context.Background(), "Session.handleTimeout", trace.WithAttributes(sessionAttributes(s)...))
+	span.SetAttributes(attribute.String("session.expiry_reason", reason))
+	defer span.End()
+
+	s.end(Data{ctx: ctx, event: TIMEOUT, publishedAt: time.Now(), Reason: reason}, "timeout")
+	s.emitExpired(reason)
+}
+
+func (s *Session) handleClosed(msg Data) {
+	// logger.Info("session closed by admin", "session", s.Id)
+	s.end(msg, "closed")
+}
+
+// end removes the session, shows the template with the given name to all
+// users and closes their connections.
+func (s *Session) end(msg Data, name string) {
+	close(s.done)
+
+	lockSessions.Lock()
+	unregisterSession(s)
+	if s.room != nil && activeRooms[s.room.Slug] == s {
+		// logger.Info("room goes dormant", "room", s.room.Slug)
+		delete(activeRooms, s.room.Slug)
+	}
+	lockSessions.Unlock()
+
+	if s.room != nil {
+		s.saveRoom()
+	}
+
+	s.executeAllUsers(msg, func(ctx context.Context, user *User) {
+		s.render(ctx, user, name, Data{
 			SessionName: s.Name,
+			Reason:      msg.Reason,
 		})
 
-		if err != nil {
-			// logger.Error("could not execute template", "template", "timeout", "session", s.Id, "user", user.Name, "error", err)
+		if user.Connection == nil {
+			return
 		}
-
-		if err = user.Connection.Write(context.Background(), websocket.MessageText, buf.Bytes()); err != nil {
-			// logger.Error("could not write message to user", "message", buf.String(), "session", s.Id, "user", user.Name, "error", err)
+		if err := user.Connection.Close("Session ended"); err != nil {
+			// logger.Error("could not close websocket connection", "user", user.Name, "session", s.Id, "error", err)
 		}
 	})
-	delete(sessions, s.Id)
+
 	activeSessions.Dec()
+	sessionLifetime.Observe(time.Since(s.createdAt).Seconds())
+
+	s.RLock()
+	sessionParticipants.Observe(float64(s.peakUsers))
+	s.RUnlock()
 }
 
 func (s *Session) handleUserJoined(msg Data) {
 	// logger.Info("user joined session", "publisher", msg.MyUser.Name, "session", s.Id)
-	activeUsers.Inc()
-
-	go s.executeSubscribers(msg.MyUser.Name, func(user *User) {
-		var buf bytes.Buffer
-		err := templates.ExecuteTemplate(&buf, "users", Data{
+	go s.executeSubscribers(msg, func(ctx context.Context, user *User) {
+		s.render(ctx, user, "users", Data{
 			MyUser:     user,
-			OtherUsers: s.getOtherUsers(user.Name),
+			OtherUsers: s.getOtherUsers(user.Id),
 		})
-
-		if err != nil {
-			// logger.Error("could not execute template", "template", "users", "session", s.Id, "user", user.Name, "error", err)
-		}
-
-		if err = user.Connection.Write(context.Background(), websocket.MessageText, buf.Bytes()); err != nil {
-			// logger.Error("could not write message to user", "message", buf.String(), "session", s.Id, "user", user.Name, "error", err)
-		}
 	})
 }
 
 func (s *Session) handleUserLeft(msg Data) {
 	// logger.Info("user left session", "user", msg.MyUser.Name, "session", s.Id)
-	activeUsers.Dec()
+	s.RLock()
+	empty := len(s.Users) == 0
+	s.RUnlock()
+	if empty {
+		s.stopCountdown()
+		return
+	}
 
-	d := Data{}
-	if s.allUsersVoted() {
-		votes := s.getVotes()
-		average := average(votes)
-		median := median(votes)
-		recommendation := recommendation(average, median, s.scale)
+	s.RLock()
+	revealed := s.revealed
+	s.RUnlock()
+
+	allVoted := s.allUsersVoted()
+	if revealed == nil && allVoted && s.countdown != nil {
+		// the countdown is waiting for the user that left
+		s.reveal(msg)
+		return
+	}
 
-		d.AllVoted = true
-		d.Average = average
-		d.Median = median
-		d.Recommendation = recommendation
+	d := Data{}
+	if revealed != nil {
+		d = resultData(revealed.round)
+		d.Accepted = revealed.accepted
+	} else if allVoted {
+		d = resultData(s.newRound())
 	}
 
-	go s.executeAllUsers(func(user *User) {
+	go s.executeAllUsers(msg, func(ctx context.Context, user *User) {
 		data := d
 		data.MyUser = user
-		data.OtherUsers = s.getOtherUsers(user.Name)
-
-		var buf bytes.Buffer
-		err := templates.ExecuteTemplate(&buf, "users", data)
-		if err != nil {
-			// logger.Error("could not execute template", "template", "users", "session", s.Id, "user", user.Name, "error", err)
-		}
+		data.OtherUsers = s.getOtherUsers(user.Id)
+		data.Moderator = s.isModerator(user)
 
-		if err = user.Connection.Write(context.Background(), websocket.MessageText, buf.Bytes()); err != nil {
-			// logger.Error("could not write message to user", "message", buf.String(), "session", s.Id, "user", user.Name, "error", err)
-		}
+		s.render(ctx, user, "users", data)
 	})
 }
 
 func (s *Session) handleUserVoted(msg Data) {
 	// logger.Info("new vote", "user", msg.MyUser.Name, "session", s.Id, "vote", msg.Vote)
 
+	if s.isRevealed() {
+		// the vote was cast while the round was being revealed
+		return
+	}
 	if s.allUsersVoted() {
-		totalEstimations.Inc()
-
-		votes := s.getVotes()
-		average := average(votes)
-		median := median(votes)
-		recommendation := recommendation(average, median, s.scale)
-
-		d := Data{
-			AllVoted:       true,
-			Average:        average,
-			Median:         median,
-			Recommendation: recommendation,
-		}
-		// logger.Info("all users voted", "session", s.Id, "average", average, "median", median, "recommendation", recommendation)
-
-		go s.executeAllUsers(func(user *User) {
-			var buf bytes.Buffer
+		s.reveal(msg)
+		return
+	}
 
-			data := d
-			data.MyUser = user
-			data.OtherUsers = s.getOtherUsers(user.Name)
+	s.updateSlackVoting()
 
-			err := templates.ExecuteTemplate(&buf, "users", data)
-			if err != nil {
-				// logger.Error("could not execute template", "template", "users", "session", s.Id, "user", user.Name, "error", err)
-			}
-
-			if err = user.Connection.Write(context.Background(), websocket.MessageText, buf.Bytes()); err != nil {
-				// logger.Error("could not write message to user", "message", buf.String(), "session", s.Id, "user", user.Name, "error", err)
-			}
+	go s.executeAllUsers(msg, func(ctx context.Context, user *User) {
+		s.render(ctx, user, "users", Data{
+			MyUser:     user,
+			OtherUsers: s.getOtherUsers(user.Id),
 		})
+	})
+}
+
+// reveal completes the current round and shows its result to all users.
+// Everyone has to have voted or abstained.
+func (s *Session) reveal(msg Data) {
+	round := s.newRound()
+	if !s.completeRound(round) {
+		// logger.Warn("round was revealed already", "session", s.Id)
 		return
 	}
 
-	go func() {
-		var buf bytes.Buffer
-		err := templates.ExecuteTemplate(&buf, "users", Data{
-			// TODO: Do we have a nil pointer here?
-			MyUser:     msg.MyUser,
-			OtherUsers: s.getOtherUsers(msg.MyUser.Name),
-		})
-		if err != nil {
-			// logger.Error("could not execute template", "template", "users", "session", s.Id, "user", msg.MyUser.Name, "error", err)
-		}
+	totalEstimations.Inc()
+	if votes := s.getVotes(); len(votes) > 0 {
+		voteSpread.Observe(float64(slices.Max(votes) - slices.Min(votes)))
+	}
 
-		if err = msg.MyUser.Connection.Write(context.Background(), websocket.MessageText, buf.Bytes()); err != nil {
-			// logger.Error("could not write message to user", "message", buf.String(), "session", s.Id, "user", msg.MyUser.Name, "error", err)
-		}
-	}()
+	countdown := s.stopCountdown()
 
-	go s.executeSubscribers(msg.MyUser.Name, func(user *User) {
-		var buf bytes.Buffer
-		err := templates.ExecuteTemplate(&buf, "users", Data{
-			MyUser:     user,
-			OtherUsers: s.getOtherUsers(user.Name),
-		})
-		if err != nil {
-			// logger.Error("could not execute template", "template", "users", "session", s.Id, "user", user.Name, "error", err)
-		}
+	d := resultData(round)
+	// logger.Info("all users voted", "session", s.Id, "average", round.Average, "median", round.Median, "recommendation", round.Recommendation)
+
+	go s.executeAllUsers(msg, func(ctx context.Context, user *User) {
+		data := d
+		data.MyUser = user
+		data.OtherUsers = s.getOtherUsers(user.Id)
+		data.Moderator = s.isModerator(user)
 
-		if err = user.Connection.Write(context.Background(), websocket.MessageText, buf.Bytes()); err != nil {
-			// logger.Error("could not write message to user", "message", buf.String(), "session", s.Id, "user", user.Name, "error", err)
+		s.render(ctx, user, "users", data)
+		if countdown {
+			s.render(ctx, user, "countdown", Data{})
 		}
 	})
 }
 
 func (s *Session) handleReset(msg Data) {
 	// logger.Info("restarting session", "session", s.Id, "user", msg.MyUser.Name)
+	s.Lock()
+	s.revoting = nil
+	s.Unlock()
+
+	s.restartRound(msg)
+}
+
+// restartRound clears the votes of all users and shows them the deck
+func (s *Session) restartRound(msg Data) {
+	s.stopCountdown()
+
+	s.Lock()
 	for _, user := range s.Users {
-		user.Vote = -1
+		user.Vote = noVote
+		user.Special = ""
 	}
-
-	go s.executeAllUsers(func(user *User) {
-		var buf bytes.Buffer
-		err := templates.ExecuteTemplate(&buf, "session-content", Data{
-			MyUser:      user,
-			OtherUsers:  s.getOtherUsers(user.Name),
-			Scale:       s.scale,
-			SessionId:   s.Id,
-			SessionName: s.Name,
+	s.revealed = nil
+	s.Unlock()
+
+	s.updateSlackVoting()
+
+	backlog := s.backlog()
+	issueTracker := s.issueTrackerSettings("", "")
+
+	go s.executeAllUsers(msg, func(ctx context.Context, user *User) {
+		s.render(ctx, user, "session-content", Data{
+			MyUser:       user,
+			Moderator:    s.isModerator(user),
+			Protected:    s.protected(),
+			OtherUsers:   s.getOtherUsers(user.Id),
+			Scale:        s.scale,
+			SessionId:    s.Id,
+			JoinCode:     s.JoinCode,
+			SessionName:  s.Name,
+			Backlog:      backlog,
+			IssueTracker: issueTracker,
+			Async:        s.asyncView(user),
 		})
-		if err != nil {
-			// logger.Error("could not execute template", "template", "users", "session", s.Id, "user", user.Name, "error", err)
-		}
+	})
+}
 
-		if err = user.Connection.Write(context.Background(), websocket.MessageText, buf.Bytes()); err != nil {
-			// logger.Error("could not write message to user", "message", buf.String(), "session", s.Id, "user", user.Name, "error", err)
-		}
+func (s *Session) handleBanner(msg Data) {
+	go s.executeAllUsers(msg, func(ctx context.Context, user *User) {
+		s.render(ctx, user, "banner", Data{
+			Banner: msg.Banner,
+		})
 	})
 }
 
-func (s *Session) executeAllUsers(action func(user *User)) {
+// render executes the template with the given name and writes the
+// result to the connection of user. Users without connection,
+// e.g. from Slack, are skipped.
+func (s *Session) render(ctx context.Context, user *User, name string, data Data) {
+	if user.Connection == nil {
+		return
+	}
+
+	ctx, span := tracer.Start(ctx, "Connection.Write", trace.WithAttributes(
+		attribute.String("template", name),
+		attribute.String("user.id", user.Id),
+	))
+	defer span.End()
+
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, data); err != nil {
+		// logger.Error("could not execute template", "template", name, "session", s.Id, "user", user.Name, "error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "could not execute template")
+		return
+	}
+
+	start := time.Now()
+	err := user.Connection.Write(ctx, buf.Bytes())
+	clientWriteDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		// logger.Error("could not write message to user", "message", buf.String(), "session", s.Id, "user", user.Name, "error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "could not write message")
+	}
+}
+
+// executeAllUsers runs action concurrently for every user of the session
+// and blocks until all of them are done.
+func (s *Session) executeAllUsers(msg Data, action func(ctx context.Context, user *User)) {
+	s.RLock()
+	users := make([]*User, 0, len(s.Users))
 	for _, user := range s.Users {
-		go action(user)
+		users = append(users, user)
 	}
+	s.RUnlock()
+
+	s.execute(msg, users, action)
+}
+
+// executeSubscribers runs action concurrently for every user except the
+// publisher of msg and blocks until all of them are done.
+func (s *Session) executeSubscribers(msg Data, action func(ctx context.Context, user *User)) {
+	s.execute(msg, s.getOtherUsers(msg.MyUser.Id), action)
 }
 
-func (s *Session) executeSubscribers(publisher string, action func(user *User)) {
-	for _, user := range s.getOtherUsers(publisher) {
-		go action(user)
+func (s *Session) execute(msg Data, users []*User, action func(ctx context.Context, user *User)) {
+	ctx, span := tracer.Start(msg.ctx, "Session.broadcast", trace.WithAttributes(sessionAttributes(s)...))
+	span.SetAttributes(attribute.Int("recipients", len(users)))
+	defer span.End()
+
+	var wg sync.WaitGroup
+	for _, user := range users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			action(ctx, user)
+		}()
 	}
+	wg.Wait()
+
+	broadcastDuration.WithLabelValues(msg.event.String()).Observe(time.Since(msg.publishedAt).Seconds())
 }
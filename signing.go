@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// signingKeys are used to sign tokens handed out to clients. The first key
+// signs new tokens, all keys are accepted when verifying. This allows to
+// rotate keys by prepending a new one and removing the oldest one later.
+//
+// The keys are set from the configuration on startup. Without
+// configuration, a random key is used and all tokens become invalid when
+// the server restarts.
+var signingKeys = [][]byte{newRandomKey()}
+
+func newRandomKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func mac(key []byte, payload []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(payload)
+	return m.Sum(nil)
+}
+
+// sign returns payload together with its HMAC, so that it can be handed
+// out to clients and verified when it comes back.
+func sign(payload string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac(signingKeys[0], []byte(payload)))
+}
+
+// verify returns the payload of a token created by sign. ok is false if
+// the token was not signed with any of the signingKeys. current is false
+// if it was signed with a retired key and should be reissued.
+func verify(token string) (payload string, current bool, ok bool) {
+	encPayload, encSig, found := strings.Cut(token, ".")
+	if !found {
+		return "", false, false
+	}
+
+	p, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return "", false, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil {
+		return "", false, false
+	}
+
+	for i, key := range signingKeys {
+		if hmac.Equal(sig, mac(key, p)) {
+			return string(p), i == 0, true
+		}
+	}
+
+	return "", false, false
+}
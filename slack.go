@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The slash command /poker <story> creates a session and posts a message
+// with a button for every card to the channel. Slack users join the session
+// with their first click. They don't have a websocket connection, but vote
+// in the same session as users of the web UI, which can join with the link
+// in the message. Once everyone has voted, or the user that started the
+// session reveals the votes, the message is replaced with the result.
+
+// slackMaxAge is how old the timestamp of a request may be, to prevent
+// replays of recorded requests
+const slackMaxAge = 5 * time.Minute
+
+// slackMaxBodySize is the maximum size of requests from Slack
+const slackMaxBodySize = 64 << 10
+
+// slackThread is the Slack message of a session. Its fields are guarded by
+// the lock of the session.
+type slackThread struct {
+	// responseURL is the response URL of the last interaction. Each one
+	// can only be used a few times, so it is replaced with every click.
+	responseURL string
+	// link opens the session in the browser
+	link string
+}
+
+var slackHTTP httpDoer = &http.Client{Timeout: integrationTimeout}
+
+var errInvalidSlackSignature = errors.New("invalid slack signature")
+
+// verifySlackRequest reads the body of r and checks its signature
+func verifySlackRequest(r *http.Request) (url.Values, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, slackMaxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errInvalidSlackSignature
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > slackMaxAge || age < -slackMaxAge {
+		return nil, errInvalidSlackSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(config.Slack.SigningSecret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Slack-Signature"))) {
+		return nil, errInvalidSlackSignature
+	}
+
+	return url.ParseQuery(string(body))
+}
+
+// validResponseURL only allows to post to Slack
+func validResponseURL(responseURL string) bool {
+	return strings.HasPrefix(responseURL, config.Slack.ResponseURLPrefix)
+}
+
+// slackUserId is the participant id of a Slack user
+func slackUserId(team string, user string) string {
+	return "slack-" + team + "-" + user
+}
+
+func slackUserName(name string, id string) string {
+	if name, err := validateUserName(name); err == nil {
+		return name
+	}
+	return id
+}
+
+// slackEscape escapes the characters Slack interprets in mrkdwn
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func slackText(text string) map[string]any {
+	return map[string]any{"type": "mrkdwn", "text": text}
+}
+
+func slackButton(text string, actionId string, value string) map[string]any {
+	return map[string]any{
+		"type":      "button",
+		"text":      map[string]any{"type": "plain_text", "text": text},
+		"action_id": actionId,
+		"value":     value,
+	}
+}
+
+func slackLinkButton(text string, link string) map[string]any {
+	return map[string]any{
+		"type":      "button",
+		"text":      map[string]any{"type": "plain_text", "text": text},
+		"action_id": "open",
+		"url":       link,
+	}
+}
+
+// slackVoting is the message that is shown while the votes are hidden
+func (s *Session) slackVoting() map[string]any {
+	s.RLock()
+	var voted, waiting []string
+	for _, user := range s.Users {
+		if user.Voted() {
+			voted = append(voted, slackEscape(user.Name))
+		} else {
+			waiting = append(waiting, slackEscape(user.Name))
+		}
+	}
+	link := s.slack.link
+	s.RUnlock()
+	slices.Sort(voted)
+	slices.Sort(waiting)
+
+	status := "Nobody voted yet"
+	if len(voted) > 0 {
+		status = "Voted: " + strings.Join(voted, ", ")
+	}
+	if len(waiting) > 0 {
+		status += " · Waiting for: " + strings.Join(waiting, ", ")
+	}
+
+	cards := make([]any, 0, len(s.scale.Cards)+len(s.scale.Special))
+	for _, card := range s.scale.Cards {
+		value := strconv.Itoa(card)
+		cards = append(cards, slackButton(value, "vote-"+value, s.Id+":"+value))
+	}
+	for i, card := range s.scale.Special {
+		cards = append(cards, slackButton(card, "vote-special-"+strconv.Itoa(i), s.Id+":"+card))
+	}
+
+	return map[string]any{
+		"response_type": "in_channel",
+		"text":          "Pointing Poker: " + s.Name,
+		"blocks": []any{
+			map[string]any{"type": "section", "text": slackText("*" + slackEscape(s.Name) + "*")},
+			map[string]any{"type": "context", "elements": []any{slackText(status)}},
+			map[string]any{"type": "actions", "elements": cards},
+			map[string]any{"type": "actions", "elements": []any{
+				slackButton("Reveal", "reveal", s.Id),
+				slackLinkButton("Open in browser", link),
+			}},
+		},
+	}
+}
+
+// slackResult is the message that shows the votes of round
+func (s *Session) slackResult(round Round) map[string]any {
+	var votes strings.Builder
+	for _, voter := range round.voters() {
+		fmt.Fprintf(&votes, "%s: *%d*%s\n", slackEscape(voter.Name), round.Votes[voter.Id].Vote, round.changeOf(voter.Id))
+	}
+	for _, voter := range round.Abstained {
+		fmt.Fprintf(&votes, "%s: ?\n", slackEscape(voter.Name))
+	}
+
+	summary := "Nobody voted"
+	if len(round.Votes) > 0 {
+		summary = fmt.Sprintf("Average *%.1f* · Median *%.1f* · Recommendation *%d*", round.Average, round.Median, round.Recommendation)
+	}
+	switch {
+	case len(round.Votes) == 0:
+	case round.Consensus == consensusUnanimous:
+		summary += "\nConsensus!"
+	case round.Consensus == consensusNear:
+		summary += "\nAlmost a consensus, all votes are within one card."
+	default:
+		summary += "\nNo consensus. Let's hear from the extremes."
+	}
+
+	s.RLock()
+	link := s.slack.link
+	s.RUnlock()
+
+	return map[string]any{
+		"response_type": "in_channel",
+		"text":          "Pointing Poker: " + s.Name,
+		"blocks": []any{
+			map[string]any{"type": "section", "text": slackText("*" + slackEscape(s.Name) + "*")},
+			map[string]any{"type": "section", "text": slackText(votes.String())},
+			map[string]any{"type": "section", "text": slackText(summary)},
+			map[string]any{"type": "actions", "elements": []any{
+				slackButton("Vote again", "revote", s.Id),
+				slackLinkButton("Open in browser", link),
+			}},
+		},
+	}
+}
+
+// postSlackMessage replaces the message of session via the last response URL
+func (s *Session) postSlackMessage(ctx context.Context, message map[string]any) error {
+	s.RLock()
+	responseURL := s.slack.responseURL
+	s.RUnlock()
+
+	message["replace_original"] = true
+	b, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, responseURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := slackHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("slack responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// postSlackResult is a round hook that shows the result in the Slack
+// message of sessions started from Slack
+func postSlackResult(ctx context.Context, session *Session, story *Story, round Round) {
+	if session.slack == nil {
+		return
+	}
+
+	if err := session.postSlackMessage(ctx, session.slackResult(round)); err != nil {
+		// logger.Error("could not post result to slack", "session", session.Id, "error", err)
+	}
+}
+
+// slackEphemeral answers only to the user that sent the request
+func slackEphemeral(w http.ResponseWriter, text string) {
+	writeJSON(w, http.StatusOK, map[string]any{"response_type": "ephemeral", "text": text})
+}
+
+func postSlackCommand(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("POST /slack/commands").Inc()
+
+	form, err := verifySlackRequest(r)
+	if err != nil {
+		// logger.Warn("rejecting slack command", "error", err)
+		http.Error(w, "invalid request", http.StatusUnauthorized)
+		return
+	}
+
+	name, err := validateSessionName(form.Get("text"))
+	if err != nil {
+		slackEphemeral(w, "Usage: /poker <story>")
+		return
+	}
+
+	responseURL := form.Get("response_url")
+	if !validResponseURL(responseURL) {
+		http.Error(w, "invalid response url", http.StatusBadRequest)
+		return
+	}
+
+	moderator := &User{
+		Id:   slackUserId(form.Get("team_id"), form.Get("user_id")),
+		Name: slackUserName(form.Get("user_name"), form.Get("user_id")),
+		Vote: noVote,
+	}
+
+	scale, ok := scales.Get(config.Slack.Scale)
+	if !ok {
+		// logger.Error("unknown slack scale", "scale", config.Slack.Scale)
+		slackEphemeral(w, "Could not start a session: the scale "+config.Slack.Scale+" does not exist")
+		return
+	}
+	session := newSessionState(name, moderator.Id, scale, config.Expiry)
+	session.slack = &slackThread{responseURL: responseURL}
+	if err := startSession(session); err != nil {
+		slackEphemeral(w, "Could not start a session: "+err.Error())
+		return
+	}
+
+	session.Lock()
+	session.slack.link = publicURL(r) + "/" + session.Id
+	session.Unlock()
+	session.addUser(moderator)
+
+	// logger.Info("session started from slack", "session", session.Id, "user", moderator.Id)
+	writeJSON(w, http.StatusOK, session.slackVoting())
+}
+
+type slackInteraction struct {
+	Type string `json:"type"`
+	User struct {
+		Id       string `json:"id"`
+		Username string `json:"username"`
+		Name     string `json:"name"`
+		TeamId   string `json:"team_id"`
+	} `json:"user"`
+	Team struct {
+		Id string `json:"id"`
+	} `json:"team"`
+	Actions []struct {
+		ActionId string `json:"action_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+	ResponseURL string `json:"response_url"`
+}
+
+func postSlackInteraction(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("POST /slack/interactions").Inc()
+
+	form, err := verifySlackRequest(r)
+	if err != nil {
+		// logger.Warn("rejecting slack interaction", "error", err)
+		http.Error(w, "invalid request", http.StatusUnauthorized)
+		return
+	}
+
+	var interaction slackInteraction
+	if err := json.Unmarshal([]byte(form.Get("payload")), &interaction); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	if interaction.Type != "block_actions" || len(interaction.Actions) == 0 || !validResponseURL(interaction.ResponseURL) {
+		// Slack expects a 200 for interactions it doesn't need an answer to
+		return
+	}
+
+	action := interaction.Actions[0]
+	if action.ActionId == "open" {
+		return
+	}
+
+	sessionId, value, _ := strings.Cut(action.Value, ":")
+	session, ok := getSessionById(sessionId)
+	if !ok || session.slack == nil {
+		slackEphemeral(w, "This session has ended.")
+		return
+	}
+
+	team := interaction.Team.Id
+	if team == "" {
+		team = interaction.User.TeamId
+	}
+	user := session.slackParticipant(
+		slackUserId(team, interaction.User.Id),
+		slackUserName(cmp.Or(interaction.User.Username, interaction.User.Name), interaction.User.Id),
+	)
+	if user == nil {
+		slackEphemeral(w, "This session is full.")
+		return
+	}
+
+	session.Lock()
+	session.slack.responseURL = interaction.ResponseURL
+	session.Unlock()
+
+	ctx := r.Context()
+
+	switch {
+	case strings.HasPrefix(action.ActionId, "vote-"):
+		vote, special, err := parseVote(session.scale, value)
+		if err != nil {
+			return
+		}
+		session.Lock()
+		if session.revealed != nil {
+			session.Unlock()
+			slackEphemeral(w, "The votes have been revealed already. Vote again to start a new round.")
+			return
+		}
+		user.Vote = vote
+		user.Special = special
+		session.Unlock()
+
+		session.publish(Data{ctx: ctx, event: USER_VOTED, MyUser: user})
+	case action.ActionId == "reveal":
+		if !session.isModerator(user) {
+			slackEphemeral(w, "Only the user that started the session can reveal the votes.")
+			return
+		}
+		session.publish(Data{ctx: ctx, event: REVEAL, MyUser: user})
+	case action.ActionId == "revote":
+		session.publish(Data{ctx: ctx, event: REVOTE, MyUser: user})
+	}
+}
+
+// updateSlackVoting shows who has voted in the Slack message of sessions
+// started from Slack. The result is posted by postSlackResult.
+func (s *Session) updateSlackVoting() {
+	if s.slack == nil {
+		return
+	}
+
+	message := s.slackVoting()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), integrationTimeout)
+		defer cancel()
+
+		if err := s.postSlackMessage(ctx, message); err != nil {
+			// logger.Error("could not update slack message", "session", s.Id, "error", err)
+		}
+	}()
+}
+
+// slackParticipant returns the user with id, which is added to the
+// session if it votes for the first time. It is nil if the session is full.
+func (s *Session) slackParticipant(id string, name string) *User {
+	s.RLock()
+	user, ok := s.Users[id]
+	s.RUnlock()
+	if ok {
+		return user
+	}
+
+	user = &User{Id: id, Name: name, Vote: noVote}
+	if s.full(user) {
+		return nil
+	}
+
+	s.addUser(user)
+	s.publish(Data{event: USER_JOINED, MyUser: user})
+	return user
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSlackSecret = "8f742231b10e8888abcd99yyyzzz85a5"
+
+// newSlackTestServer serves the routes with the Slack integration. The
+// messages posted to response URLs are passed on to the returned channel.
+func newSlackTestServer(t *testing.T) (server *httptest.Server, responseURL string, messages <-chan string) {
+	t.Helper()
+
+	posted := make(chan string, 16)
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		posted <- string(body)
+	}))
+	t.Cleanup(slack.Close)
+
+	server = newTestServer(t, func(c *Config) {
+		c.Slack = SlackConfig{SigningSecret: testSlackSecret, ResponseURLPrefix: slack.URL + "/", Scale: defaultScale}
+	})
+
+	hooks := roundHooks
+	roundHooks = []RoundHook{postSlackResult}
+	t.Cleanup(func() { roundHooks = hooks })
+
+	return server, slack.URL + "/actions/T1", posted
+}
+
+// slackRequest returns a request of form to u, signed with secret at
+// timestamp
+func slackRequest(u string, form url.Values, secret string, timestamp time.Time) *http.Request {
+	body := form.Encode()
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + ts + ":" + body))
+
+	r, _ := http.NewRequest(http.MethodPost, u, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Slack-Request-Timestamp", ts)
+	r.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+// postSlack sends form to u, signed with secret at timestamp
+func postSlack(t *testing.T, u string, form url.Values, secret string, timestamp time.Time) *http.Response {
+	t.Helper()
+
+	resp, err := http.DefaultClient.Do(slackRequest(u, form, secret, timestamp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func slackCommand(text string, user string, responseURL string) url.Values {
+	return url.Values{
+		"command":      {"/poker"},
+		"text":         {text},
+		"team_id":      {"T1"},
+		"user_id":      {user},
+		"user_name":    {strings.ToLower(user)},
+		"response_url": {responseURL},
+	}
+}
+
+// slackClick is the interaction of user clicking the button with the
+// given action and value
+func slackClick(user string, action string, value string, responseURL string) url.Values {
+	payload, _ := json.Marshal(map[string]any{
+		"type":         "block_actions",
+		"user":         map[string]string{"id": user, "username": strings.ToLower(user), "team_id": "T1"},
+		"team":         map[string]string{"id": "T1"},
+		"actions":      []map[string]string{{"action_id": action, "value": value}},
+		"response_url": responseURL,
+	})
+	return url.Values{"payload": {string(payload)}}
+}
+
+func decodeSlack(t *testing.T, resp *http.Response) map[string]any {
+	t.Helper()
+
+	var message map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestSlackSignature(t *testing.T) {
+	server, responseURL, _ := newSlackTestServer(t)
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp time.Time
+		want      int
+	}{
+		{"valid", testSlackSecret, time.Now(), http.StatusOK},
+		{"bad signature", "wrong secret", time.Now(), http.StatusUnauthorized},
+		{"stale timestamp", testSlackSecret, time.Now().Add(-10 * time.Minute), http.StatusUnauthorized},
+		{"timestamp in the future", testSlackSecret, time.Now().Add(10 * time.Minute), http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, path := range []string{"/slack/commands", "/slack/interactions"} {
+				form := slackCommand("Signature "+tt.name, "U1", responseURL)
+				if path == "/slack/interactions" {
+					form = slackClick("U1", "open", "", responseURL)
+				}
+
+				resp := postSlack(t, server.URL+path, form, tt.secret, tt.timestamp)
+				if resp.StatusCode != tt.want {
+					t.Errorf("%s responded with %d, want %d", path, resp.StatusCode, tt.want)
+				}
+			}
+			if tt.want == http.StatusOK {
+				slackSession(t, "Signature "+tt.name)
+			}
+		})
+	}
+}
+
+func TestSlackCommand(t *testing.T) {
+	server, responseURL, _ := newSlackTestServer(t)
+
+	resp := postSlack(t, server.URL+"/slack/commands", slackCommand("", "U1", responseURL), testSlackSecret, time.Now())
+	if message := decodeSlack(t, resp); message["response_type"] != "ephemeral" || message["text"] != "Usage: /poker <story>" {
+		t.Errorf("command without story answered %v", message)
+	}
+
+	resp = postSlack(t, server.URL+"/slack/commands", slackCommand("Login", "U1", "https://evil.example.com/"), testSlackSecret, time.Now())
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("command with foreign response URL responded with %d", resp.StatusCode)
+	}
+
+	resp = postSlack(t, server.URL+"/slack/commands", slackCommand("Command test", "U1", responseURL), testSlackSecret, time.Now())
+	message := decodeSlack(t, resp)
+	if message["response_type"] != "in_channel" || message["text"] != "Pointing Poker: Command test" {
+		t.Errorf("command answered %v", message)
+	}
+
+	session := slackSession(t, "Command test")
+	session.RLock()
+	moderator := session.Users[slackUserId("T1", "U1")]
+	session.RUnlock()
+	if moderator == nil || moderator.Name != "u1" || !session.isModerator(moderator) {
+		t.Errorf("moderator = %+v", moderator)
+	}
+}
+
+func TestSlackScale(t *testing.T) {
+	server, responseURL, _ := newSlackTestServer(t)
+
+	config.Slack.Scale = "workingdays"
+	postSlack(t, server.URL+"/slack/commands", slackCommand("Scale test", "U1", responseURL), testSlackSecret, time.Now())
+	if session := slackSession(t, "Scale test"); session.scale.Name != "workingdays" {
+		t.Errorf("session has scale %s, want workingdays", session.scale.Name)
+	}
+
+	config.Slack.Scale = "missing"
+	resp := postSlack(t, server.URL+"/slack/commands", slackCommand("Missing scale", "U1", responseURL), testSlackSecret, time.Now())
+	if message := decodeSlack(t, resp); message["response_type"] != "ephemeral" {
+		t.Errorf("command with missing scale answered %v", message)
+	}
+	for _, session := range listSessions() {
+		if session.Name == "Missing scale" {
+			t.Error("a session was started without a scale")
+		}
+	}
+}
+
+// slackSession returns the session started with /poker name
+func slackSession(t *testing.T, name string) *Session {
+	t.Helper()
+
+	for _, session := range listSessions() {
+		if session.Name == name && session.slack != nil {
+			t.Cleanup(func() { session.publish(Data{event: CLOSED}) })
+			return session
+		}
+	}
+	t.Fatalf("no session %s", name)
+	return nil
+}
+
+func TestSlackVoting(t *testing.T) {
+	server, responseURL, messages := newSlackTestServer(t)
+	interactions := server.URL + "/slack/interactions"
+
+	postSlack(t, server.URL+"/slack/commands", slackCommand("Voting test", "U1", responseURL), testSlackSecret, time.Now())
+	session := slackSession(t, "Voting test")
+
+	click := func(user string, action string, value string) *http.Response {
+		t.Helper()
+		return postSlack(t, interactions, slackClick(user, action, session.Id+":"+value, responseURL), testSlackSecret, time.Now())
+	}
+	ephemeral := func(resp *http.Response, want string) {
+		t.Helper()
+		if message := decodeSlack(t, resp); message["response_type"] != "ephemeral" || !strings.HasPrefix(message["text"].(string), want) {
+			t.Errorf("answered %v, want %q", message, want)
+		}
+	}
+
+	// the first click lets U2 join
+	if resp := click("U2", "vote-8", "8"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("vote responded with %d", resp.StatusCode)
+	}
+	receive(t, messages, "Waiting for: u1")
+
+	ephemeral(click("U2", "reveal", ""), "Only the user that started the session")
+
+	click("U1", "vote-5", "5")
+	result := receive(t, messages, "u1: *5*")
+	if !strings.Contains(result, "u2: *8*") || !strings.Contains(result, `"replace_original":true`) {
+		t.Errorf("result = %s", result)
+	}
+
+	ephemeral(click("U2", "vote-3", "3"), "The votes have been revealed already")
+
+	// a new round lets everyone vote again
+	click("U2", "revote", "")
+	waitFor(t, "the new round", func() bool { return !session.isRevealed() })
+	click("U2", "vote-special-0", "?")
+	receive(t, messages, "Voted: u2 · Waiting for: u1")
+
+	click("U1", "reveal", "")
+	result = receive(t, messages, "u2: ?")
+	if !strings.Contains(result, "u1: ?") || !strings.Contains(result, "Nobody voted") {
+		t.Errorf("result = %s", result)
+	}
+}
+
+func TestSlackInteractionForEndedSession(t *testing.T) {
+	server, responseURL, _ := newSlackTestServer(t)
+
+	resp := postSlack(t, server.URL+"/slack/interactions", slackClick("U1", "vote-5", "missing:5", responseURL), testSlackSecret, time.Now())
+	if message := decodeSlack(t, resp); message["text"] != "This session has ended." {
+		t.Errorf("answered %v", message)
+	}
+}
+
+func TestSlackSessionLink(t *testing.T) {
+	tests := []struct {
+		name      string
+		publicURL string
+		want      func(server string) string
+	}{
+		{"from the request", "", func(server string) string { return server }},
+		{"public URL", "https://poker.example.com/", func(string) string { return "https://poker.example.com" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, responseURL, _ := newSlackTestServer(t)
+			config.Security.PublicURL = tt.publicURL
+
+			// the header of a proxy is sent by the client and not trusted
+			r := slackRequest(server.URL+"/slack/commands", slackCommand("Link "+tt.name, "U1", responseURL), testSlackSecret, time.Now())
+			r.Header.Set("X-Forwarded-Proto", "https")
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			session := slackSession(t, "Link "+tt.name)
+			session.RLock()
+			link := session.slack.link
+			session.RUnlock()
+			if want := tt.want(server.URL) + "/" + session.Id; link != want {
+				t.Errorf("link = %s, want %s", link, want)
+			}
+		})
+	}
+}
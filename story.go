@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// A session can have a list of stories that are estimated one after the
+// other. Stories are imported from issue trackers or CSV files by the
+// moderator. When a round is completed, its recommendation becomes the
+// estimate of the current story and is handed to the round hooks, which
+// e.g. write it back to the tracker.
+
+// maxStories is the maximum number of stories in the list of a session
+const maxStories = 200
+
+// maxDescriptionLength is the number of characters of a description that
+// are shown during voting
+const maxDescriptionLength = 2000
+
+// Story is an item of the story list of a session
+type Story struct {
+	// Key identifies the story in its source, e.g. PROJ-123
+	Key         string `json:"key"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Link        string `json:"link,omitempty"`
+	// Source is the tracker the story was imported from
+	Source string `json:"source,omitempty"`
+	// Estimate is the recommendation of the last completed round
+	Estimate int `json:"estimate,omitempty"`
+	// Rounds are the completed rounds of the story, one per re-vote
+	Rounds []Round `json:"rounds,omitempty"`
+}
+
+// Backlog is the part of the story list that is shown to the users
+type Backlog struct {
+	// Current is a copy of the story that is estimated right now
+	Current *Story
+	// Number is the position of Current in the story list, starting at 1
+	Number int
+	Total  int
+}
+
+// RoundHook is called after a round of session was completed. story is a
+// copy of the story the round belongs to and nil if there is none. Hooks
+// run in their own goroutine, so they may block.
+type RoundHook func(ctx context.Context, session *Session, story *Story, round Round)
+
+// roundHooks are registered on startup
+var roundHooks []RoundHook
+
+// roundHookTimeout limits how long a hook may take
+const roundHookTimeout = 30 * time.Second
+
+func runRoundHooks(session *Session, story *Story, round Round) {
+	runHooks(roundHooks, session, story, round)
+}
+
+func runHooks(hooks []RoundHook, session *Session, story *Story, round Round) {
+	for _, hook := range hooks {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), roundHookTimeout)
+			defer cancel()
+			hook(ctx, session, story, round)
+		}()
+	}
+}
+
+// addStories appends stories to the story list and returns how many were
+// added. Stories that are already in the list are skipped. If no story was
+// being estimated, the first new one becomes the current story.
+func (s *Session) addStories(stories []*Story) int {
+	s.Lock()
+	defer s.Unlock()
+
+	added := 0
+	for _, story := range stories {
+		if len(s.stories) >= maxStories {
+			break
+		}
+		if s.hasStory(story) {
+			continue
+		}
+		story.Description = truncate(story.Description, maxDescriptionLength)
+		s.stories = append(s.stories, story)
+		added++
+	}
+	return added
+}
+
+// hasStory reports whether story is in the list. s has to be locked by the
+// caller.
+func (s *Session) hasStory(story *Story) bool {
+	return slices.ContainsFunc(s.stories, func(existing *Story) bool {
+		return sameStory(existing, story)
+	})
+}
+
+// sameStory reports whether a and b have the same source and key. Stories
+// without key, e.g. from CSV files, are compared by title and link.
+func sameStory(a *Story, b *Story) bool {
+	if a.Source != b.Source || a.Key != b.Key {
+		return false
+	}
+	return a.Key != "" || (a.Title == b.Title && a.Link == b.Link)
+}
+
+// currentStory returns the story that is estimated right now. s has to be
+// locked by the caller.
+func (s *Session) currentStory() *Story {
+	if s.story >= len(s.stories) {
+		return nil
+	}
+	return s.stories[s.story]
+}
+
+func (s *Session) backlog() Backlog {
+	s.RLock()
+	defer s.RUnlock()
+
+	backlog := Backlog{Total: len(s.stories)}
+	if story := s.currentStory(); story != nil {
+		current := *story
+		backlog.Current = &current
+		backlog.Number = s.story + 1
+	}
+	return backlog
+}
+
+// estimate sets the estimate of the current story to the recommendation
+// of round and returns a copy of the story, or nil if there is none. The
+// caller has to hold the lock of the session.
+func (s *Session) estimate(round *Round) *Story {
+	story := s.currentStory()
+	if story == nil {
+		return nil
+	}
+
+	round.Story = story.Key
+	if len(round.Votes) > 0 {
+		story.Estimate = round.Recommendation
+	}
+	story.Rounds = append(story.Rounds, *round)
+	estimated := *story
+	estimated.Rounds = slices.Clone(story.Rounds)
+	return &estimated
+}
+
+func (s *Session) handleStoriesAdded(msg Data) {
+	backlog := s.backlog()
+
+	go s.executeAllUsers(msg, func(ctx context.Context, user *User) {
+		s.render(ctx, user, "story", Data{
+			Backlog:   backlog,
+			Moderator: s.isModerator(user),
+		})
+	})
+}
+
+// handleNextStory moves on to the next story and starts a new round
+func (s *Session) handleNextStory(msg Data) {
+	if !s.isModerator(msg.MyUser) {
+		// logger.Warn("user tried to move to the next story without being moderator", "session", s.Id, "user", msg.MyUser.Name)
+		return
+	}
+
+	s.Lock()
+	if s.story < len(s.stories) {
+		s.story++
+	}
+	s.Unlock()
+
+	s.handleReset(msg)
+}
+
+// importStories adds stories to session and shows the moderator how many
+// were imported. Errors of the tracker are shown to the moderator as well.
+func importStories(w http.ResponseWriter, session *Session, user *User, source string, stories []*Story, err error) {
+	data := Data{}
+	if err != nil {
+		// logger.Warn("could not import stories", "session", session.Id, "source", source, "error", err)
+		data.Error = "Could not import stories: " + err.Error()
+	} else if settings := session.asyncSettings(); settings != nil {
+		data.Imported = session.queueStories(*settings, stories)
+		session.publish(Data{event: ASYNC_CHANGED, MyUser: user})
+	} else {
+		data.Imported = session.addStories(stories)
+		session.publish(Data{event: STORIES_ADDED, MyUser: user})
+	}
+
+	if err := templates.ExecuteTemplate(w, "import-result", data); err != nil {
+		// logger.Error("could not execute template", "template", "import-result", "session", session.Id, "error", err)
+	}
+}
+
+func (d Data) JiraEnabled() bool {
+	return jira != nil && canImportJira(d.MyUser)
+}
+
+// moderatorSession returns the session of the request if the user is its
+// moderator. Otherwise an error is written and ok is false.
+func moderatorSession(w http.ResponseWriter, r *http.Request) (session *Session, user *User, ok bool) {
+	session, ok = getSessionById(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	user = identify(w, r)
+	if !session.isModerator(user) || !session.hasAccess(r) {
+		http.Error(w, "only the moderator can import stories", http.StatusForbidden)
+		return nil, nil, false
+	}
+	return session, user, true
+}
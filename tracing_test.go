@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spans collects the spans of the tests. The global tracer delegates to
+// the first provider that is installed, so it is installed only once.
+var spans = sync.OnceValue(func() *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	installTracerProvider(exporter, TracingConfig{ServiceName: "pointing-poker", SampleRatio: 1})
+	return exporter
+})
+
+// findSpan flushes the provider until a span with the given name that
+// matches was exported
+func findSpan(t *testing.T, exporter *tracetest.InMemoryExporter, name string, match func(tracetest.SpanStub) bool) tracetest.SpanStub {
+	t.Helper()
+
+	tp := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		tp.ForceFlush(context.Background())
+		for _, span := range exporter.GetSpans() {
+			if span.Name == name && match(span) {
+				return span
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no span named %q", name)
+	return tracetest.SpanStub{}
+}
+
+func attributeOf(span tracetest.SpanStub, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestTracing(t *testing.T) {
+	exporter := spans()
+	exporter.Reset()
+
+	server := newTestServer(t)
+	session := startTestSession(t, "alice-id")
+
+	_, aliceMessages := dialWebsocket(t, server, session, identityCookie("alice-id", "Alice"))
+	bob := identityCookie("bob-id", "Bob")
+	openEventStream(t, server, session, bob)
+	receive(t, aliceMessages, "Bob")
+
+	resp := postForm(t, server.URL+"/sse/"+session.Id+"/vote", url.Values{"vote": {"8"}}, bob)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("vote responded with %d", resp.StatusCode)
+	}
+
+	request := findSpan(t, exporter, "POST /sse/{sessionId}/vote", func(span tracetest.SpanStub) bool {
+		path, _ := attributeOf(span, "url.path")
+		return path.AsString() == "/sse/"+session.Id+"/vote"
+	})
+	if request.SpanKind != trace.SpanKindServer {
+		t.Errorf("span kind = %v, want %v", request.SpanKind, trace.SpanKindServer)
+	}
+	want := map[attribute.Key]attribute.Value{
+		"http.request.method":       attribute.StringValue(http.MethodPost),
+		"http.route":                attribute.StringValue("POST /sse/{sessionId}/vote"),
+		"url.path":                  attribute.StringValue("/sse/" + session.Id + "/vote"),
+		"http.response.status_code": attribute.IntValue(http.StatusNoContent),
+	}
+	for key, value := range want {
+		if got, ok := attributeOf(request, key); !ok || got != value {
+			t.Errorf("request span %s = %v, want %v", key, got.Emit(), value.Emit())
+		}
+	}
+
+	// the event published by the request continues its trace
+	event := findSpan(t, exporter, "Session.handleEvent", func(span tracetest.SpanStub) bool {
+		return span.Parent.SpanID() == request.SpanContext.SpanID()
+	})
+	want = map[attribute.Key]attribute.Value{
+		"session.id":    attribute.StringValue(session.Id),
+		"session.event": attribute.StringValue(USER_VOTED.String()),
+	}
+	for key, value := range want {
+		if got, ok := attributeOf(event, key); !ok || got != value {
+			t.Errorf("event span %s = %v, want %v", key, got.Emit(), value.Emit())
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"nhooyr.io/websocket"
+)
+
+// Some proxies block websockets. Clients behind them fall back to a stream
+// of server-sent events for updates and send votes and button clicks as
+// plain POST requests. Both transports feed the same event pipeline of the
+// session and receive the same rendered templates.
+
+// Conn delivers rendered templates to a user
+type Conn interface {
+	Write(ctx context.Context, msg []byte) error
+	// Close ends the connection, e.g. when the session ends
+	Close(reason string) error
+}
+
+type wsConn struct {
+	c *websocket.Conn
+}
+
+func (w wsConn) Write(ctx context.Context, msg []byte) error {
+	return w.c.Write(ctx, websocket.MessageText, msg)
+}
+
+func (w wsConn) Close(reason string) error {
+	return w.c.Close(websocket.StatusNormalClosure, reason)
+}
+
+// sseBuffer is the number of messages that are queued for a stream
+const sseBuffer = 32
+
+// sseHeartbeat keeps proxies from closing idle streams
+const sseHeartbeat = 25 * time.Second
+
+var errStreamClosed = errors.New("event stream closed")
+
+// sseConn queues messages for the handler of an event stream
+type sseConn struct {
+	messages  chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	reason    string
+	// limiter limits the POST requests of the user, like the messages of
+	// a websocket connection
+	limiter *rate.Limiter
+}
+
+func newSSEConn() *sseConn {
+	return &sseConn{
+		messages: make(chan []byte, sseBuffer),
+		done:     make(chan struct{}),
+		limiter:  rate.NewLimiter(perSecondLimit(config.Limits.MessageRate), config.Limits.MessageBurst),
+	}
+}
+
+func (c *sseConn) Write(ctx context.Context, msg []byte) error {
+	select {
+	case c.messages <- msg:
+		return nil
+	case <-c.done:
+		return errStreamClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *sseConn) Close(reason string) error {
+	c.closeOnce.Do(func() {
+		c.reason = reason
+		close(c.done)
+	})
+	return nil
+}
+
+// writeSSE writes msg as one event. Every line of msg becomes a data line.
+func writeSSE(w http.ResponseWriter, event string, msg string) error {
+	var b strings.Builder
+	if event != "" {
+		b.WriteString("event: " + event + "\n")
+	}
+	for _, line := range strings.Split(msg, "\n") {
+		b.WriteString("data: " + strings.TrimSuffix(line, "\r") + "\n")
+	}
+	b.WriteString("\n")
+
+	if _, err := w.Write([]byte(b.String())); err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+// admitUser returns the session of the request and the user that wants to
+// connect to it. Otherwise an error is written and ok is false.
+func admitUser(w http.ResponseWriter, r *http.Request) (session *Session, user *User, ok bool) {
+	sessionId := r.PathValue("id")
+
+	user = identify(w, r)
+	if user.Id == "" {
+		// logger.Error("identity cookie not set or invalid. Could not join session")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("identity cookie not set or invalid. Could not join session"))
+		return nil, nil, false
+	}
+
+	session, ok = getSessionById(sessionId)
+	if !ok {
+		// logger.Warn("session does not exist", "session", sessionId)
+		w.WriteHeader(http.StatusNotFound)
+
+		err := templateNotFound.Execute(w, Data{
+			SessionId: sessionId,
+		})
+		if err != nil {
+			// logger.Error("could not execute template", "template", "not-found", "error", err, "session", sessionId)
+		}
+		return nil, nil, false
+	}
+
+	if !session.admits(user) {
+		// logger.Warn("user is not admitted to session", "session", sessionId, "user", user.Name)
+		http.Error(w, "you are not allowed to join this session", http.StatusForbidden)
+		return nil, nil, false
+	}
+
+	if !session.hasAccess(r) {
+		// logger.Warn("user has no access to protected session", "session", sessionId, "user", user.Name)
+		http.Error(w, "this session is protected", http.StatusForbidden)
+		return nil, nil, false
+	}
+
+	if session.full(user) {
+		// logger.Warn("session is full", "session", sessionId, "user", user.Name)
+		rateLimited.WithLabelValues(limitParticipants).Inc()
+		http.Error(w, "this session is full", http.StatusServiceUnavailable)
+		return nil, nil, false
+	}
+
+	return session, user, true
+}
+
+// messageEvent turns a message of the client into an event of the session.
+// Votes are applied to user right away.
+func (s *Session) messageEvent(ctx context.Context, user *User, msg HtmxWsResponse) (Data, error) {
+	data := Data{
+		ctx:    ctx,
+		MyUser: user,
+	}
+
+	trigger := msg.Headers.HxTrigger
+	if msg.Vote != "" {
+		vote, special, err := parseVote(s.scale, msg.Vote)
+		if err != nil {
+			return data, err
+		}
+
+		s.Lock()
+		if s.revealed != nil {
+			s.Unlock()
+			return data, ErrRoundRevealed
+		}
+		user.Vote = vote
+		user.Special = special
+		s.Unlock()
+
+		data.event = USER_VOTED
+	} else if trigger == "restart-session" {
+		data.event = RESET
+	} else if trigger == "revote" {
+		data.event = REVOTE
+	} else if trigger == "accept-round" {
+		data.event = ACCEPT
+	} else if trigger == "extend-session" {
+		data.event = EXTENDED
+	} else if trigger == "next-story" {
+		data.event = NEXT_STORY
+	} else if seconds, ok := strings.CutPrefix(trigger, "countdown-"); ok {
+		data.event = COUNTDOWN
+		data.Countdown, _ = strconv.Atoi(seconds)
+	}
+
+	return data, nil
+}
+
+func handleSSEConnection(w http.ResponseWriter, r *http.Request) {
+	httpReqs.WithLabelValues("GET /sse/{sessionId}").Inc()
+
+	session, user, ok := admitUser(w, r)
+	if !ok {
+		return
+	}
+
+	conn := newSSEConn()
+	user.Connection = conn
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// nginx would buffer the stream otherwise
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		// logger.Error("event stream can't be flushed", "error", err)
+		return
+	}
+
+	session.addUser(user)
+
+	sseConnects.Inc()
+	activeUsers.Inc()
+	defer activeUsers.Dec()
+
+	session.publish(Data{
+		ctx:       context.WithoutCancel(r.Context()),
+		event:     USER_JOINED,
+		MyUser:    user,
+		SessionId: session.Id,
+	})
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	reason := closeReasonNormal
+loop:
+	for {
+		select {
+		case msg := <-conn.messages:
+			if err := writeSSE(w, "", string(msg)); err != nil {
+				reason = closeReasonError
+				break loop
+			}
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(": ping\n\n")); err != nil {
+				reason = closeReasonError
+				break loop
+			}
+			http.NewResponseController(w).Flush()
+		case <-conn.done:
+			// Messages that were queued before closing are still sent, e.g.
+			// the page shown when the session ends
+			for len(conn.messages) > 0 {
+				writeSSE(w, "", string(<-conn.messages))
+			}
+			writeSSE(w, "close", conn.reason)
+			reason = closeReasonSessionClosed
+			break loop
+		case <-r.Context().Done():
+			break loop
+		}
+	}
+
+	conn.Close("Connection closed")
+	session.removeUser(user)
+	if !session.publish(Data{ctx: context.WithoutCancel(r.Context()), event: USER_LEFT, MyUser: user}) || session.closed() {
+		reason = closeReasonSessionClosed
+	}
+	sseDisconnects.WithLabelValues(reason).Inc()
+}
+
+// streamUser returns the user of the request if it is connected to the
+// session via an event stream. Otherwise an error is written and ok is
+// false.
+func streamUser(w http.ResponseWriter, r *http.Request) (session *Session, user *User, conn *sseConn, ok bool) {
+	session, ok = getSessionById(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return nil, nil, nil, false
+	}
+
+	identity := identify(w, r)
+	session.RLock()
+	user = session.Users[identity.Id]
+	if user != nil {
+		conn, ok = user.Connection.(*sseConn)
+	}
+	session.RUnlock()
+
+	if user == nil || !ok {
+		http.Error(w, "open the event stream of the session first", http.StatusConflict)
+		return nil, nil, nil, false
+	}
+
+	if !conn.limiter.Allow() {
+		// logger.Warn("dropping message, rate limit exceeded", "session", session.Id, "user", user.Name)
+		rateLimited.WithLabelValues(limitMessages).Inc()
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many messages", http.StatusTooManyRequests)
+		return nil, nil, nil, false
+	}
+
+	return session, user, conn, true
+}
+
+// postSSEMessage handles a message of a client that is connected via an
+// event stream. Like websocket messages, it carries a vote or the id of
+// the button that was clicked.
+func postSSEMessage(route string, message func(r *http.Request) HtmxWsResponse) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		httpReqs.WithLabelValues(route).Inc()
+
+		session, user, _, ok := streamUser(w, r)
+		if !ok {
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "could not parse form", http.StatusBadRequest)
+			return
+		}
+
+		data, err := session.messageEvent(context.WithoutCancel(r.Context()), user, message(r))
+		if errors.Is(err, ErrRoundRevealed) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			// logger.Error("invalid vote", "vote", r.Form.Get("vote"), "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !session.publish(data) {
+			http.Error(w, "session already closed", http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+var postSSEVote = postSSEMessage("POST /sse/{sessionId}/vote", func(r *http.Request) HtmxWsResponse {
+	return HtmxWsResponse{Vote: r.Form.Get("vote")}
+})
+
+var postSSEReset = postSSEMessage("POST /sse/{sessionId}/reset", func(r *http.Request) HtmxWsResponse {
+	return HtmxWsResponse{Headers: HtmxWsHeaders{HxTrigger: "restart-session"}}
+})
+
+// postSSETrigger handles the remaining buttons, e.g. countdown-30
+var postSSETrigger = postSSEMessage("POST /sse/{sessionId}/trigger", func(r *http.Request) HtmxWsResponse {
+	return HtmxWsResponse{Headers: HtmxWsHeaders{HxTrigger: r.Form.Get("trigger")}}
+})
@@ -1,30 +1,43 @@
 package main
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"math"
+	"math/big"
 	"slices"
 )
 
 // var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
 
-var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890")
+var letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
 
-type Scale []int
+// Join codes leave out characters that are easily confused, like O and 0
+var joinCodeLetters = "ABCDEFGHJKLMNPQRSTUVWXYZ"
+var joinCodeDigits = "23456789"
 
-var scales = map[string]Scale{
-	"fibonacci":   {1, 2, 3, 5, 8, 13, 21, 34, 55, 89, 144},
-	"workingdays": {1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14},
-}
+// randSeq returns a string of n characters drawn uniformly from alphabet
+// using a cryptographically secure random number generator.
+func randSeq(n int, alphabet string) string {
+	runes := []rune(alphabet)
+	max := big.NewInt(int64(len(runes)))
 
-func randSeq(n int) string {
 	b := make([]rune, n)
 	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			// crypto/rand only fails if the OS can't provide randomness
+			panic(err)
+		}
+		b[i] = runes[idx.Int64()]
 	}
 	return string(b)
 }
 
 func average(s []int) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+
 	average := 0.0
 	for _, v := range s {
 		average += float64(v)
@@ -32,6 +45,20 @@ func average(s []int) float64 {
 	return average / float64(len(s))
 }
 
+// stddev returns the population standard deviation of s
+func stddev(s []int) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+
+	mean := average(s)
+	variance := 0.0
+	for _, v := range s {
+		variance += (float64(v) - mean) * (float64(v) - mean)
+	}
+	return math.Sqrt(variance / float64(len(s)))
+}
+
 func median(s []int) float64 {
 	sCopy := make([]int, len(s))
 	copy(sCopy, s)
@@ -57,3 +84,12 @@ func recommendation(av float64, med float64, scale Scale) int {
 	}
 	return scale[len(scale)-1]
 }
+
+// truncate shortens s to at most n characters
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// All user input that is shown to others goes through the functions in this
+// file, no matter if it comes from a form or an API.
+//
+// Names are normalized to NFC, so that the same name typed on different
+// systems compares equal, and runs of whitespace are collapsed into a single
+// space. Control and formatting characters are rejected, since they can be
+// used to spoof other names, as well as the characters in rejectedCharacters.
+
+const (
+	maxUserNameLength    = 32
+	maxSessionNameLength = 64
+	// bcrypt only uses the first 72 bytes of a passphrase
+	maxPassphraseBytes = 72
+)
+
+// rejectedCharacters are not allowed in names, because they are
+// interpreted as markup by some of the places names end up in
+const rejectedCharacters = "<>`"
+
+// asciiWhitespace are control characters that are collapsed like spaces
+// instead of being rejected
+const asciiWhitespace = "\t\n\v\f\r"
+
+// zeroWidthJoiner is a formatting character, but it is needed to combine
+// emoji
+const zeroWidthJoiner = '\u200d'
+
+// ValidationError is returned for input that does not satisfy the rules.
+// Its message is meant to be shown to the user.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func invalid(field string, format string, args ...any) *ValidationError {
+	return &ValidationError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// normalizeName returns name in normal form or an error if it is empty,
+// longer than maxLength characters or contains rejected characters.
+func normalizeName(field string, label string, name string, maxLength int) (string, error) {
+	name = norm.NFC.String(name)
+
+	// the characters are checked before whitespace is collapsed, since
+	// line and paragraph separators count as whitespace
+	for _, r := range name {
+		if r == zeroWidthJoiner || strings.ContainsRune(asciiWhitespace, r) {
+			continue
+		}
+		if r == utf8.RuneError || strings.ContainsRune(rejectedCharacters, r) ||
+			unicode.In(r, unicode.Cc, unicode.Cf, unicode.Co, unicode.Zl, unicode.Zp) {
+			return "", invalid(field, "%s must not contain %q", label, r)
+		}
+	}
+
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		return "", invalid(field, "%s must not be empty", label)
+	}
+	if utf8.RuneCountInString(name) > maxLength {
+		return "", invalid(field, "%s must not be longer than %d characters", label, maxLength)
+	}
+
+	return name, nil
+}
+
+func validateUserName(name string) (string, error) {
+	return normalizeName("username", "Username", name, maxUserNameLength)
+}
+
+func validateSessionName(name string) (string, error) {
+	return normalizeName("session-name", "Session name", name, maxSessionNameLength)
+}
+
+func validatePassphrase(passphrase string) error {
+	if len(passphrase) > maxPassphraseBytes {
+		return invalid("passphrase", "Passphrase must not be longer than %d bytes", maxPassphraseBytes)
+	}
+	return nil
+}
+
+// parseVote returns the vote for value, which has to be a card of scale.
+// Special cards abstain and are returned as special.
+func parseVote(scale ScaleDefinition, value string) (vote int, special string, err error) {
+	if slices.Contains(scale.Special, value) {
+		return abstained, value, nil
+	}
+
+	vote, err = strconv.Atoi(value)
+	if err != nil || !slices.Contains(scale.Cards, vote) {
+		return 0, "", invalid("vote", "%q is not a card of the scale", value)
+	}
+	return vote, "", nil
+}
+
+// validateScale only accepts the names of scales in the registry
+func validateScale(name string) (ScaleDefinition, error) {
+	scale, ok := scales.Get(name)
+	if !ok {
+		return scale, invalid("scale", "Please choose one of the available scales")
+	}
+	return scale, nil
+}
+
+// validateAsync returns the settings of an async room, or nil if enabled
+// is false. An empty number of days uses the default.
+func validateAsync(enabled bool, days string, quorum string) (*AsyncSettings, error) {
+	if !enabled {
+		return nil, nil
+	}
+
+	settings := &AsyncSettings{Days: defaultAsyncDays}
+	if days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 || n > maxAsyncDays {
+			return nil, invalid("async-days", "Stories can be open for 1 to %d days", maxAsyncDays)
+		}
+		settings.Days = n
+	}
+	if quorum != "" {
+		n, err := strconv.Atoi(quorum)
+		if err != nil || n < 0 || n > maxAsyncQuorum {
+			return nil, invalid("async-quorum", "The quorum has to be between 0 and %d", maxAsyncQuorum)
+		}
+		settings.Quorum = n
+	}
+	return settings, nil
+}
+
+// validateStrategy only accepts the names of known recommendation
+// strategies. The default strategy is used if name is empty.
+func validateStrategy(name string) (Strategy, error) {
+	if name == "" {
+		name = defaultStrategy
+	}
+	strategy, ok := getStrategy(name)
+	if !ok {
+		return Strategy{}, invalid("strategy", "Please choose one of the available recommendation strategies")
+	}
+	return strategy, nil
+}
+
+// validateRole only accepts the configured roles. Users may choose no role.
+func validateRole(role string) (string, error) {
+	if _, ok := roleWeights[role]; role != "" && !ok {
+		return "", invalid("role", "Please choose one of the available roles")
+	}
+	return role, nil
+}
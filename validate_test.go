@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateUserName(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		field string
+	}{
+		{"plain", "Alice", "Alice", ""},
+		{"whitespace collapsed", "  Alice \t\n Smith ", "Alice Smith", ""},
+		{"nfc", "Zoe\u0301", "Zo\u00e9", ""},
+		{"zero width joiner", "Bob \U0001F469\u200d\U0001F4BB", "Bob \U0001F469\u200d\U0001F4BB", ""},
+		{"max length", strings.Repeat("\u00e9", maxUserNameLength), strings.Repeat("\u00e9", maxUserNameLength), ""},
+		{"max length after nfc", strings.Repeat("e\u0301", maxUserNameLength), strings.Repeat("\u00e9", maxUserNameLength), ""},
+		{"empty", "", "", "username"},
+		{"only whitespace", " \t ", "", "username"},
+		{"too long", strings.Repeat("a", maxUserNameLength+1), "", "username"},
+		{"null", "Al\x00ice", "", "username"},
+		{"escape", "\x1b[31mAlice", "", "username"},
+		{"next line", "Alice\u0085", "", "username"},
+		{"right-to-left override", "Alice\u202e", "", "username"},
+		{"zero width space", "Al\u200bice", "", "username"},
+		{"private use", "Alice\ue000", "", "username"},
+		{"line separator", "Alice\u2028Bob", "", "username"},
+		{"paragraph separator", "Alice\u2029Bob", "", "username"},
+		{"markup", "<b>Alice</b>", "", "username"},
+		{"invalid utf-8", "Alice\xff", "", "username"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateUserName(tt.input)
+
+			var validation *ValidationError
+			if tt.field != "" {
+				if !errors.As(err, &validation) || validation.Field != tt.field {
+					t.Errorf("validateUserName(%q) = %q, %v, want error for %s", tt.input, got, err, tt.field)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("validateUserName(%q) = %q, %v, want %q", tt.input, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSessionName(t *testing.T) {
+	if _, err := validateSessionName(strings.Repeat("a", maxSessionNameLength)); err != nil {
+		t.Errorf("session name of maximum length was rejected: %v", err)
+	}
+	if _, err := validateSessionName(strings.Repeat("a", maxSessionNameLength+1)); err == nil {
+		t.Error("too long session name was accepted")
+	}
+}
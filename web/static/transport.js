@@ -0,0 +1,137 @@
+// Some proxies block websockets. If the websocket handshake of a session
+// fails, the page falls back to server-sent events. EventStreamSocket
+// behaves like a WebSocket, so that the ws extension of htmx keeps
+// swapping updates and sending ws-send elements as before: updates arrive
+// via an EventSource, and messages are sent as POST requests.
+(function () {
+  // failedHandshakes is how many handshakes may fail before falling back
+  var failedHandshakes = 2;
+  // handshakeTimeout aborts handshakes that proxies let hang
+  var handshakeTimeout = 5000;
+  var storageKey = "pointing-poker-transport";
+
+  var failures = 0;
+
+  function fallbackActive() {
+    try {
+      return sessionStorage.getItem(storageKey) === "sse";
+    } catch (e) {
+      return false;
+    }
+  }
+
+  function activateFallback() {
+    try {
+      sessionStorage.setItem(storageKey, "sse");
+    } catch (e) {}
+  }
+
+  class EventStreamSocket extends EventTarget {
+    constructor(url) {
+      super();
+      this.CONNECTING = 0;
+      this.OPEN = 1;
+      this.CLOSING = 2;
+      this.CLOSED = 3;
+      this.readyState = this.CONNECTING;
+      this.binaryType = "blob";
+      this.onopen = null;
+      this.onclose = null;
+      this.onerror = null;
+
+      this.base = new URL(url).pathname.replace(/^\/ws\//, "/sse/");
+      this.source = new EventSource(this.base);
+
+      this.source.onopen = () => {
+        this.readyState = this.OPEN;
+        this.emit(new Event("open"));
+      };
+      this.source.onmessage = (e) => {
+        this.dispatchEvent(new MessageEvent("message", { data: e.data }));
+      };
+      // The server sends "close" when the session ends
+      this.source.addEventListener("close", () => this.finish(1000));
+      // EventSource would reconnect on its own, but the ws extension
+      // takes care of reconnecting
+      this.source.onerror = () => this.finish(1006);
+    }
+
+    emit(event) {
+      var handler = this["on" + event.type];
+      if (handler) {
+        handler.call(this, event);
+      }
+      this.dispatchEvent(event);
+    }
+
+    finish(code) {
+      if (this.readyState === this.CLOSED) {
+        return;
+      }
+      this.readyState = this.CLOSED;
+      this.source.close();
+      this.emit(new CloseEvent("close", { code: code, wasClean: code === 1000 }));
+    }
+
+    close() {
+      this.finish(1000);
+    }
+
+    // send maps a message of the ws extension to the POST endpoints
+    send(message) {
+      var msg = JSON.parse(message);
+      var headers = msg.HEADERS || {};
+      var body = new URLSearchParams();
+      var path = "/trigger";
+
+      if (msg.vote) {
+        path = "/vote";
+        body.set("vote", msg.vote);
+      } else if (headers["HX-Trigger"] === "restart-session") {
+        path = "/reset";
+      } else {
+        body.set("trigger", headers["HX-Trigger"] || "");
+      }
+
+      fetch(this.base + path, {
+        method: "POST",
+        body: body,
+        credentials: "same-origin",
+        headers: { "X-CSRF-Token": headers["X-CSRF-Token"] || "" },
+      }).then((resp) => {
+        if (!resp.ok) {
+          this.emit(new Event("error"));
+        }
+      });
+    }
+  }
+
+  var createWebSocket = htmx.createWebSocket;
+
+  htmx.createWebSocket = function (url) {
+    if (fallbackActive()) {
+      return new EventStreamSocket(url);
+    }
+
+    var socket = createWebSocket(url);
+    var opened = false;
+    var timer = setTimeout(function () {
+      if (!opened) {
+        socket.close();
+      }
+    }, handshakeTimeout);
+
+    socket.addEventListener("open", function () {
+      opened = true;
+      failures = 0;
+      clearTimeout(timer);
+    });
+    socket.addEventListener("close", function () {
+      clearTimeout(timer);
+      if (!opened && ++failures >= failedHandshakes) {
+        activateFallback();
+      }
+    });
+    return socket;
+  };
+})();
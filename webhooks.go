@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Other tools can react to sessions with outbound webhooks. Webhooks are
+// configured globally and per room. Every event is sent as JSON, signed
+// with the secret of the webhook:
+//
+//	X-Poker-Signature: sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+//
+// Deliveries are queued and sent by a pool of workers, so that slow
+// receivers never block the broadcast loop of a session. Failed deliveries
+// are retried with exponential backoff. The last deliveries are kept in a
+// log that can be read through the admin API.
+
+const (
+	webhookSessionCreated = "session.created"
+	webhookRoundRevealed  = "round.revealed"
+	webhookSessionExpired = "session.expired"
+)
+
+// webhookLogSize is the number of deliveries kept in the log
+const webhookLogSize = 200
+
+const (
+	webhookMinBackoff = time.Second
+	webhookMaxBackoff = 5 * time.Minute
+)
+
+// Webhook is an endpoint events are sent to
+type Webhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// WebhookEvent is the payload of a webhook
+type WebhookEvent struct {
+	Id        string          `json:"id"`
+	Event     string          `json:"event"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Session   WebhookSession  `json:"session"`
+	Round     *Round          `json:"round,omitempty"`
+	Story     *Story          `json:"story,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+	payload   json.RawMessage `json:"-"`
+}
+
+type WebhookSession struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Room string `json:"room,omitempty"`
+}
+
+// webhookDelivery is one attempt to send an event to a webhook
+type webhookDelivery struct {
+	webhook Webhook
+	event   *WebhookEvent
+	attempt int
+}
+
+// WebhookLogEntry is the result of a delivery attempt
+type WebhookLogEntry struct {
+	Delivery string    `json:"delivery"`
+	Event    string    `json:"event"`
+	URL      string    `json:"url"`
+	Attempt  int       `json:"attempt"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	At       time.Time `json:"at"`
+	Duration float64   `json:"durationSeconds"`
+}
+
+type webhookDispatcher struct {
+	cfg   WebhooksConfig
+	queue chan webhookDelivery
+	http  httpDoer
+
+	lockLog sync.Mutex
+	log     []WebhookLogEntry
+}
+
+// webhooks sends the events of all sessions. It is set up on startup.
+var webhooks *webhookDispatcher
+
+func newWebhookDispatcher(cfg WebhooksConfig, client httpDoer) *webhookDispatcher {
+	d := &webhookDispatcher{
+		cfg:   cfg,
+		queue: make(chan webhookDelivery, cfg.QueueSize),
+		http:  client,
+	}
+	for range cfg.Workers {
+		go d.work()
+	}
+	return d
+}
+
+func (d *webhookDispatcher) work() {
+	for delivery := range d.queue {
+		d.deliver(delivery)
+	}
+}
+
+// enqueue adds delivery to the queue. It never blocks. If the queue is
+// full, the delivery is dropped.
+func (d *webhookDispatcher) enqueue(delivery webhookDelivery) {
+	select {
+	case d.queue <- delivery:
+	default:
+		// logger.Warn("webhook queue is full, dropping delivery", "event", delivery.event.Event, "url", delivery.webhook.URL)
+		webhookDeliveries.WithLabelValues(delivery.event.Event, "dropped").Inc()
+		d.record(delivery, 0, "queue is full", 0)
+	}
+}
+
+func (d *webhookDispatcher) deliver(delivery webhookDelivery) {
+	start := time.Now()
+	status, err := d.send(delivery)
+	duration := time.Since(start)
+
+	if err == nil {
+		webhookDeliveries.WithLabelValues(delivery.event.Event, "ok").Inc()
+		d.record(delivery, status, "", duration)
+		return
+	}
+
+	d.record(delivery, status, err.Error(), duration)
+
+	if delivery.attempt >= d.cfg.MaxAttempts {
+		// logger.Warn("giving up on webhook delivery", "event", delivery.event.Event, "url", delivery.webhook.URL, "error", err)
+		webhookDeliveries.WithLabelValues(delivery.event.Event, "failed").Inc()
+		return
+	}
+
+	webhookDeliveries.WithLabelValues(delivery.event.Event, "retried").Inc()
+	retry := delivery
+	retry.attempt++
+	time.AfterFunc(webhookBackoff(delivery.attempt), func() {
+		d.enqueue(retry)
+	})
+}
+
+// webhookBackoff doubles the delay with every attempt and adds up to 20%
+// jitter, so that retries of many deliveries don't arrive at once
+func webhookBackoff(attempt int) time.Duration {
+	backoff := webhookMinBackoff << min(attempt-1, 16)
+	backoff = min(backoff, webhookMaxBackoff)
+	return backoff + rand.N(backoff/5+1)
+}
+
+func (d *webhookDispatcher) send(delivery webhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.webhook.URL, bytes.NewReader(delivery.event.payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pointing-poker-webhooks")
+	req.Header.Set("X-Poker-Event", delivery.event.Event)
+	req.Header.Set("X-Poker-Delivery", delivery.event.Id)
+	req.Header.Set("X-Poker-Timestamp", timestamp)
+	req.Header.Set("X-Poker-Signature", webhookSignature(delivery.webhook.Secret, timestamp, delivery.event.payload))
+
+	resp, err := d.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func webhookSignature(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *webhookDispatcher) record(delivery webhookDelivery, status int, err string, duration time.Duration) {
+	d.lockLog.Lock()
+	defer d.lockLog.Unlock()
+
+	d.log = append(d.log, WebhookLogEntry{
+		Delivery: delivery.event.Id,
+		Event:    delivery.event.Event,
+		URL:      delivery.webhook.URL,
+		Attempt:  delivery.attempt,
+		Status:   status,
+		Error:    err,
+		At:       time.Now(),
+		Duration: duration.Seconds(),
+	})
+	if len(d.log) > webhookLogSize {
+		d.log = d.log[len(d.log)-webhookLogSize:]
+	}
+}
+
+// deliveries returns the log, the most recent delivery first
+func (d *webhookDispatcher) deliveries() []WebhookLogEntry {
+	d.lockLog.Lock()
+	defer d.lockLog.Unlock()
+
+	entries := make([]WebhookLogEntry, 0, len(d.log))
+	for i := len(d.log) - 1; i >= 0; i-- {
+		entries = append(entries, d.log[i])
+	}
+	return entries
+}
+
+// webhooksOf returns the global webhooks and the webhooks of the room of
+// session
+func (d *webhookDispatcher) webhooksOf(session *Session) []Webhook {
+	list := make([]Webhook, 0, len(d.cfg.URLs))
+	for _, url := range d.cfg.URLs {
+		list = append(list, Webhook{URL: url, Secret: d.cfg.Secret})
+	}
+
+	if session.room != nil {
+		session.room.Lock()
+		list = append(list, session.room.Settings.Webhooks...)
+		session.room.Unlock()
+	}
+	return list
+}
+
+// emit sends event to all webhooks of session
+func (d *webhookDispatcher) emit(session *Session, event *WebhookEvent) {
+	if d == nil {
+		return
+	}
+
+	targets := d.webhooksOf(session)
+	if len(targets) == 0 {
+		return
+	}
+
+	event.Id = randSeq(20, letters)
+	event.CreatedAt = time.Now()
+	event.Session = WebhookSession{Id: session.Id, Name: session.Name}
+	if session.room != nil {
+		event.Session.Room = session.room.Slug
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		// logger.Error("could not marshal webhook event", "event", event.Event, "error", err)
+		return
+	}
+	event.payload = payload
+
+	for _, webhook := range targets {
+		d.enqueue(webhookDelivery{webhook: webhook, event: event, attempt: 1})
+	}
+}
+
+func (s *Session) emitCreated() {
+	webhooks.emit(s, &WebhookEvent{Event: webhookSessionCreated})
+}
+
+func (s *Session) emitExpired(reason string) {
+	webhooks.emit(s, &WebhookEvent{Event: webhookSessionExpired, Reason: reason})
+}
+
+// emitRevealed is a round hook
+func emitRevealed(ctx context.Context, session *Session, story *Story, round Round) {
+	webhooks.emit(session, &WebhookEvent{Event: webhookRoundRevealed, Round: &round, Story: story})
+}
+
+// validateWebhook only accepts absolute http and https URLs. A secret is
+// generated if it is empty.
+func validateWebhook(webhook Webhook) (Webhook, error) {
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return webhook, invalid("url", "%q is not a valid webhook URL", webhook.URL)
+	}
+	if webhook.Secret == "" {
+		webhook.Secret = randSeq(32, letters)
+	}
+	return webhook, nil
+}
+
+func adminGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if webhooks == nil {
+		writeJSON(w, http.StatusOK, []WebhookLogEntry{})
+		return
+	}
+	writeJSON(w, http.StatusOK, webhooks.deliveries())
+}
+
+func adminGetRoomWebhooks(w http.ResponseWriter, r *http.Request) {
+	room, err := rooms.Get(r.PathValue("slug"))
+	if err != nil {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+
+	room.Lock()
+	list := append([]Webhook{}, room.Settings.Webhooks...)
+	room.Unlock()
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// adminPutRoomWebhooks replaces the webhooks of a room. The response
+// contains the generated secrets.
+func adminPutRoomWebhooks(w http.ResponseWriter, r *http.Request) {
+	room, err := rooms.Get(r.PathValue("slug"))
+	if err != nil {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+
+	var list []Webhook
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	for i, webhook := range list {
+		if list[i], err = validateWebhook(webhook); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	room.Lock()
+	room.Settings.Webhooks = list
+	room.Unlock()
+
+	if err := rooms.Save(room); err != nil {
+		// logger.Error("could not save room", "room", room.Slug, "error", err)
+		http.Error(w, "could not save room", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// playRound lets alice and bob vote until the round is revealed
+func playRound(t *testing.T, session *Session, alice *User, bob *User, aliceVote string, bobVote string) {
+	t.Helper()
+
+	vote(t, session, alice, aliceVote)
+	vote(t, session, bob, bobVote)
+	waitFor(t, "the reveal", session.isRevealed)
+}
+
+// revealAgain tries every way of revealing the round a second time
+func revealAgain(t *testing.T, session *Session, moderator *User, voter *User) {
+	t.Helper()
+
+	// a vote that was applied while the round was being revealed
+	session.Lock()
+	voter.Vote = 3
+	session.Unlock()
+	session.publish(Data{event: USER_VOTED, MyUser: voter})
+
+	session.publish(Data{event: REVEAL, MyUser: moderator})
+	trigger(session, moderator, "countdown-30")
+
+	if session.completeRound(session.newRound()) {
+		t.Error("the revealed round was completed again")
+	}
+}
+
+func TestRevealedWebhookOncePerRound(t *testing.T) {
+	var lock sync.Mutex
+	var rounds []Round
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Poker-Signature") != webhookSignature("secret", r.Header.Get("X-Poker-Timestamp"), body) {
+			t.Errorf("invalid signature %s", r.Header.Get("X-Poker-Signature"))
+		}
+
+		var event WebhookEvent
+		json.Unmarshal(body, &event)
+		if event.Event == webhookRoundRevealed {
+			lock.Lock()
+			rounds = append(rounds, *event.Round)
+			lock.Unlock()
+		}
+	}))
+	t.Cleanup(receiver.Close)
+	received := func() []Round {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]Round{}, rounds...)
+	}
+
+	webhooks = newWebhookDispatcher(WebhooksConfig{
+		URLs:        []string{receiver.URL},
+		Secret:      "secret",
+		Workers:     1,
+		QueueSize:   16,
+		MaxAttempts: 1,
+		Timeout:     time.Second,
+	}, receiver.Client())
+	roundHooks = []RoundHook{emitRevealed}
+	t.Cleanup(func() {
+		webhooks = nil
+		roundHooks = nil
+	})
+
+	config = loadConfig()
+	session := startTestSession(t, "alice-id")
+	alice := &User{Id: "alice-id", Name: "Alice", Vote: noVote}
+	bob := &User{Id: "bob-id", Name: "Bob", Vote: noVote}
+	session.addUser(alice)
+	session.addUser(bob)
+
+	playRound(t, session, alice, bob, "5", "8")
+	revealAgain(t, session, alice, bob)
+
+	trigger(session, alice, "revote")
+	waitFor(t, "the new round", func() bool { return !session.isRevealed() })
+	playRound(t, session, alice, bob, "8", "8")
+	revealAgain(t, session, alice, bob)
+
+	waitFor(t, "the events", func() bool { return len(received()) >= 2 })
+	time.Sleep(50 * time.Millisecond)
+
+	got := received()
+	if len(got) != 2 {
+		t.Fatalf("%s was emitted %d times, want once per round", webhookRoundRevealed, len(got))
+	}
+	if got[0].Votes["bob-id"].Vote != 8 || got[1].Recommendation != 8 {
+		t.Errorf("rounds = %+v", got)
+	}
+}